@@ -0,0 +1,318 @@
+package xgraph
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AffectedResult is the result of finding the Jobs affected by a set of changed files.
+type AffectedResult struct {
+	// Targets is the sorted list of the affected targets, which may be passed to Runner.Run.
+	Targets []string
+
+	// Jobs is the reason each affected Job was selected, indexed by name.
+	// It includes the affected dependencies of the targets, and the affected Jobs added to the build by triggers.
+	Jobs map[string]*AffectedReason
+
+	// Errors is the error of each target which could not be looked up, or which has a hard dependency which could not be looked up, indexed by the name of the target.
+	// These targets are not included in Targets.
+	Errors map[string]error
+}
+
+// AffectedReason is the reason a Job is affected by a set of changed files.
+type AffectedReason struct {
+	// Changed is the sorted list of the changed files which the Job reads (see InputJob).
+	Changed []string
+
+	// Deps is the sorted list of the affected dependencies of the Job.
+	Deps []string
+}
+
+// Why explains why a Job is affected, by finding a shortest chain of dependencies from the Job to a changed file.
+// Returns the names of the Jobs in the chain, starting with the given Job, followed by the changed file.
+// Returns nil if the Job is not affected.
+func (ar *AffectedResult) Why(name string) []string {
+	if ar.Jobs[name] == nil {
+		return nil
+	}
+	from := map[string]string{name: ""}
+	queue := []string{name}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		r := ar.Jobs[cur]
+		if len(r.Changed) > 0 {
+			chain := []string{r.Changed[0]}
+			for ; cur != ""; cur = from[cur] {
+				chain = append(chain, cur)
+			}
+			for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+				chain[i], chain[j] = chain[j], chain[i]
+			}
+			return chain
+		}
+		for _, d := range r.Deps {
+			if _, ok := from[d]; !ok {
+				from[d] = cur
+				queue = append(queue, d)
+			}
+		}
+	}
+	return nil
+}
+
+// Affected finds the targets which are affected by a set of changed files.
+// A Job is affected if it reads a changed file or a directory containing one (see InputJob), or if it depends on an affected Job.
+// Order-only dependencies do not propagate changes.
+// The targets and all of their dependencies are looked up, including Jobs created by generators.
+// Jobs added by triggers (see AddFinally and AddOnFailure) are looked up if a Job they watch is, and are included in the Jobs of the result, but never in the Targets.
+// If no targets are given, the Jobs added to the Graph are used (see Jobs).
+// Aliases in the targets are replaced by their targets.
+// Relative paths, both in changed and in the inputs of Jobs, are relative to the working directory.
+//
+// Soft dependencies which cannot be looked up are skipped, as they are by the Runner.
+// If a target or one of its hard dependencies cannot be looked up, the error is recorded in the Errors of the result,
+// and Affected returns the result for the other targets along with the error of the first such target.
+func (g *Graph) Affected(changed []string, targets ...string) (*AffectedResult, error) {
+	if len(targets) == 0 {
+		targets = g.Jobs()
+	}
+	targets = g.expand(targets)
+	for i, t := range targets {
+		targets[i] = strings.TrimPrefix(t, "/")
+	}
+
+	//look up the targets and their dependencies
+	ix := newInputIndex()
+	seen := make(map[string]bool)
+	hard := make(map[string][]string)
+	failed := make(map[string]error)
+	lookup := func(stack []string) {
+		for len(stack) > 0 {
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			deps, inputs, err := g.lookupInputs(name)
+			if err != nil {
+				failed[name] = err
+				continue
+			}
+			deps = g.expandDeps(deps)
+			for _, d := range deps {
+				if d.Type == HardDependency {
+					hard[name] = append(hard[name], strings.TrimPrefix(d.Name, "/"))
+				}
+			}
+			ix.add(name, deps, inputs)
+			stack = append(stack, ix.deps[name]...)
+		}
+	}
+	stack := make([]string, 0, len(targets))
+	for i := len(targets) - 1; i >= 0; i-- {
+		stack = append(stack, targets[i])
+	}
+	lookup(stack)
+
+	//look up the jobs added by triggers, which may watch each other
+	trigs := g.listTriggers()
+	for added := true; added; {
+		added = false
+		for _, tr := range trigs {
+			name := strings.TrimPrefix(tr.name, "/")
+			if seen[name] {
+				continue
+			}
+			for _, w := range tr.watch {
+				if w = strings.TrimPrefix(w, "/"); seen[w] && failed[w] == nil {
+					lookup([]string{name})
+					added = true
+					break
+				}
+			}
+		}
+	}
+
+	res := &AffectedResult{
+		Targets: []string{},
+		Jobs:    ix.affected(changed),
+		Errors:  make(map[string]error),
+	}
+	var err error
+	sort.Strings(targets)
+	for _, t := range dedup(targets) {
+		if terr := hardLookupErr(t, hard, failed); terr != nil {
+			res.Errors[t] = terr
+			if err == nil {
+				err = terr
+			}
+			continue
+		}
+		if res.Jobs[t] != nil {
+			res.Targets = append(res.Targets, t)
+		}
+	}
+	return res, err
+}
+
+// lookupInputs looks up a Job, and lists its dependencies and inputs.
+func (g *Graph) lookupInputs(name string) ([]Dependency, []string, error) {
+	j, err := g.GetJob(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	deps, err := listDependencies(j)
+	if err != nil {
+		return nil, nil, err
+	}
+	inputs, err := listInputs(j)
+	if err != nil {
+		return nil, nil, err
+	}
+	return deps, inputs, nil
+}
+
+// hardLookupErr finds the lookup error of a job or of one of its transitive hard dependencies, in depth-first order.
+// Returns nil if the job and all of its hard dependencies were looked up.
+func hardLookupErr(name string, hard map[string][]string, failed map[string]error) error {
+	visited := map[string]bool{name: true}
+	stack := []string{name}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if err := failed[cur]; err != nil {
+			return err
+		}
+		deps := hard[cur]
+		for i := len(deps) - 1; i >= 0; i-- {
+			if !visited[deps[i]] {
+				visited[deps[i]] = true
+				stack = append(stack, deps[i])
+			}
+		}
+	}
+	return nil
+}
+
+// dedup removes adjacent duplicates from a sorted list.
+func dedup(list []string) []string {
+	out := list[:0]
+	for _, v := range list {
+		if len(out) == 0 || v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// inputIndex records the inputs and dependencies of Jobs, to find the Jobs affected by changed files.
+type inputIndex struct {
+	// inputs is the absolute paths of the inputs of each job
+	inputs map[string][]string
+
+	// deps is the names of the dependencies of each job, excluding order-only dependencies
+	deps map[string][]string
+}
+
+func newInputIndex() inputIndex {
+	return inputIndex{
+		inputs: make(map[string][]string),
+		deps:   make(map[string][]string),
+	}
+}
+
+// add records the dependencies and inputs of a job.
+// Returns the absolute paths of the inputs.
+func (ix inputIndex) add(name string, deps []Dependency, inputs []string) []string {
+	dnames := make([]string, 0, len(deps))
+	for _, d := range deps {
+		if d.Type != OrderDependency {
+			dnames = append(dnames, strings.TrimPrefix(d.Name, "/"))
+		}
+	}
+	ix.deps[name] = dnames
+	abs := make([]string, 0, len(inputs))
+	for _, in := range inputs {
+		p, err := filepath.Abs(in)
+		if err != nil {
+			continue
+		}
+		abs = append(abs, p)
+	}
+	ix.inputs[name] = abs
+	return abs
+}
+
+// affected finds the jobs which read any of the changed paths, and all jobs which depend on them.
+func (ix inputIndex) affected(changed []string) map[string]*AffectedReason {
+	//index jobs by input
+	readers := make(map[string][]string)
+	for name, inputs := range ix.inputs {
+		for _, in := range inputs {
+			readers[in] = append(readers[in], name)
+		}
+	}
+
+	//find jobs which read the changed paths or a directory containing them
+	aff := make(map[string]*AffectedReason)
+	var stack []string
+	for _, path := range changed {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			continue
+		}
+		for p := abs; ; {
+			for _, name := range readers[p] {
+				r := aff[name]
+				if r == nil {
+					r = &AffectedReason{}
+					aff[name] = r
+					stack = append(stack, name)
+				}
+				if len(r.Changed) == 0 || r.Changed[len(r.Changed)-1] != path {
+					r.Changed = append(r.Changed, path)
+				}
+			}
+			parent := filepath.Dir(p)
+			if parent == p {
+				break
+			}
+			p = parent
+		}
+	}
+
+	//add everything downstream
+	rdeps := make(map[string][]string)
+	for name, deps := range ix.deps {
+		for _, d := range deps {
+			rdeps[d] = append(rdeps[d], name)
+		}
+	}
+	for len(stack) > 0 {
+		name := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, r := range rdeps[name] {
+			if aff[r] == nil {
+				aff[r] = &AffectedReason{}
+				stack = append(stack, r)
+			}
+		}
+	}
+
+	//list the affected dependencies of each job
+	for name, r := range aff {
+		for _, d := range ix.deps[name] {
+			if aff[d] != nil {
+				r.Deps = append(r.Deps, d)
+			}
+		}
+		sort.Strings(r.Changed)
+		r.Changed = dedup(r.Changed)
+		sort.Strings(r.Deps)
+		r.Deps = dedup(r.Deps)
+	}
+	return aff
+}
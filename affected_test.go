@@ -0,0 +1,181 @@
+package xgraph
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestAffected(t *testing.T) {
+	nop := func() error { return nil }
+	g := New().AddJob(BasicJob{
+		JobName:     "lib",
+		RunCallback: nop,
+		Files:       []string{"/src/lib"},
+	}).AddJob(BasicJob{
+		JobName:     "gen",
+		RunCallback: nop,
+		Files:       []string{"/src/gen.txt"},
+	}).AddJob(BasicJob{
+		JobName:     "app",
+		Deps:        []string{"lib"},
+		OrderDeps:   []string{"gen"},
+		RunCallback: nop,
+		Files:       []string{"/src/main.go"},
+	}).AddJob(BasicJob{
+		JobName:     "test",
+		Deps:        []string{"app", "lib"},
+		RunCallback: nop,
+	}).AddJob(BasicJob{
+		JobName:     "docs",
+		RunCallback: nop,
+		Files:       []string{"/docs"},
+	})
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := New().AddJob(BasicJob{
+		JobName:     "rel",
+		RunCallback: nop,
+		Files:       []string{"testdata"},
+	})
+	errDeps := errors.New("deps failed")
+	sub := New().AddGenerator(func(name string) (Job, error) {
+		if name == "bad" {
+			return depErrJob{BasicJob{JobName: name}, errDeps}, nil
+		}
+		return BasicJob{JobName: name, RunCallback: nop, Files: []string{"/sub/" + name}}, nil
+	})
+	mounted := New().Mount("sub", sub).AddJob(BasicJob{
+		JobName:     "top",
+		Deps:        []string{"sub/x"},
+		RunCallback: nop,
+	})
+	partial := New().AddJob(BasicJob{
+		JobName:     "a",
+		SoftDeps:    []string{"gone"},
+		OrderDeps:   []string{"gone"},
+		RunCallback: nop,
+		Files:       []string{"/a"},
+	}).AddJob(BasicJob{
+		JobName:     "b",
+		Deps:        []string{"a", "gone"},
+		RunCallback: nop,
+	}).AddJob(BasicJob{
+		JobName:     "c",
+		Deps:        []string{"b"},
+		RunCallback: nop,
+	}).AddFinally(BasicJob{
+		JobName:     "cleanup",
+		RunCallback: nop,
+		Files:       []string{"/cleanup"},
+	}, "a")
+	affected := func(g *Graph, changed []string, targets ...string) (string, error) {
+		res, err := g.Affected(changed, targets...)
+		out := fmt.Sprint(res.Targets)
+		for _, name := range res.Targets {
+			out += fmt.Sprintf(" %s:%v", name, res.Why(name))
+		}
+		for _, name := range targets {
+			if terr := res.Errors[name]; terr != nil {
+				out += fmt.Sprintf(" %s:%v", name, terr)
+			}
+		}
+		return out, err
+	}
+	tests := []testCase{
+		{
+			Name:   "file",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/main.go"}},
+			Expect: []interface{}{"[app test] app:[app /src/main.go] test:[test app /src/main.go]", nil},
+		},
+		{
+			Name:   "directory",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/lib/a/b.go", "/docs/x.md"}},
+			Expect: []interface{}{"[app docs lib test] app:[app lib /src/lib/a/b.go] docs:[docs /docs/x.md] lib:[lib /src/lib/a/b.go] test:[test lib /src/lib/a/b.go]", nil},
+		},
+		{
+			Name:   "order-only",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/gen.txt"}},
+			Expect: []interface{}{"[gen] gen:[gen /src/gen.txt]", nil},
+		},
+		{
+			Name:   "targets",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/lib/x.go", "/docs/x.md"}, "test", "test"},
+			Expect: []interface{}{"[test] test:[test lib /src/lib/x.go]", nil},
+		},
+		{
+			Name:   "unaffected",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/other.go", "/"}, "test"},
+			Expect: []interface{}{"[]", nil},
+		},
+		{
+			Name:   "relative",
+			Func:   affected,
+			Args:   []interface{}{rel, []string{filepath.Join(wd, "testdata", "x")}},
+			Expect: []interface{}{fmt.Sprintf("[rel] rel:[rel %s]", filepath.Join(wd, "testdata", "x")), nil},
+		},
+		{
+			Name:   "generated",
+			Func:   affected,
+			Args:   []interface{}{mounted, []string{"/sub/x"}},
+			Expect: []interface{}{"[top] top:[top sub/x /sub/x]", nil},
+		},
+		{
+			Name:   "missing",
+			Func:   affected,
+			Args:   []interface{}{g, []string{"/src/main.go"}, "nope"},
+			Expect: []interface{}{`[] nope:job not found: "nope"`, JobNotFoundError("nope")},
+		},
+		{
+			Name:   "deps-error",
+			Func:   affected,
+			Args:   []interface{}{mounted, []string{"/sub/x"}, "sub/bad", "top"},
+			Expect: []interface{}{"[top] top:[top sub/x /sub/x] sub/bad:deps failed", errDeps},
+		},
+		{
+			Name:   "missing-dependency",
+			Func:   affected,
+			Args:   []interface{}{partial, []string{"/a/x"}, "a", "c"},
+			Expect: []interface{}{`[a] a:[a /a/x] c:job not found: "gone"`, JobNotFoundError("gone")},
+		},
+		{
+			Name: "trigger",
+			Func: func() ([]string, []string, error) {
+				res, err := partial.Affected([]string{"/cleanup/x"}, "a")
+				if err != nil {
+					return nil, nil, err
+				}
+				jobs := []string{}
+				for name := range res.Jobs {
+					jobs = append(jobs, name)
+				}
+				sort.Strings(jobs)
+				return res.Targets, jobs, nil
+			},
+			Expect: []interface{}{[]string{}, []string{"cleanup"}, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+// depErrJob is a Job which fails to list its dependencies.
+type depErrJob struct {
+	BasicJob
+	err error
+}
+
+func (dej depErrJob) DependencyList() ([]Dependency, error) {
+	return nil, dej.err
+}
@@ -0,0 +1,174 @@
+package xgraph
+
+import (
+	"sort"
+	"strings"
+)
+
+// AddAlias adds an alias to the Graph, which is a name for a group of targets.
+// Running or depending on an alias is the same as running or depending on all of its targets.
+// An alias is not a Job: it is never run, and does not appear in the results of a build.
+// The targets may be Jobs or other aliases, and are relative to the Graph like the dependencies of its Jobs.
+// If a Job has the same name as an alias, the alias is used instead of the Job.
+// In strict mode, an alias with the same name as an existing Job or alias is not added, and a *DuplicateJobError is recorded instead (see Strict).
+func (g *Graph) AddAlias(name string, targets ...string) *Graph {
+	src := caller()
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	name = strings.TrimPrefix(name, "/")
+	if g.strict {
+		if first, ok := g.firstSource(name); ok {
+			g.dups[name] = append(g.dups[name], &DuplicateJobError{
+				Name:   name,
+				First:  first,
+				Second: src,
+			})
+			return g
+		}
+	}
+	g.aliases[name] = append([]string(nil), targets...)
+	g.aliasSrcs[name] = src
+	return g
+}
+
+// Alias returns the targets of an alias, and whether the alias exists.
+// Names in a mounted namespace are searched for in the mounted Graph.
+func (g *Graph) Alias(name string) ([]string, bool) {
+	name = strings.TrimPrefix(name, "/")
+	if sub, prefix := g.lookupMount(name); sub != nil {
+		targets, ok := sub.Alias(name[len(prefix)+1:])
+		if !ok {
+			return nil, false
+		}
+		nj := nsJob{prefix: prefix}
+		for i, v := range targets {
+			targets[i] = nj.resolve(v)
+		}
+		return targets, true
+	}
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	targets, ok := g.aliases[name]
+	if !ok {
+		return nil, false
+	}
+	return append([]string(nil), targets...), true
+}
+
+// Aliases returns the sorted names of the aliases of the Graph, including the aliases of mounted Graphs.
+func (g *Graph) Aliases() []string {
+	g.lck.RLock()
+	names := make([]string, 0, len(g.aliases))
+	for name := range g.aliases {
+		names = append(names, name)
+	}
+	mounts := make(map[string]*Graph, len(g.mounts))
+	for prefix, sub := range g.mounts {
+		mounts[prefix] = sub
+	}
+	g.lck.RUnlock()
+
+	for prefix, sub := range mounts {
+		for _, name := range sub.Aliases() {
+			names = append(names, prefix+"/"+name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetDefaults sets the default targets of the Graph.
+// The default targets are run by a Runner when no targets are given, and may include aliases.
+func (g *Graph) SetDefaults(targets ...string) *Graph {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	g.defaults = append([]string(nil), targets...)
+	return g
+}
+
+// Defaults returns the default targets of the Graph.
+func (g *Graph) Defaults() []string {
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	return append([]string(nil), g.defaults...)
+}
+
+// expand replaces the aliases in a list of names with their targets, recursively.
+// An alias which refers back to itself is expanded once.
+func (g *Graph) expand(names []string) []string {
+	deps := make([]Dependency, len(names))
+	for i, v := range names {
+		deps[i] = Dependency{Name: v}
+	}
+	deps = g.expandDeps(deps)
+	out := make([]string, len(deps))
+	for i, v := range deps {
+		out[i] = v.Name
+	}
+	return out
+}
+
+// expandDeps replaces the aliases in a list of dependencies with their targets, recursively.
+// The targets have the same type of dependency as the alias.
+func (g *Graph) expandDeps(deps []Dependency) []Dependency {
+	if !g.hasAliases() {
+		return deps
+	}
+	var out []Dependency
+	for i, d := range deps {
+		targets, ok := g.Alias(d.Name)
+		if !ok {
+			if out != nil {
+				out = append(out, d)
+			}
+			continue
+		}
+		if out == nil { //copy on first alias
+			out = append(make([]Dependency, 0, len(deps)), deps[:i]...)
+		}
+		seen := map[string]bool{strings.TrimPrefix(d.Name, "/"): true}
+		out = g.expandAlias(out, targets, d.Type, seen)
+	}
+	if out == nil {
+		return deps
+	}
+	return out
+}
+
+// hasAliases checks whether the Graph or any of its mounted Graphs has aliases.
+func (g *Graph) hasAliases() bool {
+	g.lck.RLock()
+	if len(g.aliases) > 0 {
+		g.lck.RUnlock()
+		return true
+	}
+	mounts := make([]*Graph, 0, len(g.mounts))
+	for _, sub := range g.mounts {
+		mounts = append(mounts, sub)
+	}
+	g.lck.RUnlock()
+
+	for _, sub := range mounts {
+		if sub.hasAliases() {
+			return true
+		}
+	}
+	return false
+}
+
+// expandAlias appends the expanded targets of an alias to a list of dependencies.
+func (g *Graph) expandAlias(out []Dependency, targets []string, typ DependencyType, seen map[string]bool) []Dependency {
+	for _, t := range targets {
+		name := strings.TrimPrefix(t, "/")
+		sub, ok := g.Alias(name)
+		if !ok {
+			out = append(out, Dependency{Name: name, Type: typ})
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			out = g.expandAlias(out, sub, typ, seen)
+		}
+	}
+	return out
+}
@@ -0,0 +1,185 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAlias(t *testing.T) {
+	errBad := errors.New("bad")
+	nop := func() error { return nil }
+	newGraph := func() *Graph {
+		return New().
+			AddJob(BasicJob{JobName: "build", RunCallback: nop}).
+			AddJob(BasicJob{JobName: "test", Deps: []string{"build"}, RunCallback: nop}).
+			AddJob(BasicJob{JobName: "lint", RunCallback: nop}).
+			AddJob(BasicJob{JobName: "broken", RunCallback: func() error { return errBad }}).
+			AddJob(BasicJob{JobName: "release", Deps: []string{"all"}, RunCallback: nop}).
+			AddJob(BasicJob{JobName: "ship", Deps: []string{"bad"}, RunCallback: nop}).
+			AddJob(funcJob{BasicJob: BasicJob{JobName: "dynamic"}, run: func(ctx context.Context) error {
+				return AddDependencies(ctx, "ci")
+			}}).
+			AddAlias("all", "build", "test").
+			AddAlias("ci", "all", "lint", "/team/all").
+			AddAlias("bad", "broken", "lint").
+			AddAlias("loop-a", "loop-b", "build").
+			AddAlias("loop-b", "loop-a", "lint").
+			AddAlias("empty").
+			Mount("team", New().
+				AddJob(BasicJob{JobName: "x", RunCallback: nop}).
+				AddJob(BasicJob{JobName: "y", RunCallback: nop}).
+				AddAlias("all", "x", "y"))
+	}
+	// run returns the sorted names of the jobs which ran, and the errors of the jobs which failed
+	run := func(g *Graph, targets ...string) ([]string, map[string]error) {
+		defer timeout()()
+		res := (&Runner{Graph: g}).Run(context.Background(), targets...)
+		ran := []string{}
+		errs := map[string]error{}
+		for name, r := range res.Jobs {
+			if r.Ran {
+				ran = append(ran, name)
+			}
+			if r.Err != nil {
+				errs[name] = r.Err
+			}
+		}
+		sort.Strings(ran)
+		return ran, errs
+	}
+	tests := []testCase{
+		{
+			Name:   "alias",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "all"},
+			Expect: []interface{}{[]string{"build", "test"}, map[string]error{}},
+		},
+		{
+			Name:   "nested",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "ci"},
+			Expect: []interface{}{[]string{"build", "lint", "team/x", "team/y", "test"}, map[string]error{}},
+		},
+		{
+			Name:   "dependency",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "release"},
+			Expect: []interface{}{[]string{"build", "release", "test"}, map[string]error{}},
+		},
+		{
+			Name:   "dependency-failed",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "ship"},
+			Expect: []interface{}{[]string{"broken", "lint"}, map[string]error{"broken": errBad, "ship": BuildDependencyError{"broken"}}},
+		},
+		{
+			Name:   "dynamic",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "dynamic"},
+			Expect: []interface{}{[]string{"build", "dynamic", "lint", "team/x", "team/y", "test"}, map[string]error{}},
+		},
+		{
+			Name:   "cycle",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "loop-a"},
+			Expect: []interface{}{[]string{"build", "lint"}, map[string]error{}},
+		},
+		{
+			Name:   "mounted",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "team/all"},
+			Expect: []interface{}{[]string{"team/x", "team/y"}, map[string]error{}},
+		},
+		{
+			Name:   "empty",
+			Func:   run,
+			Args:   []interface{}{newGraph(), "empty"},
+			Expect: []interface{}{[]string{}, map[string]error{}},
+		},
+		{
+			Name:   "defaults",
+			Func:   run,
+			Args:   []interface{}{newGraph().SetDefaults("all", "lint")},
+			Expect: []interface{}{[]string{"build", "lint", "test"}, map[string]error{}},
+		},
+		{
+			Name:   "no-defaults",
+			Func:   run,
+			Args:   []interface{}{newGraph()},
+			Expect: []interface{}{[]string{}, map[string]error{}},
+		},
+		{
+			Name: "lookup",
+			Func: func() ([]string, bool, []string, bool) {
+				g := newGraph()
+				targets, ok := g.Alias("/ci")
+				mounted, mok := g.Alias("team/all")
+				return targets, ok, mounted, mok
+			},
+			Expect: []interface{}{[]string{"all", "lint", "/team/all"}, true, []string{"team/x", "team/y"}, true},
+		},
+		{
+			Name: "lookup-missing",
+			Func: func() ([]string, bool) {
+				return newGraph().Alias("build")
+			},
+			Expect: []interface{}{[]string(nil), false},
+		},
+		{
+			Name:   "aliases",
+			Func:   newGraph().Aliases,
+			Expect: []interface{}{[]string{"all", "bad", "ci", "empty", "loop-a", "loop-b", "team/all"}},
+		},
+		{
+			Name: "query",
+			Func: func() ([]string, error) {
+				res, err := newGraph().Query("ci")
+				if err != nil {
+					return nil, err
+				}
+				return res.Jobs, nil
+			},
+			Expect: []interface{}{[]string{"build", "lint", "team/x", "team/y", "test"}, nil},
+		},
+		{
+			Name: "strict-job-first",
+			Func: func() (string, bool, bool) {
+				g := New().Strict().
+					AddJob(BasicJob{JobName: "all", RunCallback: nop}).
+					AddAlias("all", "build")
+				errs, _ := g.Err().(DuplicateJobsError)
+				_, isAlias := g.Alias("all")
+				return errs[0].Name, len(errs) == 1 && strings.Contains(errs[0].Second, "alias_test.go:"), isAlias
+			},
+			Expect: []interface{}{"all", true, false},
+		},
+		{
+			Name: "strict-alias-first",
+			Func: func() (string, bool, bool) {
+				g := New().Strict().
+					AddAlias("all", "build").
+					AddJob(BasicJob{JobName: "all", RunCallback: nop})
+				errs, _ := g.Err().(DuplicateJobsError)
+				_, isAlias := g.Alias("all")
+				return errs[0].Name, len(errs) == 1 && strings.Contains(errs[0].First, "alias_test.go:"), isAlias
+			},
+			Expect: []interface{}{"all", true, true},
+		},
+		{
+			Name: "strict-no-duplicate",
+			Func: func() error {
+				return New().Strict().
+					AddJob(BasicJob{JobName: "build", RunCallback: nop}).
+					AddAlias("all", "build").
+					Err()
+			},
+			Expect: []interface{}{nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,479 @@
+// Package cli implements a command line interface for running an xgraph.Graph.
+//
+// Graphs are defined in Go, so a program builds its Graph and passes it to Main:
+//
+//	func main() {
+//		os.Exit(cli.Main(graph, os.Args[1:]))
+//	}
+//
+// Each subcommand lists its flags with -h.
+//
+// The run subcommand runs targets, or the default targets of the Graph (see xgraph.Graph.SetDefaults), and reports the jobs which failed with their owners (see xgraph.OwnedJob).
+// Targets may be aliases (see xgraph.Graph.AddAlias).
+// Jobs can also be run in worker processes, on remote workers, or with the parallelism of a GNU make jobserver.
+//
+// The list subcommand lists the jobs and aliases of the Graph, with their descriptions, tags and owners.
+//
+// The query subcommand prints the jobs matching a query expression (see xgraph.Graph.Query) as a list, a Graphviz DOT graph or JSON:
+//
+//	prog query 'rdeps(test-*, lib) except tag(slow, *)'
+//
+// The affected subcommand reads a list of changed files, and prints the targets they affect (see xgraph.Graph.Affected), so that CI can build only what a change affects:
+//
+//	git diff --name-only main | prog affected | xargs prog run
+//
+// Targets which could not be looked up are reported on stderr, and the exit status is 1.
+//
+// The serve subcommand serves the xgraph.Server HTTP API, to start runs and follow their events.
+//
+// The worker subcommand connects to a run started with -listen, and runs the jobs it is sent.
+// The xgraph command runs the CLI on an empty Graph, so it can be used as a worker for ExecJobs.
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jadr2ddude/xgraph"
+)
+
+// CLI is a command line interface for a Graph.
+type CLI struct {
+	// Graph is the Graph to operate on.
+	Graph *xgraph.Graph
+
+	// Stdin is the input stream.
+	Stdin io.Reader
+
+	// Stdout and Stderr are the output streams.
+	Stdout, Stderr io.Writer
+}
+
+// Main runs the command line interface with os.Stdout and os.Stderr, and returns an exit code.
+// If the program was started as a worker process by an xgraph.ProcessRunner, Main serves tasks and exits instead.
+func Main(g *xgraph.Graph, args []string) int {
+	xgraph.ProcessWorkerMain()
+	return (&CLI{
+		Graph:  g,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}).Main(args)
+}
+
+// Main runs a subcommand, and returns an exit code.
+// The exit code is 0 on success, 1 if the command failed, and 2 on a usage error.
+func (c *CLI) Main(args []string) int {
+	cmds := c.commands()
+	if len(args) == 0 {
+		c.usage(cmds)
+		return 2
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		fmt.Fprintf(c.Stderr, "unknown command %q\n", args[0])
+		c.usage(cmds)
+		return 2
+	}
+	return cmd.run(args[1:])
+}
+
+// command is a subcommand of the CLI.
+type command struct {
+	// usage is a one-line description of the arguments and purpose of the command
+	usage string
+	run   func(args []string) int
+}
+
+func (c *CLI) commands() map[string]command {
+	return map[string]command{
+		"affected": {"[-why] [-files file] [targets...]\tlist the targets affected by the changed files listed on stdin", c.affected},
+		"list":     {"[-tag tags]\tlist the jobs with their descriptions, tags and owners", c.list},
+		"query":    {"[-output list|dot|json] expr\tlist the jobs matching a query", c.query},
+		"run":      {"[-j n] [-load l] [-tag tags] [-listen addr | -isolate | -jobserver] targets...\trun targets and report failures", c.run},
+		"serve":    {"[-addr addr] [-j n] [-load l] [-runs n]\tserve the build server HTTP API", c.serve},
+		"worker":   {"[-j n] [-name name] addr\trun jobs for a run listening for workers on addr", c.worker},
+	}
+}
+
+func (c *CLI) usage(cmds map[string]command) {
+	names := make([]string, 0, len(cmds))
+	for n := range cmds {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(c.Stderr, "commands:")
+	for _, n := range names {
+		fmt.Fprintf(c.Stderr, "\t%s %s\n", n, cmds[n].usage)
+	}
+}
+
+// flags creates a FlagSet for a subcommand.
+func (c *CLI) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.Stderr)
+	return fs
+}
+
+// loadFlag adds the -load flag to a FlagSet.
+func loadFlag(fs *flag.FlagSet) *float64 {
+	return fs.Float64("load", 0, "hold back jobs while the load average per CPU is above this, on Linux (0 for no limit)")
+}
+
+// tagFlag adds the -tag flag to a FlagSet.
+func tagFlag(fs *flag.FlagSet, usage string) *string {
+	return fs.String("tag", "", usage)
+}
+
+// pool creates a WorkPool, which is load-aware if maxLoad is set.
+func pool(parallel int, maxLoad float64) *xgraph.WorkPool {
+	wp := xgraph.NewResizableWorkPool(parallel)
+	if maxLoad > 0 {
+		wp.SetLoadLimit(&xgraph.LoadLimit{MaxLoad: maxLoad})
+	}
+	return wp
+}
+
+// signalContext returns a context which is cancelled on an interrupt signal.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func (c *CLI) run(args []string) int {
+	fs := c.flags("run")
+	parallel := fs.Int("j", 0, "number of jobs to run in parallel (0 for one per CPU)")
+	listen := fs.String("listen", "", "address to accept worker connections on, which are sent the jobs implementing xgraph.RemoteJob")
+	isolate := fs.Bool("isolate", false, "run the jobs implementing xgraph.RemoteJob in worker processes running this program")
+	jobserver := fs.Bool("jobserver", false, "share parallelism with make: join the GNU make jobserver in MAKEFLAGS, or start one with -j tokens which is passed to exec jobs")
+	load := loadFlag(fs)
+	tag := tagFlag(fs, "also run the jobs with any of these comma-separated tags (see xgraph.TaggedJob)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	targets := fs.Args()
+	if *tag != "" {
+		tagged, err := c.Graph.Tagged(strings.Split(*tag, ",")...)
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+		targets = append(targets, tagged...)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	var wr xgraph.WorkRunner
+	if *listen != "" {
+		ln, err := net.Listen("tcp", *listen)
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+		rr := &xgraph.RemoteRunner{Local: *parallel}
+		go rr.Serve(ln)
+		fmt.Fprintf(c.Stderr, "listening for workers on %s\n", ln.Addr())
+		wr = rr
+	} else if *isolate {
+		wr = &xgraph.ProcessRunner{Processes: *parallel, Local: *parallel}
+	} else if *jobserver {
+		js, err := xgraph.JobserverFromEnv()
+		if err == xgraph.ErrNoJobserver {
+			js, err = xgraph.NewJobserver(*parallel)
+		}
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+		wr = js
+	} else {
+		wr = pool(*parallel, *load)
+	}
+	defer wr.Close()
+	res := (&xgraph.Runner{
+		Graph:        c.Graph,
+		WorkRunner:   wr,
+		EventHandler: &logHandler{w: c.Stderr},
+	}).Run(ctx, targets...)
+
+	if failed := res.Failed(); len(failed) > 0 {
+		for i, name := range failed {
+			if owner := res.Jobs[name].Owner; owner != "" {
+				failed[i] = fmt.Sprintf("%s (owner %s)", name, owner)
+			}
+		}
+		fmt.Fprintf(c.Stderr, "%d jobs failed: %s\n", len(failed), strings.Join(failed, ", "))
+		return 1
+	}
+	return 0
+}
+
+func (c *CLI) affected(args []string) int {
+	fs := c.flags("affected")
+	why := fs.Bool("why", false, "follow each target with a chain of dependencies leading to a changed file which it reads")
+	files := fs.String("files", "-", "file listing the changed files, one per line (- for stdin)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	in := c.Stdin
+	if *files != "-" {
+		f, err := os.Open(*files)
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	var changed []string
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			changed = append(changed, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		fmt.Fprintln(c.Stderr, err)
+		return 1
+	}
+
+	//print the targets which were looked up, even if others failed
+	res, err := c.Graph.Affected(changed, fs.Args()...)
+	for _, t := range res.Targets {
+		if *why {
+			fmt.Fprintf(c.Stdout, "%s: %s\n", t, strings.Join(res.Why(t), " -> "))
+		} else {
+			fmt.Fprintln(c.Stdout, t)
+		}
+	}
+	if err != nil {
+		failed := make([]string, 0, len(res.Errors))
+		for t := range res.Errors {
+			failed = append(failed, t)
+		}
+		sort.Strings(failed)
+		for _, t := range failed {
+			fmt.Fprintf(c.Stderr, "%s: %v\n", t, res.Errors[t])
+		}
+		return 1
+	}
+	return 0
+}
+
+func (c *CLI) list(args []string) int {
+	fs := c.flags("list")
+	tag := tagFlag(fs, "only list the jobs with any of these comma-separated tags (see xgraph.TaggedJob)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	names := c.Graph.Jobs()
+	if *tag != "" {
+		var err error
+		names, err = c.Graph.Tagged(strings.Split(*tag, ",")...)
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+	}
+	tw := tabwriter.NewWriter(c.Stdout, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		j, err := c.Graph.GetJob(name)
+		if err != nil {
+			fmt.Fprintln(c.Stderr, err)
+			return 1
+		}
+		var desc, tags, owner string
+		if dj, ok := j.(xgraph.DescribedJob); ok {
+			desc = dj.Description()
+		}
+		if tj, ok := j.(xgraph.TaggedJob); ok && len(tj.Tags()) > 0 {
+			tags = "[" + strings.Join(tj.Tags(), " ") + "]"
+		}
+		if oj, ok := j.(xgraph.OwnedJob); ok && oj.Owner() != "" {
+			owner = "owner " + oj.Owner()
+		}
+		fmt.Fprintln(tw, strings.TrimRight(strings.Join([]string{name, desc, tags, owner}, "\t"), "\t"))
+	}
+	if *tag == "" {
+		for _, name := range c.Graph.Aliases() {
+			targets, _ := c.Graph.Alias(name)
+			fmt.Fprintf(tw, "%s\talias for %s\n", name, strings.Join(targets, ", "))
+		}
+	}
+	tw.Flush()
+	return 0
+}
+
+func (c *CLI) query(args []string) int {
+	fs := c.flags("query")
+	output := fs.String("output", "list", "output format (list, dot or json)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(c.Stderr, "query requires an expression")
+		return 2
+	}
+	switch *output {
+	case "list", "dot", "json":
+	default:
+		fmt.Fprintf(c.Stderr, "unknown output format %q\n", *output)
+		return 2
+	}
+
+	res, err := c.Graph.Query(strings.Join(fs.Args(), " "))
+	if err != nil {
+		fmt.Fprintln(c.Stderr, err)
+		return 1
+	}
+	switch *output {
+	case "list":
+		for _, name := range res.Jobs {
+			fmt.Fprintln(c.Stdout, name)
+		}
+	case "dot":
+		writeDOT(c.Stdout, res)
+	case "json":
+		writeJSON(c.Stdout, res)
+	}
+	return 0
+}
+
+// writeDOT writes a query result as a Graphviz DOT graph.
+// Order-only dependencies are dashed, and soft dependencies are dotted.
+func writeDOT(w io.Writer, res *xgraph.QueryResult) {
+	fmt.Fprintln(w, "digraph xgraph {")
+	for _, name := range res.Jobs {
+		fmt.Fprintf(w, "\t%q;\n", name)
+	}
+	for _, e := range res.Edges {
+		switch e.Type {
+		case xgraph.OrderDependency:
+			fmt.Fprintf(w, "\t%q -> %q [style=dashed];\n", e.From, e.To)
+		case xgraph.SoftDependency:
+			fmt.Fprintf(w, "\t%q -> %q [style=dotted];\n", e.From, e.To)
+		default:
+			fmt.Fprintf(w, "\t%q -> %q;\n", e.From, e.To)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// jsonEdge is a dependency in the JSON output of a query.
+type jsonEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Type string `json:"type"`
+}
+
+// writeJSON writes a query result as JSON.
+func writeJSON(w io.Writer, res *xgraph.QueryResult) {
+	out := struct {
+		Jobs  []string   `json:"jobs"`
+		Edges []jsonEdge `json:"edges"`
+	}{
+		Jobs:  res.Jobs,
+		Edges: make([]jsonEdge, len(res.Edges)),
+	}
+	for i, e := range res.Edges {
+		out.Edges[i] = jsonEdge{From: e.From, To: e.To, Type: e.Type.String()}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(out)
+}
+
+func (c *CLI) serve(args []string) int {
+	fs := c.flags("serve")
+	addr := fs.String("addr", ":8080", "address to listen on")
+	parallel := fs.Int("j", 0, "number of jobs to run in parallel (0 for one per CPU)")
+	runs := fs.Int("runs", 0, "number of runs to execute at once (0 for one per CPU)")
+	load := loadFlag(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	wp := pool(*parallel, *load)
+	defer wp.Close()
+	srv := xgraph.NewServer(c.Graph, wp, *runs)
+	defer srv.Close()
+	hs := &http.Server{Addr: *addr, Handler: srv}
+	go func() {
+		<-ctx.Done()
+		hs.Close()
+	}()
+	fmt.Fprintf(c.Stderr, "serving on %s\n", *addr)
+	if err := hs.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintln(c.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (c *CLI) worker(args []string) int {
+	fs := c.flags("worker")
+	parallel := fs.Int("j", 0, "number of jobs to run in parallel (0 for one per CPU)")
+	name := fs.String("name", "", "name of the worker (defaults to host:pid)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(c.Stderr, "worker requires an address")
+		return 2
+	}
+	if *name == "" {
+		host, _ := os.Hostname()
+		*name = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+	conn, err := net.Dial("tcp", fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(c.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(c.Stderr, "worker %s connected to %s\n", *name, fs.Arg(0))
+	err = (&xgraph.Worker{Name: *name, Capacity: *parallel}).Serve(ctx, conn)
+	if err != nil {
+		fmt.Fprintln(c.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// logHandler is an xgraph.EventHandler which logs events to a Writer.
+type logHandler struct {
+	w io.Writer
+}
+
+func (lh *logHandler) OnQueued(job string) {}
+
+func (lh *logHandler) OnStart(job string) {
+	fmt.Fprintf(lh.w, "started %s\n", job)
+}
+
+func (lh *logHandler) OnFinish(job string) {
+	fmt.Fprintf(lh.w, "finished %s\n", job)
+}
+
+func (lh *logHandler) OnError(job string, err error) {
+	fmt.Fprintf(lh.w, "FAILED %s: %v\n", job, err)
+	if perr, ok := err.(*xgraph.JobPanicError); ok && perr.Job == job {
+		lh.w.Write(perr.Stack)
+	}
+}
@@ -0,0 +1,245 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jadr2ddude/xgraph"
+)
+
+// testGraph returns a Graph for testing the CLI.
+func testGraph() *xgraph.Graph {
+	return xgraph.New().
+		AddJob(xgraph.BasicJob{JobName: "build", RunCallback: func() error { return nil }}).
+		AddJob(xgraph.BasicJob{JobName: "test", Deps: []string{"build"}, RunCallback: func() error { return nil }}).
+		AddJob(xgraph.BasicJob{JobName: "broken", Deps: []string{"build"}, RunCallback: func() error { return errors.New("bad") }})
+}
+
+// runCLI runs the CLI with the arguments, and returns the exit code and output.
+func runCLI(g *xgraph.Graph, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := (&CLI{Graph: g, Stdin: strings.NewReader(""), Stdout: &stdout, Stderr: &stderr}).Main(args)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun(t *testing.T) {
+	code, _, stderr := runCLI(testGraph(), "run", "-j", "1", "test")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if stderr != "started build\nfinished build\nstarted test\nfinished test\n" {
+		t.Errorf("unexpected output: %q", stderr)
+	}
+
+	code, _, stderr = runCLI(testGraph(), "run", "-j", "2", "-load", "1000", "test")
+	if code != 0 {
+		t.Fatalf("exit code %d with load limit: %s", code, stderr)
+	}
+
+	code, _, stderr = runCLI(testGraph(), "run", "-j", "2", "-jobserver", "test")
+	if code != 0 {
+		t.Fatalf("exit code %d with jobserver: %s", code, stderr)
+	}
+
+	code, _, stderr = runCLI(testGraph(), "run", "-j", "1", "broken")
+	if code != 1 {
+		t.Errorf("expected exit code 1 but got %d", code)
+	}
+	if !strings.Contains(stderr, "FAILED broken: bad\n") || !strings.HasSuffix(stderr, "1 jobs failed: broken\n") {
+		t.Errorf("unexpected output: %q", stderr)
+	}
+}
+
+func TestAffected(t *testing.T) {
+	nop := func() error { return nil }
+	g := xgraph.New().
+		AddJob(xgraph.BasicJob{JobName: "lib", Files: []string{"/src/lib"}, RunCallback: nop}).
+		AddJob(xgraph.BasicJob{JobName: "app", Deps: []string{"lib"}, Files: []string{"/src/app"}, RunCallback: nop}).
+		AddJob(xgraph.BasicJob{JobName: "docs", Files: []string{"/docs"}, RunCallback: nop})
+	affected := func(stdin string, args ...string) (int, string, string) {
+		var stdout, stderr bytes.Buffer
+		c := &CLI{Graph: g, Stdin: strings.NewReader(stdin), Stdout: &stdout, Stderr: &stderr}
+		code := c.Main(append([]string{"affected"}, args...))
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, stdout, stderr := affected("/src/lib/a.go\n\n/docs/index.md\n")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if stdout != "app\ndocs\nlib\n" {
+		t.Errorf("unexpected output: %q", stdout)
+	}
+
+	code, stdout, stderr = affected("/src/lib/a.go\n/docs/index.md\n", "-why", "app")
+	if code != 0 {
+		t.Fatalf("exit code %d with -why: %s", code, stderr)
+	}
+	if stdout != "app: app -> lib -> /src/lib/a.go\n" {
+		t.Errorf("unexpected output with -why: %q", stdout)
+	}
+
+	code, _, stderr = affected("/src/lib/a.go\n", "nope")
+	if code != 1 || !strings.Contains(stderr, "job not found") {
+		t.Errorf("expected missing job error but got %d: %q", code, stderr)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	g := testGraph().AddJob(xgraph.BasicJob{JobName: "lint", OrderDeps: []string{"build"}, RunCallback: func() error { return nil }})
+	tests := []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"deps(test)"}, "build\ntest\n"},
+		{[]string{"-output", "list", "rdeps(*,", "build)", "except", "test"}, "broken\nbuild\n"},
+		{[]string{"-output", "dot", "deps(test) + lint"}, "digraph xgraph {\n\t\"build\";\n\t\"lint\";\n\t\"test\";\n\t\"lint\" -> \"build\" [style=dashed];\n\t\"test\" -> \"build\";\n}\n"},
+		{[]string{"-output", "json", "deps(test)"}, `{
+	"jobs": [
+		"build",
+		"test"
+	],
+	"edges": [
+		{
+			"from": "test",
+			"to": "build",
+			"type": "hard"
+		}
+	]
+}
+`},
+	}
+	for _, tc := range tests {
+		code, stdout, stderr := runCLI(g, append([]string{"query"}, tc.args...)...)
+		if code != 0 {
+			t.Errorf("exit code %d for %q: %s", code, tc.args, stderr)
+		} else if stdout != tc.stdout {
+			t.Errorf("unexpected output for %q: %q", tc.args, stdout)
+		}
+	}
+
+	code, _, stderr := runCLI(g, "query", "deps(")
+	if code != 1 || !strings.Contains(stderr, "query syntax error") {
+		t.Errorf("expected syntax error but got %d: %q", code, stderr)
+	}
+	code, _, _ = runCLI(g, "query", "-output", "svg", "test")
+	if code != 2 {
+		t.Errorf("expected exit code 2 for unknown output but got %d", code)
+	}
+}
+
+// metadataGraph returns a Graph with job metadata for testing the CLI.
+func metadataGraph() *xgraph.Graph {
+	nop := func() error { return nil }
+	return xgraph.New().
+		AddJob(xgraph.BasicJob{JobName: "build", RunCallback: nop, JobDescription: "build the binary", JobTags: []string{"ci"}}).
+		AddJob(xgraph.BasicJob{JobName: "integration", Deps: []string{"build"}, RunCallback: nop, JobDescription: "run the integration tests", JobTags: []string{"test", "slow"}, JobOwner: "team-a"}).
+		AddJob(xgraph.BasicJob{JobName: "flaky", RunCallback: func() error { return errors.New("bad") }, JobTags: []string{"slow"}, JobOwner: "team-b"}).
+		AddJob(xgraph.BasicJob{JobName: "misc", RunCallback: nop})
+}
+
+func TestList(t *testing.T) {
+	code, stdout, stderr := runCLI(metadataGraph(), "list")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	expect := "build        build the binary           [ci]\n" +
+		"flaky                                   [slow]       owner team-b\n" +
+		"integration  run the integration tests  [test slow]  owner team-a\n" +
+		"misc\n"
+	if stdout != expect {
+		t.Errorf("unexpected output: %q", stdout)
+	}
+
+	code, stdout, stderr = runCLI(metadataGraph(), "list", "-tag", "ci,test")
+	if code != 0 {
+		t.Fatalf("exit code %d with -tag: %s", code, stderr)
+	}
+	if !strings.HasPrefix(stdout, "build ") || !strings.Contains(stdout, "\nintegration ") || strings.Count(stdout, "\n") != 2 {
+		t.Errorf("unexpected output with -tag: %q", stdout)
+	}
+}
+
+func TestRunTags(t *testing.T) {
+	code, _, stderr := runCLI(metadataGraph(), "run", "-j", "1", "-tag", "test")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if stderr != "started build\nfinished build\nstarted integration\nfinished integration\n" {
+		t.Errorf("unexpected output: %q", stderr)
+	}
+
+	code, _, stderr = runCLI(metadataGraph(), "run", "-j", "1", "-tag", "slow", "misc")
+	if code != 1 {
+		t.Errorf("expected exit code 1 but got %d", code)
+	}
+	if !strings.HasSuffix(stderr, "1 jobs failed: flaky (owner team-b)\n") || !strings.Contains(stderr, "started misc\n") {
+		t.Errorf("unexpected output: %q", stderr)
+	}
+}
+
+func TestAliases(t *testing.T) {
+	g := testGraph().AddAlias("all", "test", "broken").AddAlias("ci", "all")
+	code, stdout, stderr := runCLI(g, "list")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if !strings.HasSuffix(stdout, "\nall  alias for test, broken\nci   alias for all\n") {
+		t.Errorf("unexpected output: %q", stdout)
+	}
+
+	code, _, stderr = runCLI(g, "run", "-j", "1", "ci")
+	if code != 1 || !strings.HasSuffix(stderr, "1 jobs failed: broken\n") || !strings.Contains(stderr, "finished test\n") {
+		t.Errorf("unexpected result of alias %d: %q", code, stderr)
+	}
+
+	code, _, stderr = runCLI(g.SetDefaults("test"), "run", "-j", "1")
+	if code != 0 || stderr != "started build\nfinished build\nstarted test\nfinished test\n" {
+		t.Errorf("unexpected result of defaults %d: %q", code, stderr)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{{}, {"nope"}, {"run", "-nope"}} {
+		code, _, stderr := runCLI(testGraph(), args...)
+		if code != 2 {
+			t.Errorf("expected exit code 2 for %q but got %d", args, code)
+		}
+		if stderr == "" {
+			t.Errorf("expected usage for %q", args)
+		}
+	}
+}
+
+func TestWorker(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := &xgraph.RemoteRunner{}
+	go rr.Serve(ln)
+	done := make(chan int)
+	var stderr string
+	go func() {
+		var code int
+		code, _, stderr = runCLI(xgraph.New(), "worker", "-j", "1", "-name", "w", ln.Addr().String())
+		done <- code
+	}()
+	for rr.Workers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err = rr.RunJob(context.Background(), xgraph.ExecJob{JobName: "fail", Command: "sh", Args: []string{"-c", "exit 3"}})
+	if rerr, ok := err.(*xgraph.RemoteError); !ok || rerr.Worker != "w" {
+		t.Errorf("expected error from worker but got %v", err)
+	}
+	rr.Close()
+	if code := <-done; code != 0 {
+		t.Errorf("exit code %d: %s", code, stderr)
+	}
+}
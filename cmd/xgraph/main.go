@@ -0,0 +1,19 @@
+// Command xgraph runs the xgraph command line interface on an empty Graph.
+//
+// It is mainly useful as a worker process:
+//
+//	xgraph worker -j 4 buildhost:9000
+//
+// runs ExecJobs sent by a program running "run -listen :9000".
+package main
+
+import (
+	"os"
+
+	"github.com/jadr2ddude/xgraph"
+	"github.com/jadr2ddude/xgraph/cli"
+)
+
+func main() {
+	os.Exit(cli.Main(xgraph.New(), os.Args[1:]))
+}
@@ -0,0 +1,113 @@
+package xgraph
+
+import "sync"
+
+// Coordinator deduplicates Jobs across concurrent builds by Runners which share it.
+// If a Job is already running in one build when another build dispatches it, the second build joins the run instead of running the Job again.
+// While any build using the Coordinator is in progress, a Job which has succeeded is not run again by builds using the Coordinator.
+// The outcome of a shared run is reported to the EventHandler of every build which joined it.
+// Jobs are identified by their Graph and name, so Runners may share a Coordinator even if they use different Graphs.
+// A Coordinator is safe for concurrent use.
+type Coordinator struct {
+	lck sync.Mutex
+	// active is the number of builds in progress
+	active int
+	// flights is the set of runs which are in progress, or have succeeded while builds were active
+	flights map[flightKey]*flight
+
+	// onJoin is called with the name of a Job when a build joins its run (for testing)
+	onJoin func(name string)
+}
+
+// NewCoordinator creates a new Coordinator.
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		flights: make(map[flightKey]*flight),
+	}
+}
+
+// flightKey identifies a Job in a Coordinator
+type flightKey struct {
+	g    *Graph
+	name string
+}
+
+// flight is a run of a Job which may be shared between builds.
+type flight struct {
+	// done is closed when the run completes
+	done chan struct{}
+
+	// outcome of the run
+	err     error
+	value   interface{}
+	dynDeps []string
+	dynJobs []Job
+	reduce  string
+}
+
+// begin registers a build in progress.
+func (co *Coordinator) begin() {
+	co.lck.Lock()
+	defer co.lck.Unlock()
+	co.active++
+}
+
+// end unregisters a build in progress.
+// When no builds are in progress, the completed runs are forgotten.
+func (co *Coordinator) end() {
+	co.lck.Lock()
+	defer co.lck.Unlock()
+	co.active--
+	if co.active > 0 {
+		return
+	}
+	for k, f := range co.flights {
+		select {
+		case <-f.done:
+			delete(co.flights, k)
+		default:
+		}
+	}
+}
+
+// do runs the Job of jt using fn, or joins a run of the same Job which is in flight or has succeeded.
+// The value and dynamic dependencies of the run are copied into jt.
+func (co *Coordinator) do(ex *executor, jt *jTree, fn func() error) error {
+	key := flightKey{g: ex.tb.g, name: jt.name}
+	co.lck.Lock()
+	if f := co.flights[key]; f != nil {
+		co.lck.Unlock()
+		if co.onJoin != nil {
+			co.onJoin(jt.name)
+		}
+		<-f.done
+		ex.vlck.Lock()
+		jt.value = f.value
+		jt.dynDeps = append(jt.dynDeps, f.dynDeps...)
+		jt.dynJobs = append(jt.dynJobs, f.dynJobs...)
+		jt.reduce = f.reduce
+		jt.shared = true
+		ex.vlck.Unlock()
+		return f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	co.flights[key] = f
+	co.lck.Unlock()
+
+	f.err = fn()
+	ex.vlck.Lock()
+	f.value = jt.value
+	f.dynDeps = append([]string(nil), jt.dynDeps...)
+	f.dynJobs = append([]Job(nil), jt.dynJobs...)
+	f.reduce = jt.reduce
+	ex.vlck.Unlock()
+
+	co.lck.Lock()
+	if f.err != nil { //only keep successful runs, which are forgotten once no builds are active
+		delete(co.flights, key)
+	}
+	co.lck.Unlock()
+	close(f.done)
+
+	return f.err
+}
@@ -0,0 +1,90 @@
+package xgraph
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestCoordinator(t *testing.T) {
+	var lck sync.Mutex
+	runs := map[string]int{}
+	count := func(name string) {
+		lck.Lock()
+		defer lck.Unlock()
+		runs[name]++
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g := New().
+		AddJob(BasicJob{JobName: "shared", RunCallback: func() error {
+			count("shared")
+			close(started)
+			<-release
+			return nil
+		}}).
+		AddJob(BasicJob{JobName: "a", Deps: []string{"shared"}, RunCallback: func() error { count("a"); return nil }}).
+		AddJob(BasicJob{JobName: "b", Deps: []string{"shared"}, RunCallback: func() error { count("b"); return nil }}).
+		AddJob(BasicJob{JobName: "quick", RunCallback: func() error { count("quick"); return nil }})
+	co := NewCoordinator()
+	joined := make(chan struct{})
+	co.onJoin = func(name string) {
+		if name == "shared" {
+			close(joined)
+		}
+	}
+	wp := NewWorkPool(4)
+	defer wp.Close()
+	run := func(targets ...string) *BuildResult {
+		return (&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: NoOpEventHandler,
+			Coordinator:  co,
+		}).Run(context.Background(), targets...)
+	}
+
+	defer timeout()()
+	var wg sync.WaitGroup
+	var resa, resb *BuildResult
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		resa = run("a", "quick")
+	}()
+	<-started
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sr := &startRecorder{}
+		resb = (&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: sr,
+			Coordinator:  co,
+		}).Run(context.Background(), "b", "quick")
+		if len(sr.started) != 3 {
+			t.Errorf("expected start events for all jobs but got %v", sr.started)
+		}
+	}()
+	//the run must not finish before the second build joins it
+	<-joined
+	close(release)
+	wg.Wait()
+
+	if runs["shared"] != 1 || runs["a"] != 1 || runs["b"] != 1 {
+		t.Errorf("unexpected run counts: %v", runs)
+	}
+	if resa.Jobs["shared"].Err != nil || resb.Jobs["shared"].Err != nil {
+		t.Errorf("unexpected errors: %v %v", resa.Jobs["shared"].Err, resb.Jobs["shared"].Err)
+	}
+	if resa.Jobs["shared"].Shared == resb.Jobs["shared"].Shared {
+		t.Errorf("expected exactly one build to share the run")
+	}
+
+	//once no builds are active, jobs are run again
+	run("quick")
+	if runs["quick"] < 2 {
+		t.Errorf("expected quick to be run again, but ran %d times", runs["quick"])
+	}
+}
@@ -0,0 +1,61 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotRunning indicates that a context passed to a function does not belong to a running Job.
+var ErrNotRunning = errors.New("context does not belong to a running job")
+
+// AddDependencies adds dependencies to the running Job which were discovered while running it.
+// The ctx must be the context passed to Run.
+// Names are relative to the namespace of the Job, as with Dependencies.
+// After Run returns successfully, the new dependencies are added to the build and run.
+// The Job does not complete until they have completed, so dependents of the Job are run after them.
+// If any of them fail, the Job fails with a BuildDependencyError.
+// If they would create a dependency cycle, the Job fails with a DependencyCycleError.
+func AddDependencies(ctx context.Context, deps ...string) error {
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return ErrNotRunning
+	}
+	scope.ex.vlck.Lock()
+	defer scope.ex.vlck.Unlock()
+	for _, v := range deps {
+		scope.jt.dynDeps = append(scope.jt.dynDeps, scopeName(scope.jt.job, v))
+	}
+	return nil
+}
+
+// AddJobs adds new Jobs to the running build.
+// The ctx must be the context passed to Run.
+// The Jobs are not added to the Graph, and are in the same namespace as the running Job.
+// They are added as dependencies of the running Job, as with AddDependencies.
+// If a Job with the same name is already part of the build, the running Job fails with a *DuplicateJobError.
+func AddJobs(ctx context.Context, jobs ...Job) error {
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return ErrNotRunning
+	}
+	scope.ex.vlck.Lock()
+	defer scope.ex.vlck.Unlock()
+	for _, j := range jobs {
+		scope.jt.dynJobs = append(scope.jt.dynJobs, scopeJob(scope.jt.job, j))
+	}
+	return nil
+}
+
+// setReduceJob makes a Job in the build depend on all of the Jobs added by the running Job (see FanOutJob.ReduceJob).
+// The ctx must be the context passed to Run.
+// The name is relative to the namespace of the running Job.
+func setReduceJob(ctx context.Context, name string) error {
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return ErrNotRunning
+	}
+	scope.ex.vlck.Lock()
+	defer scope.ex.vlck.Unlock()
+	scope.jt.reduce = scopeName(scope.jt.job, name)
+	return nil
+}
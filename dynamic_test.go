@@ -0,0 +1,191 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDynamic(t *testing.T) {
+	var lck sync.Mutex
+	var ran []string
+	record := func(name string) {
+		lck.Lock()
+		defer lck.Unlock()
+		ran = append(ran, name)
+	}
+	job := func(name string, run func(ctx context.Context) error, deps ...string) funcJob {
+		return funcJob{
+			BasicJob: BasicJob{JobName: name, Deps: deps},
+			run: func(ctx context.Context) error {
+				record(name)
+				if run == nil {
+					return nil
+				}
+				return run(ctx)
+			},
+		}
+	}
+	g := New().
+		AddJob(job("header", nil)).
+		AddJob(job("compile", func(ctx context.Context) error {
+			return AddDependencies(ctx, "header")
+		})).
+		AddJob(job("link", nil, "compile")).
+		AddJob(job("generate", func(ctx context.Context) error {
+			return AddJobs(ctx, job("gen1", nil), job("gen2", nil, "header"))
+		})).
+		AddJob(job("use", nil, "generate")).
+		AddJob(job("a", nil, "b")).
+		AddJob(job("b", func(ctx context.Context) error {
+			return AddDependencies(ctx, "a")
+		})).
+		AddJob(job("broken", func(ctx context.Context) error {
+			return errors.New("bad")
+		})).
+		AddJob(job("discover-broken", func(ctx context.Context) error {
+			return AddDependencies(ctx, "broken")
+		})).
+		AddJob(job("duplicate", func(ctx context.Context) error {
+			return AddJobs(ctx, job("header", nil))
+		}, "header")).
+		AddJob(job("duplicate-dynamic", func(ctx context.Context) error {
+			return AddJobs(ctx, job("gen1", nil))
+		}, "generate")).
+		AddJob(job("generate-cycle", func(ctx context.Context) error {
+			return AddJobs(ctx, job("c1", nil, "c2"), job("c2", nil, "c1"))
+		})).
+		AddJob(job("generate-tmp", func(ctx context.Context) error {
+			return AddJobs(ctx, job("tmp", nil))
+		})).
+		AddFinally(job("cleanup", nil), "tmp").
+		Mount("ns", New().
+			AddJob(job("x", nil)).
+			AddJob(job("y", func(ctx context.Context) error {
+				return AddDependencies(ctx, "x")
+			})))
+	run := func(targets ...string) ([]string, map[string]error) {
+		defer timeout()()
+		ran = nil
+		wp := NewWorkPool(2)
+		defer wp.Close()
+		res := (&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: NoOpEventHandler,
+		}).Run(context.Background(), targets...)
+		errs := make(map[string]error)
+		for n, r := range res.Jobs {
+			if r.Err != nil {
+				errs[n] = r.Err
+			}
+		}
+		return ran, errs
+	}
+	tests := []testCase{
+		{
+			Name: "dependencies",
+			Func: func() ([]string, map[string]error) {
+				return run("link")
+			},
+			Expect: []interface{}{[]string{"compile", "header", "link"}, map[string]error{}},
+		},
+		{
+			Name: "jobs",
+			Func: func() ([]string, map[string]error) {
+				r, errs := run("use")
+				sort.Strings(r[1:4])
+				return r, errs
+			},
+			Expect: []interface{}{[]string{"generate", "gen1", "gen2", "header", "use"}, map[string]error{}},
+		},
+		{
+			Name: "cycle",
+			Func: func() ([]string, map[string]error) {
+				r, errs := run("a")
+				if cyc, ok := errs["b"].(DependencyCycleError); ok {
+					sort.Strings(cyc)
+				}
+				return r, errs
+			},
+			Expect: []interface{}{[]string{"b"}, map[string]error{
+				"a": BuildDependencyError{"b"},
+				"b": DependencyCycleError{"a", "b"},
+			}},
+		},
+		{
+			Name: "failure",
+			Func: func() ([]string, map[string]error) {
+				return run("discover-broken")
+			},
+			Expect: []interface{}{[]string{"discover-broken", "broken"}, map[string]error{
+				"broken":          errors.New("bad"),
+				"discover-broken": BuildDependencyError{"broken"},
+			}},
+		},
+		{
+			Name: "duplicate",
+			Func: func() ([]string, string, bool, string) {
+				r, errs := run("duplicate")
+				dup, _ := errs["duplicate"].(*DuplicateJobError)
+				return r, dup.Name, strings.Contains(dup.First, "dynamic_test.go:"), dup.Second
+			},
+			Expect: []interface{}{[]string{"header", "duplicate"}, "header", true, "duplicate"},
+		},
+		{
+			Name: "duplicate-dynamic",
+			Func: func() ([]string, map[string]error) {
+				r, errs := run("duplicate-dynamic")
+				sort.Strings(r[1:4])
+				return r, errs
+			},
+			Expect: []interface{}{[]string{"generate", "gen1", "gen2", "header", "duplicate-dynamic"}, map[string]error{
+				"duplicate-dynamic": &DuplicateJobError{Name: "gen1", First: "generate", Second: "duplicate-dynamic"},
+			}},
+		},
+		{
+			Name: "cycle-new-jobs",
+			Func: func() ([]string, map[string]error) {
+				r, errs := run("generate-cycle")
+				for _, err := range errs {
+					if cyc, ok := err.(DependencyCycleError); ok {
+						sort.Strings(cyc)
+					}
+				}
+				return r, errs
+			},
+			Expect: []interface{}{[]string{"generate-cycle"}, map[string]error{
+				"c1":             DependencyCycleError{"c1", "c2"},
+				"c2":             DependencyCycleError{"c1", "c2"},
+				"generate-cycle": BuildDependencyError{"c1", "c2"},
+			}},
+		},
+		{
+			Name: "trigger",
+			Func: func() ([]string, map[string]error) {
+				return run("generate-tmp")
+			},
+			Expect: []interface{}{[]string{"generate-tmp", "tmp", "cleanup"}, map[string]error{}},
+		},
+		{
+			Name: "namespace",
+			Func: func() ([]string, map[string]error) {
+				return run("ns/y")
+			},
+			Expect: []interface{}{[]string{"y", "x"}, map[string]error{}},
+		},
+		{
+			Name: "not-running",
+			Func: func() (error, error) {
+				return AddDependencies(context.Background(), "x"), AddJobs(context.Background())
+			},
+			Expect: []interface{}{ErrNotRunning, ErrNotRunning},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
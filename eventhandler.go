@@ -15,6 +15,32 @@ type EventHandler interface {
 	OnError(job string, err error)
 }
 
+// CheckEventHandler is an optional interface for an EventHandler which is notified while jobs are looked up and checked.
+// Lookups and checks run on the WorkRunner, and may be slow (for example if they stat many files).
+type CheckEventHandler interface {
+	// OnResolveStart is called when a Job is being looked up and its dependencies listed
+	OnResolveStart(job string)
+
+	// OnResolveFinish is called when a Job has been looked up, with the error (if any)
+	OnResolveFinish(job string, err error)
+
+	// OnCheckStart is called when the ShouldRun method of a Job is being called
+	OnCheckStart(job string)
+
+	// OnCheckFinish is called when the ShouldRun method of a Job has returned
+	OnCheckFinish(job string, run bool, err error)
+}
+
+// WatchEventHandler is an optional interface for an EventHandler used with Runner.Watch.
+type WatchEventHandler interface {
+	// OnCycle is called when Watch starts a build, before any other events from the build.
+	// The cycle is the number of the build, starting at 1, and changed lists the inputs which changed since the last build (nil for the first build).
+	OnCycle(cycle int, changed []string)
+
+	// OnCycleFinish is called when a build started by Watch has finished or been cancelled, after any other events from the build.
+	OnCycleFinish(cycle int, result *BuildResult)
+}
+
 type nophandler struct{}
 
 func (n nophandler) OnQueued(job string)           {}
@@ -0,0 +1,153 @@
+package xgraph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ExecJob is a Job which runs a command.
+// ExecJob implements RemoteJob, so it can be run by a worker process.
+// If it is run by a Jobserver, the jobserver is passed to the command in MAKEFLAGS.
+type ExecJob struct {
+	// JobName of the ExecJob.
+	// Required.
+	JobName string
+
+	// Command is the program to run.
+	// Required.
+	Command string
+
+	// Args are the arguments to the command.
+	Args []string
+
+	// Dir is the working directory of the command.
+	// Defaults to the working directory of the process running it.
+	Dir string
+
+	// Env is a list of "KEY=value" entries added to the environment of the process running the command.
+	Env []string
+
+	// ShouldRunCallback returns whether the ExecJob should be run.
+	// Defaults to a function that always returns true.
+	ShouldRunCallback func() (bool, error)
+
+	// Deps is a list of dependencies for the ExecJob.
+	Deps []string
+
+	// Files is a list of the files and directories read by the command.
+	// They are watched by Runner.Watch.
+	Files []string
+}
+
+// Name returns the name of the Job.
+func (ej ExecJob) Name() string {
+	return ej.JobName
+}
+
+// Run runs the command.
+// If the command fails, an *ExecError is returned.
+func (ej ExecJob) Run(ctx context.Context) error {
+	return ej.spec().run(ctx)
+}
+
+// ShouldRun checks if the ExecJob should be run, using ShouldRunCallback.
+func (ej ExecJob) ShouldRun() (bool, error) {
+	if ej.ShouldRunCallback == nil {
+		return true, nil
+	}
+	return ej.ShouldRunCallback()
+}
+
+// Dependencies returns the dependencies list of the ExecJob.
+// Never returns an error.
+func (ej ExecJob) Dependencies() ([]string, error) {
+	if ej.Deps == nil {
+		return []string{}, nil
+	}
+	return ej.Deps, nil
+}
+
+// Inputs returns the Files of the ExecJob (implements InputJob).
+// Never returns an error.
+func (ej ExecJob) Inputs() ([]string, error) {
+	return ej.Files, nil
+}
+
+// RemoteTask returns a RemoteTask of kind "exec" which runs the command.
+func (ej ExecJob) RemoteTask() (*RemoteTask, error) {
+	dat, err := json.Marshal(ej.spec())
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteTask{Kind: "exec", Data: dat}, nil
+}
+
+func (ej ExecJob) spec() execSpec {
+	return execSpec{
+		Command: ej.Command,
+		Args:    ej.Args,
+		Dir:     ej.Dir,
+		Env:     ej.Env,
+	}
+}
+
+// execSpec is the serializable part of an ExecJob.
+type execSpec struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+	Dir     string   `json:"dir,omitempty"`
+	Env     []string `json:"env,omitempty"`
+}
+
+func (es execSpec) run(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, es.Command, es.Args...)
+	cmd.Dir = es.Dir
+	if len(es.Env) > 0 {
+		cmd.Env = append(os.Environ(), es.Env...)
+	}
+	setupJobserver(ctx, cmd)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return &ExecError{Command: es.Command, Err: err, Output: out.Bytes()}
+	}
+	return nil
+}
+
+func init() {
+	RegisterTaskKind("exec", func(ctx context.Context, data json.RawMessage) error {
+		var es execSpec
+		if err := json.Unmarshal(data, &es); err != nil {
+			return err
+		}
+		return es.run(ctx)
+	})
+}
+
+// ExecError is an error indicating that the command of an ExecJob failed.
+type ExecError struct {
+	// Command is the program which was run.
+	Command string
+
+	// Err is the error from running the command.
+	Err error
+
+	// Output is the combined stdout and stderr of the command.
+	Output []byte
+}
+
+func (err *ExecError) Error() string {
+	if len(err.Output) == 0 {
+		return fmt.Sprintf("command %q failed: %v", err.Command, err.Err)
+	}
+	return fmt.Sprintf("command %q failed: %v\n%s", err.Command, err.Err, bytes.TrimRight(err.Output, "\n"))
+}
+
+func (err *ExecError) Unwrap() error {
+	return err.Err
+}
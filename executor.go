@@ -2,12 +2,16 @@ package xgraph
 
 import (
 	"context"
+	"sort"
+	"strings"
 	"sync"
 )
 
 type dispatchTracker struct {
-	// job is the Job
-	job Job
+	// jt is the jTree of the Job
+	jt *jTree
+	// ex is the executor running the Job
+	ex *executor
 	// ctx is a context for running the Job
 	ctx context.Context
 	// notch is the channel to send notifications to
@@ -17,7 +21,7 @@ type dispatchTracker struct {
 // OnComplete is the completion callback used for dispatching Jobs (implements WorkTracker)
 func (dt *dispatchTracker) OnComplete(err error) {
 	dt.notch <- notification{
-		job:   dt.job,
+		jt:    dt.jt,
 		state: stateCompleted,
 		err:   err,
 	}
@@ -25,48 +29,131 @@ func (dt *dispatchTracker) OnComplete(err error) {
 
 func (dt *dispatchTracker) task() error {
 	dt.notch <- notification{
-		job:   dt.job,
+		jt:    dt.jt,
 		state: stateStarted,
 	}
-	err := dt.job.Run(dt.ctx)
-	return err
+	if dt.ex.coordinator != nil {
+		return dt.ex.coordinator.do(dt.ex, dt.jt, dt.run)
+	}
+	return dt.run()
+}
+
+// run runs the Job, using the WorkRunner if it is a JobRunner
+// Panics in the Job are returned as a *JobPanicError
+func (dt *dispatchTracker) run() error {
+	if jr, ok := dt.ex.runner.(JobRunner); ok {
+		return runJob(func() error { return jr.RunJob(dt.ctx, dt.jt.job) }, dt.jt.job)
+	}
+	return runJob(func() error { return dt.jt.job.Run(dt.ctx) }, dt.jt.job)
+}
+
+// check checks whether the Job should be run, and notifies the controller of the result
+func (dt *dispatchTracker) check() {
+	dt.notch <- notification{
+		jt:    dt.jt,
+		state: stateCheckStarted,
+	}
+	sr, err := shouldRun(dt.jt.job)
+	dt.notch <- notification{
+		jt:    dt.jt,
+		state: stateChecked,
+		run:   sr,
+		err:   err,
+	}
 }
 
 type notification struct {
-	// job is the job that this notification is about
-	job Job
+	// jt is the tree of the job that this notification is about
+	jt *jTree
 	// stats is the state which this notification is reporting
 	state int
-	// err is the error (if applicable) from the run
+	// err is the error (if applicable) from the run or check
 	err error
+	// run is the result of a check (for stateChecked)
+	run bool
+	// lookup is the result of a lookup (for stateResolved)
+	lookup resolved
+	// event is a function to call on the controller goroutine (for stateEvent)
+	event func()
 }
 
 const (
-	stateStarted   = 1
-	stateCompleted = 2
+	stateStarted      = 1
+	stateCompleted    = 2
+	stateEvent        = 3
+	stateCheckStarted = 4
+	stateChecked      = 5
+	stateResolved     = 6
+)
+
+// dispatchReq is a request to the dispatcher to look up, check, or run a job
+type dispatchReq struct {
+	jt *jTree
+	// op is the operation to do with the job
+	op int
+	// nodes are the nodes of the forest when the request was made, used to look up the dependencies of the running job
+	nodes []*jTree
+}
+
+const (
+	opRun    = 0
+	opCheck  = 1
+	opLookup = 2
 )
 
 type executor struct {
-	// forest is the jobtree we are using
-	forest map[string]*jTree
+	// tb is the treeBuilder which generated the forest, used to extend it with dynamic dependencies
+	tb *treeBuilder
 	// runner is a WorkRunner used to run Jobs
 	runner WorkRunner
 	// wg is a sync.WaitGroup used to track shutdown of the executor
 	wg sync.WaitGroup
 	// dispatchch is a channel going to a goroutine which dispatches jobs
-	dispatchch chan Job
+	dispatchch chan dispatchReq
 	// bufch is a channel going to a goroutine which buffers jobs and relays them to runch
-	bufch chan Job
+	bufch chan dispatchReq
 	// notifych is a channel carrying notifications from the running jobs
 	notifych chan notification
 	// evh is the EventHandler being used to track this build
 	evh EventHandler
-	// proms is the set of promises for rules
-	proms map[string]*Promise
-	// cbset is the set of callbacks for Job completion
-	cbset map[string]func(error)
 	// ctx is the context used for execution (with cancel)
 	ctx context.Context
+	// results is the set of results for completed jobs
+	results map[string]*JobResult
+	// vlck is a lock protecting the values and dynamic dependencies of jobs in the forest
+	vlck sync.Mutex
+	// pending is the number of jobs in the forest which have not yet completed
+	pending int
+	// coordinator is used to share runs of jobs with other executors (may be nil)
+	coordinator *Coordinator
+	// completions is a queue of jobs which have completed but have not been finished
+	completions []completion
+	// finishing is set while the completions are being processed
+	finishing bool
+	// slots and edges are scratch space used by depSet
+	slots []int32
+	edges []jEdge
+	// lookups is the number of lookups in progress
+	lookups int
+	// deferred are resolved jobs which are started once the whole forest has been resolved
+	deferred []*jTree
+	// linked is the number of nodes in the forest which have been resolved and linked
+	linked int
+	// extended are the ids of the targets of dynamic dependency edges which have not yet been checked for cycles
+	extended []int32
+	// triggers are the triggers of the Graph, and trigAdded is set for those which have been added to the build
+	triggers  []trigger
+	trigAdded []bool
+	// triggered is the set of names of triggered jobs
+	triggered map[string]bool
+	// watch is the state of a build started by Watch (may be nil)
+	watch *watchBuild
+}
+
+// completion is a job which has completed, and the error it completed with
+type completion struct {
+	jt  *jTree
+	err error
 }
 
 // startDispatcher populates dispatchch and starts a goroutine which dispatches jobs
@@ -79,23 +166,46 @@ func (ex *executor) startDispatcher() {
 		ctxdone := ex.ctx.Done()
 		for {
 			select {
-			case j, ok := <-dispatch:
+			case req, ok := <-dispatch:
 				if !ok {
 					return
 				}
+				jt := req.jt
 				dt := &dispatchTracker{
-					job:   j,
+					jt:    jt,
+					ex:    ex,
 					notch: ex.notifych,
-					ctx:   ex.ctx,
+					ctx:   context.WithValue(ex.ctx, scopeKey{}, &jobScope{ex: ex, jt: jt, nodes: req.nodes}),
+				}
+				switch req.op {
+				case opLookup:
+					ex.runner.DoTask(func() error {
+						dt.lookup()
+						return nil
+					}, CallbackTracker(func(error) {}))
+				case opCheck:
+					ex.runner.DoTask(func() error {
+						dt.check()
+						return nil
+					}, CallbackTracker(func(error) {}))
+				default:
+					ex.runner.DoTask(dt.task, dt)
 				}
-				ex.runner.DoTask(dt.task, dt)
 			case <-ctxdone:
-				for j := range dispatch { //drain dispatch buffer
-					ex.notifych <- notification{ //tell controller that they were canceled
-						job:   j,
+				for req := range dispatch { //drain dispatch buffer
+					not := notification{ //tell controller that they were canceled
+						jt:    req.jt,
 						state: stateCompleted,
 						err:   context.Canceled,
 					}
+					switch req.op {
+					case opCheck:
+						not.state = stateChecked
+					case opLookup:
+						not.state = stateResolved
+						not.lookup = resolved{err: context.Canceled}
+					}
+					ex.notifych <- not
 				}
 				return
 			}
@@ -111,7 +221,7 @@ func (ex *executor) startDispatchBuffer() {
 	go func() {
 		defer ex.wg.Done()
 		defer close(ex.dispatchch)
-		buf := []Job{} //we dont care about order so just use a stack
+		buf := []dispatchReq{} //we dont care about order so just use a stack
 		for {
 			if len(buf) == 0 {
 				j, ok := <-bufch
@@ -135,102 +245,376 @@ func (ex *executor) startDispatchBuffer() {
 	ex.bufch = bufch
 }
 
-// runJob places a job on the queue and returns a promise that resolves when the job completes
-func (ex *executor) runJob(jt *jTree) *Promise {
-	return NewPromise(func(s FinishHandler, f FailHandler) {
-		ex.cbset[jt.name] = func(err error) {
-			if err == nil {
-				s()
-			} else {
-				f(err)
-			}
+// depSet returns the distinct jobs which are the targets of a list of edges, with the effective type of the edges to each.
+// OrderDependency edges act as HardDependency edges, and failureDependency edges act as finallyDependency edges.
+// A later edge to the same job replaces an earlier one, except that a SoftDependency edge never replaces another edge.
+// The returned slice is reused by the next call.
+func (ex *executor) depSet(edges []jEdge) []jEdge {
+	if n := len(ex.tb.nodes); len(ex.slots) < n {
+		ex.slots = append(ex.slots, make([]int32, n-len(ex.slots))...)
+	}
+	set := ex.edges[:0]
+	for _, e := range edges {
+		switch e.typ {
+		case OrderDependency:
+			e.typ = HardDependency
+		case failureDependency:
+			e.typ = finallyDependency
 		}
-		ex.bufch <- jt.job
-	})
-}
-
-// promise returns a promise that resolves when a given job finished building
-func (ex *executor) promise(name string) *Promise {
-	var p *Promise
-	for p = ex.proms[name]; p == nil; p = ex.proms[name] {
-		jt := ex.forest[name]
-		ex.proms[name] = NewPromise(func(s FinishHandler, f FailHandler) {
-			//if there is a pre-existing error (e.g. dependency cycle), bail out
-			if jt.err != nil {
-				f(jt.err)
-				return
+		if i := ex.slots[e.id]; i != 0 {
+			if e.typ != SoftDependency {
+				set[i-1].typ = e.typ
 			}
+			continue
+		}
+		set = append(set, e)
+		ex.slots[e.id] = int32(len(set))
+	}
+	for _, e := range set {
+		ex.slots[e.id] = 0
+	}
+	ex.edges = set
+	return set
+}
 
-			//prep dep promise
-			var dps *Promise
-			if len(jt.deps) > 0 {
-				depps := make(map[string]*Promise)
-				for _, v := range jt.deps {
-					depps[v.name] = ex.promise(v.name)
-				}
-				dps = newBuildPromise(depps)
-			} else {
-				dps = NewPromise(func(s FinishHandler, f FailHandler) {
-					s()
-				})
+// await makes jt wait for a dependency to complete, or applies the outcome of the dependency if it already has.
+func (ex *executor) await(jt *jTree, dep *jTree, typ DependencyType) {
+	if dep.finished {
+		ex.settle(jt, dep, typ)
+		return
+	}
+	dep.rdeps = append(dep.rdeps, jEdge{id: jt.id, typ: typ})
+	jt.waiting++
+}
+
+// settle applies the outcome of a completed dependency to a job
+func (ex *executor) settle(jt *jTree, dep *jTree, typ DependencyType) {
+	if dep.outcome == nil {
+		return
+	}
+	switch typ {
+	case HardDependency:
+		jt.depFailures = append(jt.depFailures, dep.name)
+	case finallyDependency:
+		jt.failures = append(jt.failures, dep.name)
+	}
+}
+
+// start makes a job wait for its dependencies, and runs it once they have completed.
+func (ex *executor) start(jt *jTree) {
+	for _, e := range jt.deps {
+		if e.typ == failureDependency {
+			jt.watching = true
+		}
+	}
+	deps := ex.depSet(jt.deps)
+	for _, e := range deps {
+		ex.tb.nodes[e.id].refs++
+	}
+
+	//if there is a pre-existing error (e.g. dependency cycle), bail out
+	if jt.err != nil {
+		ex.complete(jt, jt.err)
+		return
+	}
+
+	for _, e := range deps {
+		ex.await(jt, ex.tb.nodes[e.id], e.typ)
+	}
+	if jt.waiting == 0 {
+		ex.ready(jt)
+	}
+}
+
+// ready is called when a job is no longer waiting for any dependencies
+func (ex *executor) ready(jt *jTree) {
+	if jt.completing {
+		return
+	}
+	if len(jt.depFailures) > 0 {
+		if err := ex.depLookupErr(jt); err != nil && !jt.extending {
+			ex.complete(jt, err)
+			return
+		}
+		sort.Strings(jt.depFailures)
+		ex.complete(jt, BuildDependencyError(jt.depFailures))
+		return
+	}
+	if jt.extending { //dynamic dependencies completed
+		ex.complete(jt, nil)
+		return
+	}
+	if jt.watching && len(jt.failures) == 0 { //on-failure job with nothing failed
+		ex.complete(jt, nil)
+		return
+	}
+	if prev := ex.watch.unchanged(jt.name); prev != nil { //keep the result from the last build
+		ex.vlck.Lock()
+		jt.value = prev.Value
+		ex.vlck.Unlock()
+		ex.complete(jt, nil)
+		return
+	}
+	sort.Strings(jt.failures)
+	ex.bufch <- dispatchReq{jt: jt, op: opCheck} //check if the job should run
+}
+
+// depLookupErr returns the error of the first hard dependency of a job which could not be looked up, if any.
+// A job fails with this error instead of a BuildDependencyError, so that the error does not depend on the order in which jobs were resolved.
+func (ex *executor) depLookupErr(jt *jTree) error {
+	for _, e := range jt.deps {
+		if d := ex.tb.nodes[e.id]; e.typ == HardDependency && d.lookupErr != nil {
+			return d.lookupErr
+		}
+	}
+	return nil
+}
+
+// checked is called with the result of checking whether a job should run
+func (ex *executor) checked(jt *jTree, run bool, err error) {
+	switch {
+	case err != nil: //error out if we cant tell whether it should be run
+		ex.complete(jt, err)
+	case run:
+		jt.started = true
+		ex.bufch <- dispatchReq{jt: jt, op: opRun, nodes: ex.tb.nodes}
+	default:
+		ex.complete(jt, nil)
+	}
+}
+
+// ran is called when a job has finished running
+func (ex *executor) ran(jt *jTree, err error) {
+	if err != nil {
+		ex.complete(jt, err)
+		return
+	}
+	ex.extend(jt)
+}
+
+// complete queues a job to be finished.
+// Jobs are finished one at a time from the queue, so that failures do not recurse through long chains of dependents.
+// A job is only completed once.
+func (ex *executor) complete(jt *jTree, err error) {
+	if jt.completing {
+		return
+	}
+	jt.completing = true
+	ex.completions = append(ex.completions, completion{jt: jt, err: err})
+	if !ex.finishing {
+		ex.drain()
+	}
+}
+
+// drain finishes the queued jobs
+func (ex *executor) drain() {
+	ex.finishing = true
+	for len(ex.completions) > 0 {
+		c := ex.completions[0]
+		ex.completions = ex.completions[1:]
+		ex.finish(c.jt, c.err)
+	}
+	ex.completions = nil
+	ex.finishing = false
+}
+
+// finish records the outcome of a job, reports it to the EventHandler, and passes it to the jobs waiting for it
+func (ex *executor) finish(jt *jTree, err error) {
+	jt.finished = true
+	jt.outcome = err
+	if err == nil {
+		ex.evh.OnFinish(jt.name)
+	} else {
+		ex.evh.OnError(jt.name, err)
+	}
+	ex.record(jt, err)
+	ex.pending--
+
+	//pass the outcome to dependents
+	rdeps := jt.rdeps
+	jt.rdeps = nil
+	for _, e := range rdeps {
+		d := ex.tb.nodes[e.id]
+		ex.settle(d, jt, e.typ)
+		d.waiting--
+		if d.waiting == 0 {
+			ex.ready(d)
+		}
+	}
+
+	//release trees which are no longer needed
+	for _, e := range ex.depSet(jt.deps) {
+		d := ex.tb.nodes[e.id]
+		d.refs--
+		if d.finished && d.refs == 0 {
+			d.release()
+		}
+	}
+	if jt.refs == 0 {
+		jt.release()
+	}
+}
+
+// release frees the parts of a completed tree which are not needed once its dependents have completed
+func (jt *jTree) release() {
+	jt.job = nil
+	jt.deps = nil
+	jt.failures = nil
+	jt.depFailures = nil
+	jt.value = nil
+}
+
+// record stores the result of a completed job
+func (ex *executor) record(jt *jTree, err error) {
+	ex.results[jt.name] = &JobResult{
+		Name:     jt.name,
+		Ran:      jt.started,
+		Err:      err,
+		Failures: jt.failures,
+		Value:    jt.value,
+		Shared:   jt.shared,
+		Owner:    jobOwner(jt.job),
+	}
+}
+
+// track starts a job in the forest, and reports the outcome to the EventHandler
+func (ex *executor) track(jt *jTree) {
+	if jt.err == nil { //if might be run, mark as queued
+		ex.evh.OnQueued(jt.name)
+	}
+	jt.tracked = true
+	ex.pending++
+	ex.start(jt)
+}
+
+// extend adds the dynamic dependencies of a job which ran successfully to the forest and starts them.
+// New jobs are resolved in parallel like the rest of the build, and the new edges are checked for cycles once they have been resolved.
+// The job completes when the dynamic dependencies complete.
+func (ex *executor) extend(jt *jTree) {
+	ex.vlck.Lock()
+	deps, jobs, reduce := jt.dynDeps, jt.dynJobs, jt.reduce
+	jt.dynDeps, jt.dynJobs, jt.reduce = nil, nil, ""
+	ex.vlck.Unlock()
+	if len(deps) == 0 && len(jobs) == 0 {
+		ex.complete(jt, nil)
+		return
+	}
+	if reduce != "" && len(jobs) > 0 {
+		if r := ex.tb.forest[strings.TrimPrefix(reduce, "/")]; r != nil && r.tracked && (r.completing || r.extending || r.waiting == 0) {
+			ex.complete(jt, ReduceStartedError(r.name))
+			return
+		}
+	}
+
+	//add new jobs to the build
+	for _, j := range jobs {
+		if name := j.Name(); ex.tb.forest[name] != nil || ex.tb.extra[name] != nil {
+			ex.complete(jt, &DuplicateJobError{
+				Name:   name,
+				First:  ex.tb.source(name),
+				Second: jt.name,
+			})
+			return
+		}
+	}
+	deps = ex.tb.g.expand(deps)
+	for _, j := range jobs {
+		name := j.Name()
+		if ex.tb.extra == nil {
+			ex.tb.extra = make(map[string]Job)
+			ex.tb.addedBy = make(map[string]string)
+		}
+		ex.tb.extra[name] = j
+		ex.tb.addedBy[name] = jt.name
+		deps = append(deps, name)
+	}
+
+	//request the new dependencies and wait for them
+	static := len(jt.deps)
+	for _, v := range deps {
+		d := ex.request(v)
+		jt.deps = append(jt.deps, jEdge{id: d.id, typ: HardDependency})
+	}
+	dyn := append([]jEdge(nil), ex.depSet(jt.deps[static:])...)
+	for _, e := range jt.deps[:static] {
+		ex.slots[e.id] = 1 //already referenced by jt
+	}
+	for _, e := range dyn {
+		d := ex.tb.nodes[e.id]
+		if ex.slots[e.id] == 0 {
+			d.refs++
+		}
+		ex.await(jt, d, HardDependency)
+		ex.extended = append(ex.extended, e.id)
+	}
+	for _, e := range jt.deps[:static] {
+		ex.slots[e.id] = 0
+	}
+	jt.extending = true
+
+	//make the reduce job depend on the new jobs
+	if reduce != "" && len(jobs) > 0 {
+		r := ex.request(reduce)
+		for _, e := range jt.deps[len(jt.deps)-len(jobs):] {
+			r.deps = append(r.deps, e)
+			if r.tracked {
+				ex.tb.nodes[e.id].refs++
+				ex.await(r, ex.tb.nodes[e.id], HardDependency)
 			}
+		}
+	}
 
-			//run dep promise
-			dps.Then(
-				func() { //on success, run build
-					sr, err := jt.job.ShouldRun() //check if the job should run
-					if err != nil {               //error out if we cant tell whether it should be run
-						f(err)
-					}
-					if sr {
-						ex.runJob(jt).Then(s, f)
-					} else {
-						s()
-					}
-				},
-				func(err error) {
-					f(err)
-				},
-			)
-		})
+	//check for cycles through the new edges, unless it waits for the lookups to complete
+	if ex.lookups == 0 {
+		ex.resolved()
+	}
+	if jt.waiting == 0 {
+		ex.ready(jt)
 	}
-	return p
 }
 
-func (ex *executor) execute() {
+func (ex *executor) execute(targets []string) {
 	// start dispatcher/buffer
 	defer ex.wg.Wait()
 	ex.startDispatcher()
 	ex.startDispatchBuffer()
 	defer close(ex.bufch)
 
-	// start build promises
-	n := len(ex.forest)
-	for _, v := range ex.forest {
-		name := v.name
-		if v.err == nil { //if might be run, mark as queued
-			ex.evh.OnQueued(name)
-		}
-		ex.promise(name).Then( //start promise
-			func() {
-				ex.evh.OnFinish(name)
-				n--
-			},
-			func(err error) {
-				ex.evh.OnError(name, err)
-				n--
-			},
-		)
+	// resolve targets, starting jobs as they are resolved
+	ex.triggers = ex.tb.g.listTriggers()
+	ex.trigAdded = make([]bool, len(ex.triggers))
+	ex.triggered = make(map[string]bool, len(ex.triggers))
+	for _, tr := range ex.triggers {
+		ex.triggered[strings.TrimPrefix(tr.name, "/")] = true
+	}
+	for _, t := range ex.tb.g.expand(targets) {
+		ex.request(t)
+	}
+	if ex.lookups == 0 {
+		ex.resolved()
 	}
 
 	// do processing loop
-	for n > 0 {
+	for ex.pending > 0 || ex.lookups > 0 {
 		not := <-ex.notifych
 		switch not.state {
 		case stateStarted:
-			ex.evh.OnStart(not.job.Name())
+			ex.evh.OnStart(not.jt.name)
 		case stateCompleted:
-			ex.cbset[not.job.Name()](not.err)
+			ex.ran(not.jt, not.err)
+		case stateEvent:
+			not.event()
+		case stateResolved:
+			ex.resolve(not.jt, not.lookup)
+		case stateCheckStarted:
+			if ceh, ok := ex.evh.(CheckEventHandler); ok {
+				ceh.OnCheckStart(not.jt.name)
+			}
+		case stateChecked:
+			if ceh, ok := ex.evh.(CheckEventHandler); ok {
+				ceh.OnCheckFinish(not.jt.name, not.run, not.err)
+			}
+			ex.checked(not.jt, not.run, not.err)
 		}
 	}
 
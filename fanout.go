@@ -0,0 +1,159 @@
+package xgraph
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FanOutJob is a Job which splits into a set of child Jobs when it is run.
+// The number of children may be decided at runtime.
+// The children are run in parallel, and are named "<JobName>/<index>".
+// The FanOutJob does not complete until all of its children have completed, and fails if any of them fail.
+// A ReduceJob may be designated to merge the results of the children.
+type FanOutJob struct {
+	// JobName of the FanOutJob.
+	// Required.
+	JobName string
+
+	// SplitCallback is called when the FanOutJob is run, and returns the child Jobs.
+	// The names of the child Jobs are replaced with hierarchical names.
+	// Dependencies of the child Jobs are relative to the namespace of the FanOutJob.
+	// Required.
+	SplitCallback func(ctx context.Context) ([]Job, error)
+
+	// ReduceJob is the name of a Job which merges the results of the children.
+	// When the children are added, the ReduceJob is made to depend on all of them, and may read their values with FanOutResults.
+	// The ReduceJob should depend on the FanOutJob, so that it has not been started when the children are added.
+	// Otherwise, the FanOutJob fails with a ReduceStartedError.
+	// The name is relative to the namespace of the FanOutJob, as with Deps.
+	// Optional.
+	ReduceJob string
+
+	// ShouldRunCallback returns whether the FanOutJob should be run.
+	// Defaults to a function that always returns true.
+	ShouldRunCallback func() (bool, error)
+
+	// Deps is a list of dependencies for the FanOutJob.
+	// Defaults to []string{}.
+	Deps []string
+}
+
+// Name returns the name of the Job.
+func (fj FanOutJob) Name() string {
+	return fj.JobName
+}
+
+// Run runs SplitCallback and adds the children to the build.
+// Returns ErrMissingCallback if SplitCallback is nil.
+func (fj FanOutJob) Run(ctx context.Context) error {
+	if fj.SplitCallback == nil {
+		return ErrMissingCallback
+	}
+	children, err := fj.SplitCallback(ctx)
+	if err != nil {
+		return err
+	}
+	jobs := make([]Job, len(children))
+	for i, v := range children {
+		jobs[i] = childJob{Job: v, name: fj.JobName + "/" + strconv.Itoa(i)}
+	}
+	if fj.ReduceJob != "" {
+		if err := setReduceJob(ctx, fj.ReduceJob); err != nil {
+			return err
+		}
+	}
+	return AddJobs(ctx, jobs...)
+}
+
+// ShouldRun checks if the FanOutJob should be run, using ShouldRunCallback.
+func (fj FanOutJob) ShouldRun() (bool, error) {
+	if fj.ShouldRunCallback == nil {
+		return true, nil
+	}
+	return fj.ShouldRunCallback()
+}
+
+// Dependencies returns the dependencies list of the FanOutJob.
+// Never returns an error.
+// If Deps is nil, returns an empty slice for the dependencies.
+func (fj FanOutJob) Dependencies() ([]string, error) {
+	if fj.Deps == nil {
+		return []string{}, nil
+	}
+	return fj.Deps, nil
+}
+
+// childJob is a child of a FanOutJob, with a hierarchical name.
+type childJob struct {
+	Job
+	name string
+}
+
+func (cj childJob) Name() string {
+	return cj.name
+}
+
+func (cj childJob) DependencyList() ([]Dependency, error) {
+	return dependencyList(cj.Job)
+}
+
+func (cj childJob) RemoteTask() (*RemoteTask, error) {
+	return remoteTask(cj.Job)
+}
+
+func (cj childJob) Inputs() ([]string, error) {
+	return jobInputs(cj.Job)
+}
+
+func (cj childJob) Description() string {
+	return jobDescription(cj.Job)
+}
+
+func (cj childJob) Tags() []string {
+	return jobTags(cj.Job)
+}
+
+func (cj childJob) Owner() string {
+	return jobOwner(cj.Job)
+}
+
+// FanOutResults returns the values produced by the children of a FanOutJob (see SetResult), in order.
+// The ctx must be the context passed to Run of the ReduceJob of the FanOutJob.
+// The name of the FanOutJob is relative to the namespace of the running Job, as with Dependencies.
+// The value of a child which did not produce one is nil.
+// Returns ErrNotRunning if ctx does not belong to a running Job.
+func FanOutResults(ctx context.Context, fanout string) ([]interface{}, error) {
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return nil, ErrNotRunning
+	}
+	prefix := strings.TrimPrefix(scopeName(scope.jt.job, fanout), "/") + "/"
+	vals := []interface{}{}
+	scope.ex.vlck.Lock()
+	defer scope.ex.vlck.Unlock()
+	for _, e := range scope.jt.deps {
+		d := scope.nodes[e.id]
+		if !strings.HasPrefix(d.name, prefix) {
+			continue
+		}
+		i, err := strconv.Atoi(d.name[len(prefix):])
+		if err != nil || i < 0 {
+			continue
+		}
+		for len(vals) <= i {
+			vals = append(vals, nil)
+		}
+		vals[i] = d.value
+	}
+	return vals, nil
+}
+
+// ReduceStartedError is an error indicating that the ReduceJob of a FanOutJob was started before the children were added.
+// The underlying string is the name of the ReduceJob.
+type ReduceStartedError string
+
+func (err ReduceStartedError) Error() string {
+	return fmt.Sprintf("reduce job %q was started before the fan-out", string(err))
+}
@@ -0,0 +1,151 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// startRecorder is an EventHandler which records the names of started jobs.
+type startRecorder struct {
+	nophandler
+	lck     sync.Mutex
+	started []string
+}
+
+func (sr *startRecorder) OnStart(job string) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	sr.started = append(sr.started, job)
+}
+
+func TestFanOut(t *testing.T) {
+	square := func(n int) Job {
+		return funcJob{run: func(ctx context.Context) error {
+			SetResult(ctx, n*n)
+			return nil
+		}}
+	}
+	split := func(n int) func(ctx context.Context) ([]Job, error) {
+		return func(ctx context.Context) ([]Job, error) {
+			jobs := make([]Job, n)
+			for i := range jobs {
+				jobs[i] = square(i + 1)
+			}
+			return jobs, nil
+		}
+	}
+	// sum is a reduce job which adds up the values of the children of a FanOutJob
+	sum := func(name string, fanout string) Job {
+		return funcJob{
+			BasicJob: BasicJob{JobName: name, Deps: []string{fanout}},
+			run: func(ctx context.Context) error {
+				vals, err := FanOutResults(ctx, fanout)
+				if err != nil {
+					return err
+				}
+				total := 0
+				for _, v := range vals {
+					total += v.(int)
+				}
+				SetResult(ctx, total)
+				return nil
+			},
+		}
+	}
+	g := New().
+		AddJob(FanOutJob{
+			JobName:       "split",
+			SplitCallback: split(4),
+			ReduceJob:     "merge",
+		}).
+		AddJob(sum("merge", "split")).
+		AddJob(FanOutJob{
+			JobName: "broken",
+			SplitCallback: func(ctx context.Context) ([]Job, error) {
+				return []Job{
+					square(1),
+					BasicJob{RunCallback: func() error { return errors.New("bad") }},
+				}, nil
+			},
+			ReduceJob: "broken-merge",
+		}).
+		AddJob(sum("broken-merge", "broken")).
+		AddJob(FanOutJob{
+			JobName:       "early",
+			SplitCallback: split(1),
+			ReduceJob:     "independent",
+		}).
+		AddJob(BasicJob{JobName: "independent", RunCallback: func() error { return nil }}).
+		AddJob(BasicJob{JobName: "early-and-independent", Deps: []string{"early", "independent"}, RunCallback: func() error { return nil }}).
+		AddJob(FanOutJob{JobName: "missing"}).
+		Mount("ns", New().
+			AddJob(FanOutJob{
+				JobName:       "split",
+				SplitCallback: split(2),
+				ReduceJob:     "merge",
+			}).
+			AddJob(sum("merge", "split")))
+	run := func(target string) (*BuildResult, []string) {
+		defer timeout()()
+		wp := NewWorkPool(4)
+		defer wp.Close()
+		sr := &startRecorder{}
+		res := (&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: sr,
+		}).Run(context.Background(), target)
+		sort.Strings(sr.started)
+		return res, sr.started
+	}
+	tests := []testCase{
+		{
+			Name: "reduce",
+			Func: func() (int, []string, error) {
+				res, started := run("merge")
+				v, err := ResultOf[int](res, "merge")
+				return v, started, err
+			},
+			Expect: []interface{}{30, []string{"merge", "split", "split/0", "split/1", "split/2", "split/3"}, nil},
+		},
+		{
+			Name: "child-failure",
+			Func: func() (error, error, error, bool) {
+				res, _ := run("broken-merge")
+				return res.Jobs["broken"].Err, res.Jobs["broken/1"].Err, res.Jobs["broken-merge"].Err, res.Jobs["broken-merge"].Ran
+			},
+			Expect: []interface{}{BuildDependencyError{"broken/1"}, errors.New("bad"), BuildDependencyError{"broken", "broken/1"}, false},
+		},
+		{
+			Name: "reduce-started",
+			Func: func() error {
+				res, _ := run("early-and-independent")
+				return res.Jobs["early"].Err
+			},
+			Expect: []interface{}{ReduceStartedError("independent")},
+		},
+		{
+			Name: "missing-callback",
+			Func: func() error {
+				res, _ := run("missing")
+				return res.Jobs["missing"].Err
+			},
+			Expect: []interface{}{ErrMissingCallback},
+		},
+		{
+			Name: "namespace",
+			Func: func() (int, []string, error) {
+				res, started := run("ns/merge")
+				v, err := ResultOf[int](res, "ns/merge")
+				return v, started, err
+			},
+			Expect: []interface{}{5, []string{"ns/merge", "ns/split", "ns/split/0", "ns/split/1"}, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
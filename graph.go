@@ -1,11 +1,37 @@
 package xgraph
 
-import "fmt"
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
 
-// Graph is an execution graph
+// Graph is an execution graph.
+// A Graph is safe for concurrent use.
 type Graph struct {
+	lck        sync.RWMutex
 	generators []JobGenerator
 	jobs       map[string]Job
+	sources    map[string]string
+	generated  map[string]bool
+	pending    map[string]*genCall
+	mounts     map[string]*Graph
+	triggers   []trigger
+	strict     bool
+	dups       map[string][]*DuplicateJobError
+	aliases    map[string][]string
+	aliasSrcs  map[string]string
+	defaults   []string
+}
+
+// genCall is an in-progress call to the generators for a single name.
+type genCall struct {
+	// done is closed when the call completes
+	done chan struct{}
+	job  Job
+	err  error
 }
 
 // New creates a new Graph
@@ -13,33 +39,361 @@ func New() *Graph {
 	return &Graph{
 		generators: []JobGenerator{},
 		jobs:       make(map[string]Job),
+		sources:    make(map[string]string),
+		generated:  make(map[string]bool),
+		pending:    make(map[string]*genCall),
+		mounts:     make(map[string]*Graph),
+		dups:       make(map[string][]*DuplicateJobError),
+		aliases:    make(map[string][]string),
+		aliasSrcs:  make(map[string]string),
 	}
 }
 
-// AddJob adds a Job to the Graph
+// Strict puts the Graph in strict mode.
+// In strict mode, AddJob and AddAlias do not overwrite an existing Job or alias with the same name.
+// Instead, a *DuplicateJobError is recorded for every duplicate, which are returned by Err.
+// GetJob returns the first *DuplicateJobError recorded for a name.
+// Use ReplaceJob to intentionally overwrite a Job.
+func (g *Graph) Strict() *Graph {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	g.strict = true
+	return g
+}
+
+// AddJob adds a Job to the Graph.
+// If a Job with the same name already exists, it is overwritten unless the Graph is in strict mode.
+// In strict mode, AddJob does not return duplicates: callers must check Err after adding Jobs.
 func (g *Graph) AddJob(job Job) *Graph {
-	g.jobs[job.Name()] = job
+	src := caller()
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	g.addJob(job, src)
+	return g
+}
+
+// addJob adds a Job which was added at src.
+// Returns false if the Job was not added because it is a duplicate in strict mode.
+// The lock must be held.
+func (g *Graph) addJob(job Job, src string) bool {
+	name := job.Name()
+	if g.strict {
+		if first, ok := g.firstSource(name); ok {
+			g.dups[name] = append(g.dups[name], &DuplicateJobError{
+				Name:   name,
+				First:  first,
+				Second: src,
+			})
+			return false
+		}
+	}
+	g.jobs[name] = job
+	g.sources[name] = src
+	delete(g.generated, name)
+	return true
+}
+
+// firstSource returns where the Job or alias with a name was added, and whether there is one.
+// The lock must be held.
+func (g *Graph) firstSource(name string) (string, bool) {
+	if g.jobs[name] != nil {
+		return g.sources[name], true
+	}
+	if _, ok := g.aliases[name]; ok {
+		return g.aliasSrcs[name], true
+	}
+	return "", false
+}
+
+// AddFinally adds a Job which is run after a set of watched Jobs finish, whether or not they succeeded.
+// The Job is added to any build which includes one of the watched Jobs, and is run after all of the watched Jobs in the build.
+// The JobResult of the Job lists the watched Jobs which failed.
+// In strict mode, a duplicate Job is not added, and does not watch the Jobs.
+func (g *Graph) AddFinally(job Job, watch ...string) *Graph {
+	src := caller()
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	if g.addJob(job, src) {
+		g.triggers = append(g.triggers, trigger{name: job.Name(), watch: watch, typ: finallyDependency})
+	}
 	return g
 }
 
+// AddOnFailure adds a Job which is run if any of a set of watched Jobs fail.
+// The Job is added to any build which includes one of the watched Jobs, and waits for all of the watched Jobs in the build.
+// If none of them failed, the Job is not run.
+// The JobResult of the Job lists the watched Jobs which failed.
+// In strict mode, a duplicate Job is not added, and does not watch the Jobs.
+func (g *Graph) AddOnFailure(job Job, watch ...string) *Graph {
+	src := caller()
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	if g.addJob(job, src) {
+		g.triggers = append(g.triggers, trigger{name: job.Name(), watch: watch, typ: failureDependency})
+	}
+	return g
+}
+
+// trigger is a Job which is added to a build when any of the watched Jobs are in the build.
+type trigger struct {
+	name  string
+	watch []string
+	typ   DependencyType
+}
+
+// listTriggers returns the triggers of the Graph, including those in mounted Graphs.
+// Names are relative to the Graph.
+func (g *Graph) listTriggers() []trigger {
+	g.lck.RLock()
+	trigs := append([]trigger(nil), g.triggers...)
+	mounts := make(map[string]*Graph, len(g.mounts))
+	for prefix, sub := range g.mounts {
+		mounts[prefix] = sub
+	}
+	g.lck.RUnlock()
+
+	for prefix, sub := range mounts {
+		for _, tr := range sub.listTriggers() {
+			nj := nsJob{prefix: prefix}
+			watch := make([]string, len(tr.watch))
+			for i, v := range tr.watch {
+				watch[i] = nj.resolve(v)
+			}
+			trigs = append(trigs, trigger{name: nj.resolve(tr.name), watch: watch, typ: tr.typ})
+		}
+	}
+	return trigs
+}
+
+// ReplaceJob adds a Job to the Graph, overwriting any existing Job with the same name.
+// Any duplicate recorded for the name in strict mode is cleared.
+func (g *Graph) ReplaceJob(job Job) *Graph {
+	src := caller()
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	name := job.Name()
+	g.jobs[name] = job
+	g.sources[name] = src
+	delete(g.generated, name)
+	delete(g.dups, name)
+	return g
+}
+
+// RemoveJob removes the Job with the given name from the Graph.
+// Any duplicate recorded for the name in strict mode is cleared.
+// Generators may create the Job again if it is requested later.
+func (g *Graph) RemoveJob(name string) *Graph {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	delete(g.jobs, name)
+	delete(g.sources, name)
+	delete(g.generated, name)
+	delete(g.dups, name)
+	return g
+}
+
+// Err returns every duplicate Job recorded in strict mode, as a DuplicateJobsError.
+// The duplicates are sorted by name, and then in the order in which they were added.
+// Returns nil if there are no duplicates.
+func (g *Graph) Err() error {
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	if len(g.dups) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(g.dups))
+	for n := range g.dups {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var errs DuplicateJobsError
+	for _, n := range names {
+		errs = append(errs, g.dups[n]...)
+	}
+	return errs
+}
+
+// DuplicateJobError is an error indicating that two Jobs with the same name, or a Job and an alias with the same name, were added to a strict Graph.
+type DuplicateJobError struct {
+	// Name is the name of the Job.
+	Name string
+
+	// First is the location (file:line) where the first Job was added.
+	// For a Job added to a build with AddJobs, it is the name of the Job which added it.
+	First string
+
+	// Second is the location (file:line) where the duplicate Job was added.
+	// For a Job added to a build with AddJobs, it is the name of the Job which added it.
+	Second string
+}
+
+func (err *DuplicateJobError) Error() string {
+	return fmt.Sprintf("duplicate job %q: added at %s and %s", err.Name, err.First, err.Second)
+}
+
+// DuplicateJobsError is a list of the duplicate Jobs added to a strict Graph.
+type DuplicateJobsError []*DuplicateJobError
+
+func (errs DuplicateJobsError) Error() string {
+	strs := make([]string, len(errs))
+	for i, v := range errs {
+		strs[i] = v.Error()
+	}
+	return strings.Join(strs, "; ")
+}
+
+// caller returns the location of the caller of the function calling caller.
+func caller() string {
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// Jobs returns the sorted names of the Jobs which have been added to the Graph, including the Jobs of mounted Graphs.
+// Jobs created by generators are not included.
+func (g *Graph) Jobs() []string {
+	g.lck.RLock()
+	names := make([]string, 0, len(g.jobs))
+	for name := range g.jobs {
+		if !g.generated[name] {
+			names = append(names, name)
+		}
+	}
+	mounts := make(map[string]*Graph, len(g.mounts))
+	for prefix, sub := range g.mounts {
+		mounts[prefix] = sub
+	}
+	g.lck.RUnlock()
+
+	for prefix, sub := range mounts {
+		for _, name := range sub.Jobs() {
+			names = append(names, prefix+"/"+name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tagged returns the sorted names of the Jobs added to the Graph (see Jobs) which have any of the tags (see TaggedJob).
+func (g *Graph) Tagged(tags ...string) ([]string, error) {
+	want := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		want[t] = true
+	}
+	names := []string{}
+	for _, name := range g.Jobs() {
+		j, err := g.GetJob(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range jobTags(j) {
+			if want[t] {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
 // AddGenerator adds a JobGenerator to the Graph
 func (g *Graph) AddGenerator(generator JobGenerator) *Graph {
+	g.lck.Lock()
+	defer g.lck.Unlock()
 	g.generators = append(g.generators, generator)
 	return g
 }
 
-func (g *Graph) generateJob(name string) (Job, error) {
-	for _, gen := range g.generators {
-		j, err := gen(name)
-		if err != nil {
-			return nil, err
+// Mount mounts another Graph under a namespace prefix.
+// A Job named "build" in sub can then be found in g as "prefix/build".
+// Dependency names of mounted Jobs are relative to the namespace, so a mounted Job depending on "lint" depends on "prefix/lint".
+// A dependency name starting with "/" is absolute, and is resolved from the root of the Graph being run.
+// Names under the prefix are looked up only in sub, so the generators of sub are scoped to the namespace.
+func (g *Graph) Mount(prefix string, sub *Graph) *Graph {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+	g.mounts[strings.Trim(prefix, "/")] = sub
+	return g
+}
+
+// lookupMount finds the Graph mounted with the longest prefix of name.
+// Returns the mounted Graph and the prefix, or nil if the name is not in a mounted namespace.
+func (g *Graph) lookupMount(name string) (*Graph, string) {
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	if len(g.mounts) == 0 {
+		return nil, ""
+	}
+	for i := strings.LastIndexByte(name, '/'); i > 0; i = strings.LastIndexByte(name[:i], '/') {
+		if sub := g.mounts[name[:i]]; sub != nil {
+			return sub, name[:i]
 		}
-		if j != nil {
-			g.AddJob(j)
-			return j, nil
+	}
+	return nil, ""
+}
+
+// generateJob runs the generators for a name.
+// If the name is already being generated by another goroutine, generateJob waits for that call instead.
+// The generators are called without holding the lock, so they may use the Graph.
+func (g *Graph) generateJob(name string) (Job, error) {
+	g.lck.Lock()
+	if j := g.jobs[name]; j != nil { //generated while we were waiting for the lock
+		g.lck.Unlock()
+		return j, nil
+	}
+	if c := g.pending[name]; c != nil { //someone else is already generating it
+		g.lck.Unlock()
+		<-c.done
+		return c.job, c.err
+	}
+	c := &genCall{done: make(chan struct{})}
+	g.pending[name] = c
+	gens := g.generators
+	g.lck.Unlock()
+
+	for _, gen := range gens {
+		c.job, c.err = gen(name)
+		if c.err != nil || c.job != nil {
+			break
 		}
 	}
-	return nil, nil
+
+	g.lck.Lock()
+	if c.job != nil {
+		g.jobs[name] = c.job
+		g.sources[name] = "generator"
+		g.generated[name] = true
+	}
+	delete(g.pending, name)
+	g.lck.Unlock()
+	close(c.done)
+
+	return c.job, c.err
+}
+
+// source returns where a Job was added to the Graph (file:line, or "generator" for generated Jobs).
+// Returns "" if the Job has not been added.
+func (g *Graph) source(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	if sub, prefix := g.lookupMount(name); sub != nil {
+		return sub.source(name[len(prefix)+1:])
+	}
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	return g.sources[name]
+}
+
+// lookupJob looks up a Job which has already been added or generated.
+// Returns an error if the name has been duplicated in strict mode.
+func (g *Graph) lookupJob(name string) (Job, error) {
+	g.lck.RLock()
+	defer g.lck.RUnlock()
+	if dups := g.dups[name]; len(dups) > 0 {
+		return nil, dups[0]
+	}
+	return g.jobs[name], nil
 }
 
 // JobNotFoundError is an error type indicating that a job was not found.
@@ -55,8 +409,24 @@ func (err JobNotFoundError) String() string {
 }
 
 // GetJob searches the Graph for a Job with the specified name.
+// If the Job is not present, the generators are used to create it.
+// Names in a mounted namespace are searched for in the mounted Graph.
 func (g *Graph) GetJob(name string) (j Job, err error) {
-	j = g.jobs[name]
+	name = strings.TrimPrefix(name, "/")
+	if sub, prefix := g.lookupMount(name); sub != nil {
+		j, err = sub.GetJob(name[len(prefix)+1:])
+		if _, ok := err.(JobNotFoundError); ok {
+			return nil, JobNotFoundError(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nsJob{Job: j, prefix: prefix}, nil
+	}
+	j, err = g.lookupJob(name)
+	if err != nil {
+		return nil, err
+	}
 	if j == nil {
 		j, err = g.generateJob(name)
 		if err != nil {
@@ -72,4 +442,85 @@ func (g *Graph) GetJob(name string) (j Job, err error) {
 // JobGenerator is a type which generates Jobs dynamically.
 // If a job with the given name should not be generated by this generator, a nil Job should be returned.
 // Any errors will be propogated.
+// A JobGenerator is called at most once at a time for a given name, but may be called concurrently for different names.
 type JobGenerator func(name string) (Job, error)
+
+// nsJob is a Job from a mounted Graph.
+// It translates the name and dependencies of the Job into the namespace of the parent Graph.
+type nsJob struct {
+	Job
+	prefix string
+}
+
+func (nj nsJob) Name() string {
+	return nj.resolve(nj.Job.Name())
+}
+
+func (nj nsJob) Dependencies() ([]string, error) {
+	deps, err := nj.Job.Dependencies()
+	if err != nil {
+		return nil, err
+	}
+	rdeps := make([]string, len(deps))
+	for i, v := range deps {
+		rdeps[i] = nj.resolve(v)
+	}
+	return rdeps, nil
+}
+
+func (nj nsJob) DependencyList() ([]Dependency, error) {
+	deps, err := dependencyList(nj.Job)
+	if err != nil {
+		return nil, err
+	}
+	rdeps := make([]Dependency, len(deps))
+	for i, v := range deps {
+		rdeps[i] = Dependency{Name: nj.resolve(v.Name), Type: v.Type}
+	}
+	return rdeps, nil
+}
+
+func (nj nsJob) RemoteTask() (*RemoteTask, error) {
+	return remoteTask(nj.Job)
+}
+
+func (nj nsJob) Inputs() ([]string, error) {
+	return jobInputs(nj.Job)
+}
+
+func (nj nsJob) Description() string {
+	return jobDescription(nj.Job)
+}
+
+func (nj nsJob) Tags() []string {
+	return jobTags(nj.Job)
+}
+
+func (nj nsJob) Owner() string {
+	return jobOwner(nj.Job)
+}
+
+// resolve converts a name relative to the namespace into a name relative to the parent Graph.
+// Absolute names are left as is.
+func (nj nsJob) resolve(name string) string {
+	if strings.HasPrefix(name, "/") {
+		return name
+	}
+	return nj.prefix + "/" + name
+}
+
+// scopeName converts a name relative to the namespace of a Job into a name relative to the root Graph.
+func scopeName(scope Job, name string) string {
+	if nj, ok := scope.(nsJob); ok {
+		return nj.resolve(scopeName(nj.Job, name))
+	}
+	return name
+}
+
+// scopeJob wraps a Job so that it is in the same namespace as another Job.
+func scopeJob(scope Job, j Job) Job {
+	if nj, ok := scope.(nsJob); ok {
+		return nsJob{Job: scopeJob(nj.Job, j), prefix: nj.prefix}
+	}
+	return j
+}
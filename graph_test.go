@@ -1,8 +1,14 @@
 package xgraph
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGraph(t *testing.T) {
@@ -85,3 +91,329 @@ func TestGraph(t *testing.T) {
 		tv.genTest(t)
 	}
 }
+
+func TestGraphConcurrent(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "add-get",
+			Func: func() error {
+				defer timeout()()
+				g := New()
+				var wg sync.WaitGroup
+				for i := 0; i < 16; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						name := fmt.Sprintf("test%d", i)
+						g.AddJob(BasicJob{JobName: name})
+						g.GetJob(name)
+					}(i)
+				}
+				wg.Wait()
+				for i := 0; i < 16; i++ {
+					if _, err := g.GetJob(fmt.Sprintf("test%d", i)); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "generate-once",
+			Func: func() int {
+				defer timeout()()
+				var lck sync.Mutex
+				calls := 0
+				g := New().AddGenerator(func(name string) (Job, error) {
+					lck.Lock()
+					calls++
+					lck.Unlock()
+					time.Sleep(10 * time.Millisecond)
+					return BasicJob{JobName: name}, nil
+				})
+				var wg sync.WaitGroup
+				for i := 0; i < 16; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						g.GetJob("test")
+					}()
+				}
+				wg.Wait()
+				return calls
+			},
+			Expect: []interface{}{1},
+		},
+		{
+			Name: "generate-recursive",
+			Func: func() (Job, error) {
+				defer timeout()()
+				g := New()
+				g.AddGenerator(func(name string) (Job, error) {
+					if name != "outer" {
+						return nil, nil
+					}
+					if _, err := g.GetJob("inner"); err != nil {
+						return nil, err
+					}
+					return BasicJob{JobName: name}, nil
+				}).AddJob(BasicJob{JobName: "inner"})
+				return g.GetJob("outer")
+			},
+			Expect: []interface{}{BasicJob{JobName: "outer"}, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestGraphMount(t *testing.T) {
+	team := New().
+		AddJob(BasicJob{JobName: "build", Deps: []string{"lint", "/tools/fmt"}}).
+		AddJob(BasicJob{JobName: "lint"}).
+		AddGenerator(func(name string) (Job, error) {
+			return BasicJob{JobName: name}, nil
+		})
+	g := New().
+		AddJob(BasicJob{JobName: "build"}).
+		Mount("team-a", team).
+		Mount("nested/team-b", New().Mount("inner", New().AddJob(BasicJob{JobName: "x", Deps: []string{"y"}})))
+	tests := []testCase{
+		{
+			Name: "name",
+			Func: func() (string, error) {
+				j, err := g.GetJob("team-a/build")
+				if err != nil {
+					return "", err
+				}
+				return j.Name(), nil
+			},
+			Expect: []interface{}{"team-a/build", nil},
+		},
+		{
+			Name: "dependencies",
+			Func: func() ([]string, error) {
+				j, err := g.GetJob("team-a/build")
+				if err != nil {
+					return nil, err
+				}
+				return j.Dependencies()
+			},
+			Expect: []interface{}{[]string{"team-a/lint", "/tools/fmt"}, nil},
+		},
+		{
+			Name: "root",
+			Func: func() (Job, error) {
+				return g.GetJob("/build")
+			},
+			Expect: []interface{}{BasicJob{JobName: "build"}, nil},
+		},
+		{
+			Name: "nested",
+			Func: func() (string, []string, error) {
+				j, err := g.GetJob("nested/team-b/inner/x")
+				if err != nil {
+					return "", nil, err
+				}
+				deps, err := j.Dependencies()
+				return j.Name(), deps, err
+			},
+			Expect: []interface{}{"nested/team-b/inner/x", []string{"nested/team-b/inner/y"}, nil},
+		},
+		{
+			Name: "generator-scoped",
+			Func: func() (Job, error) {
+				return g.GetJob("other")
+			},
+			Expect: []interface{}{nil, JobNotFoundError("other")},
+		},
+		{
+			Name: "not-found",
+			Func: func() (Job, error) {
+				return g.GetJob("nested/team-b/inner/y")
+			},
+			Expect: []interface{}{nil, JobNotFoundError("nested/team-b/inner/y")},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestGraphStrict(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "overwrite",
+			Func: func() (Job, error) {
+				return New().
+					AddJob(BasicJob{JobName: "test", Deps: []string{"a"}}).
+					AddJob(BasicJob{JobName: "test"}).
+					GetJob("test")
+			},
+			Expect: []interface{}{BasicJob{JobName: "test"}, nil},
+		},
+		{
+			Name: "duplicate",
+			Func: func() (bool, bool) {
+				g := New().Strict().
+					AddJob(BasicJob{JobName: "test"}).
+					AddJob(BasicJob{JobName: "test"})
+				_, err := g.GetJob("test")
+				dup, ok := err.(*DuplicateJobError)
+				errs, _ := g.Err().(DuplicateJobsError)
+				return ok && len(errs) == 1 && errs[0] == dup, ok && dup.First != dup.Second &&
+					strings.Contains(dup.First, "graph_test.go:") && strings.Contains(dup.Second, "graph_test.go:")
+			},
+			Expect: []interface{}{true, true},
+		},
+		{
+			Name:   "duplicate-error",
+			Func:   (&DuplicateJobError{Name: "lint", First: "a.go:1", Second: "b.go:2"}).Error,
+			Expect: []interface{}{"duplicate job \"lint\": added at a.go:1 and b.go:2"},
+		},
+		{
+			Name: "duplicates",
+			Func: func() ([]string, bool) {
+				g := New().Strict().
+					AddJob(BasicJob{JobName: "test"}).
+					AddJob(BasicJob{JobName: "lint"}).
+					AddJob(BasicJob{JobName: "test"}).
+					AddJob(BasicJob{JobName: "lint"}).
+					AddJob(BasicJob{JobName: "test"})
+				errs, _ := g.Err().(DuplicateJobsError)
+				names := []string{}
+				for _, v := range errs {
+					names = append(names, v.Name)
+				}
+				_, err := g.GetJob("test")
+				return names, err == errs[1]
+			},
+			Expect: []interface{}{[]string{"lint", "test", "test"}, true},
+		},
+		{
+			Name: "duplicates-error",
+			Func: DuplicateJobsError{
+				{Name: "lint", First: "a.go:1", Second: "b.go:2"},
+				{Name: "test", First: "a.go:3", Second: "b.go:4"},
+			}.Error,
+			Expect: []interface{}{"duplicate job \"lint\": added at a.go:1 and b.go:2; duplicate job \"test\": added at a.go:3 and b.go:4"},
+		},
+		{
+			Name: "duplicate-trigger",
+			Func: func() (int, bool) {
+				g := New().Strict().
+					AddJob(BasicJob{JobName: "cleanup"}).
+					AddFinally(BasicJob{JobName: "cleanup"}, "build").
+					AddOnFailure(BasicJob{JobName: "cleanup"}, "test")
+				errs, _ := g.Err().(DuplicateJobsError)
+				return len(errs), len(g.listTriggers()) == 0
+			},
+			Expect: []interface{}{2, true},
+		},
+		{
+			Name: "no-duplicate",
+			Func: func() error {
+				return New().Strict().
+					AddJob(BasicJob{JobName: "test"}).
+					AddJob(BasicJob{JobName: "test2"}).
+					Err()
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "replace",
+			Func: func() (Job, error) {
+				g := New().Strict().
+					AddJob(BasicJob{JobName: "test", Deps: []string{"a"}}).
+					AddJob(BasicJob{JobName: "test", Deps: []string{"b"}}).
+					ReplaceJob(BasicJob{JobName: "test"})
+				if err := g.Err(); err != nil {
+					return nil, err
+				}
+				return g.GetJob("test")
+			},
+			Expect: []interface{}{BasicJob{JobName: "test"}, nil},
+		},
+		{
+			Name: "remove",
+			Func: func() (Job, error) {
+				return New().
+					AddJob(BasicJob{JobName: "test"}).
+					RemoveJob("test").
+					GetJob("test")
+			},
+			Expect: []interface{}{nil, JobNotFoundError("test")},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestGraphMetadata(t *testing.T) {
+	nop := func() error { return nil }
+	team := New().
+		AddJob(BasicJob{JobName: "test", RunCallback: nop, JobDescription: "run the tests", JobTags: []string{"test", "ci"}, JobOwner: "team-a"}).
+		AddGenerator(func(name string) (Job, error) {
+			return BasicJob{JobName: name, JobTags: []string{"test"}}, nil
+		})
+	g := New().
+		AddJob(BasicJob{JobName: "build", RunCallback: nop, JobTags: []string{"ci"}}).
+		AddJob(BasicJob{JobName: "docs", RunCallback: nop}).
+		Mount("team-a", team)
+	if _, err := g.GetJob("team-a/generated"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []testCase{
+		{
+			Name:   "jobs",
+			Func:   g.Jobs,
+			Expect: []interface{}{[]string{"build", "docs", "team-a/test"}},
+		},
+		{
+			Name:   "tagged",
+			Func:   g.Tagged,
+			Args:   []interface{}{"ci"},
+			Expect: []interface{}{[]string{"build", "team-a/test"}, nil},
+		},
+		{
+			Name:   "tagged-any",
+			Func:   g.Tagged,
+			Args:   []interface{}{"test", "nope"},
+			Expect: []interface{}{[]string{"team-a/test"}, nil},
+		},
+		{
+			Name:   "tagged-none",
+			Func:   g.Tagged,
+			Args:   []interface{}{"nope"},
+			Expect: []interface{}{[]string{}, nil},
+		},
+		{
+			Name: "mounted",
+			Func: func() (string, []string, string, error) {
+				j, err := g.GetJob("team-a/test")
+				if err != nil {
+					return "", nil, "", err
+				}
+				return j.(DescribedJob).Description(), j.(TaggedJob).Tags(), j.(OwnedJob).Owner(), nil
+			},
+			Expect: []interface{}{"run the tests", []string{"test", "ci"}, "team-a", nil},
+		},
+		{
+			Name: "owner-result",
+			Func: func() (string, string) {
+				res := (&Runner{Graph: New().
+					AddJob(BasicJob{JobName: "fail", JobOwner: "alice", RunCallback: func() error { return errors.New("bad") }}).
+					AddJob(BasicJob{JobName: "dep", Deps: []string{"fail"}, RunCallback: nop}),
+				}).Run(context.Background(), "dep")
+				return res.Jobs["fail"].Owner, res.Jobs["dep"].Owner
+			},
+			Expect: []interface{}{"alice", ""},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
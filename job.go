@@ -3,6 +3,7 @@ package xgraph
 import (
 	"context"
 	"errors"
+	"fmt"
 )
 
 // Job is an operation in the execution graph
@@ -20,7 +21,8 @@ type Job interface {
 	// Dependents will be run even if this Job does not need to be run.
 	ShouldRun() (bool, error)
 
-	// Dependencies returns a list of dependencies for the Job.
+	// Dependencies returns a list of hard dependencies for the Job.
+	// Jobs with other types of dependencies also implement DependencyLister, which is used instead.
 	// If this returns an error, the Job is marked as errored.
 	Dependencies() ([]string, error)
 }
@@ -42,6 +44,30 @@ type BasicJob struct {
 	// Deps is a list of dependencies for the BasicJob.
 	// Defaults to []string{}.
 	Deps []string
+
+	// OrderDeps is a list of order-only dependencies for the BasicJob.
+	// See OrderDependency.
+	OrderDeps []string
+
+	// SoftDeps is a list of soft dependencies for the BasicJob.
+	// See SoftDependency.
+	SoftDeps []string
+
+	// Files is a list of the files and directories read by the BasicJob.
+	// See InputJob.
+	Files []string
+
+	// JobDescription is a human readable description of the BasicJob.
+	// See DescribedJob.
+	JobDescription string
+
+	// JobTags is a list of tags of the BasicJob.
+	// See TaggedJob.
+	JobTags []string
+
+	// JobOwner is the owner of the BasicJob.
+	// See OwnedJob.
+	JobOwner string
 }
 
 // Name returns the name of the Job.
@@ -70,7 +96,8 @@ func (bj BasicJob) ShouldRun() (bool, error) {
 	return bj.ShouldRunCallback()
 }
 
-// Dependencies returns the dependencies list of the BasicJob.
+// Dependencies returns the hard dependencies of the BasicJob (Deps).
+// OrderDeps and SoftDeps are not included: use DependencyList to get all of the dependencies.
 // Never returns an error.
 // If Deps is nil, returns an empty slice for the dependencies.
 func (bj BasicJob) Dependencies() ([]string, error) {
@@ -79,3 +106,180 @@ func (bj BasicJob) Dependencies() ([]string, error) {
 	}
 	return bj.Deps, nil
 }
+
+// DependencyList returns the dependencies of the BasicJob, including order-only and soft dependencies.
+// Never returns an error.
+func (bj BasicJob) DependencyList() ([]Dependency, error) {
+	deps := make([]Dependency, 0, len(bj.Deps)+len(bj.OrderDeps)+len(bj.SoftDeps))
+	for _, v := range bj.Deps {
+		deps = append(deps, Dependency{Name: v, Type: HardDependency})
+	}
+	for _, v := range bj.OrderDeps {
+		deps = append(deps, Dependency{Name: v, Type: OrderDependency})
+	}
+	for _, v := range bj.SoftDeps {
+		deps = append(deps, Dependency{Name: v, Type: SoftDependency})
+	}
+	return deps, nil
+}
+
+// Inputs returns the Files of the BasicJob (implements InputJob).
+// Never returns an error.
+func (bj BasicJob) Inputs() ([]string, error) {
+	return bj.Files, nil
+}
+
+// Description returns the JobDescription of the BasicJob (implements DescribedJob).
+func (bj BasicJob) Description() string {
+	return bj.JobDescription
+}
+
+// Tags returns the JobTags of the BasicJob (implements TaggedJob).
+func (bj BasicJob) Tags() []string {
+	return bj.JobTags
+}
+
+// Owner returns the JobOwner of the BasicJob (implements OwnedJob).
+func (bj BasicJob) Owner() string {
+	return bj.JobOwner
+}
+
+// DependencyType is a kind of dependency.
+type DependencyType uint8
+
+const (
+	// HardDependency is a dependency which is run before the dependent.
+	// If it fails, the dependent fails with a BuildDependencyError.
+	HardDependency DependencyType = iota
+
+	// OrderDependency is an order-only dependency.
+	// If the dependency is part of the build, the dependent is run after it, but the dependency is not added to the build by the dependent.
+	// If it fails, the dependent fails with a BuildDependencyError.
+	OrderDependency
+
+	// SoftDependency is a dependency which is run before the dependent.
+	// The dependent is run even if the dependency fails.
+	SoftDependency
+
+	// finallyDependency is an internal order-only dependency of a Job added with AddFinally on a watched Job.
+	// The dependent is run even if the dependency fails.
+	finallyDependency
+
+	// failureDependency is an internal order-only dependency of a Job added with AddOnFailure on a watched Job.
+	// The dependent is only run if a failureDependency fails.
+	failureDependency
+)
+
+// String returns the name of the DependencyType ("hard", "order" or "soft").
+func (dt DependencyType) String() string {
+	switch dt {
+	case HardDependency:
+		return "hard"
+	case OrderDependency:
+		return "order"
+	case SoftDependency:
+		return "soft"
+	case finallyDependency:
+		return "finally"
+	case failureDependency:
+		return "failure"
+	default:
+		return fmt.Sprintf("DependencyType(%d)", uint8(dt))
+	}
+}
+
+// Dependency is a dependency of a Job.
+type Dependency struct {
+	// Name is the name of the Job depended on.
+	Name string
+
+	// Type is the kind of dependency.
+	Type DependencyType
+}
+
+// DependencyLister is an optional interface which may be implemented by a Job to declare dependencies other than hard dependencies.
+type DependencyLister interface {
+	// DependencyList returns the dependencies of the Job.
+	// If a Job implements DependencyLister, DependencyList is used instead of Dependencies.
+	// If this returns an error, the Job is marked as errored.
+	DependencyList() ([]Dependency, error)
+}
+
+// InputJob is an optional interface which may be implemented by a Job which reads files.
+// Runner.Watch watches the inputs of the Jobs in the build, and runs them again when the inputs change.
+// Graph.Affected uses the inputs to find the Jobs affected by a set of changed files.
+type InputJob interface {
+	// Inputs returns the paths of the files and directories which the Job reads.
+	// A directory includes everything inside it.
+	// Relative paths are relative to the working directory of the process.
+	Inputs() ([]string, error)
+}
+
+// jobInputs gets the inputs of a Job, or nil if it does not implement InputJob.
+func jobInputs(j Job) ([]string, error) {
+	if ij, ok := j.(InputJob); ok {
+		return ij.Inputs()
+	}
+	return nil, nil
+}
+
+// DescribedJob is an optional interface which may be implemented by a Job with a human readable description.
+// Descriptions are shown when listing the Jobs of a Graph.
+type DescribedJob interface {
+	// Description returns a short description of what the Job does.
+	Description() string
+}
+
+// jobDescription gets the description of a Job, or "" if it does not implement DescribedJob.
+func jobDescription(j Job) string {
+	if dj, ok := j.(DescribedJob); ok {
+		return dj.Description()
+	}
+	return ""
+}
+
+// TaggedJob is an optional interface which may be implemented by a Job with tags.
+// Tags can be used to select Jobs (see Graph.Tagged and Graph.Query).
+type TaggedJob interface {
+	// Tags returns the tags of the Job.
+	Tags() []string
+}
+
+// jobTags gets the tags of a Job, or nil if it does not implement TaggedJob.
+func jobTags(j Job) []string {
+	if tj, ok := j.(TaggedJob); ok {
+		return tj.Tags()
+	}
+	return nil
+}
+
+// OwnedJob is an optional interface which may be implemented by a Job with an owner.
+// The owner is included in the JobResult, so that failures can be reported to the owner.
+type OwnedJob interface {
+	// Owner returns the person or team responsible for the Job.
+	Owner() string
+}
+
+// jobOwner gets the owner of a Job, or "" if it does not implement OwnedJob.
+func jobOwner(j Job) string {
+	if oj, ok := j.(OwnedJob); ok {
+		return oj.Owner()
+	}
+	return ""
+}
+
+// dependencyList gets the dependencies of a Job, using DependencyList if available.
+func dependencyList(j Job) ([]Dependency, error) {
+	if dl, ok := j.(DependencyLister); ok {
+		return dl.DependencyList()
+	}
+	names, err := j.Dependencies()
+	if err != nil {
+		return nil, err
+	}
+	deps := make([]Dependency, len(names))
+	for i, v := range names {
+		deps[i] = Dependency{Name: v, Type: HardDependency}
+	}
+	return deps, nil
+}
@@ -77,6 +77,15 @@ func TestBasicJob(t *testing.T) {
 			Func:   BasicJob{Deps: []string{"dep1", "dep2"}}.Dependencies,
 			Expect: []interface{}{[]string{"dep1", "dep2"}, nil},
 		},
+		{
+			Name: "dependency-list",
+			Func: BasicJob{Deps: []string{"dep1"}, OrderDeps: []string{"dep2"}, SoftDeps: []string{"dep3"}}.DependencyList,
+			Expect: []interface{}{[]Dependency{
+				{Name: "dep1", Type: HardDependency},
+				{Name: "dep2", Type: OrderDependency},
+				{Name: "dep3", Type: SoftDependency},
+			}, nil},
+		},
 		{
 			Name:   "dependencies-defailt",
 			Func:   BasicJob{}.Dependencies,
@@ -0,0 +1,268 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// ErrNoJobserver is an error indicating that MAKEFLAGS does not specify a jobserver.
+var ErrNoJobserver = errors.New("no jobserver in MAKEFLAGS")
+
+// Jobserver is a WorkRunner which limits the number of running tasks using a GNU make jobserver.
+// Each task holds a token while it runs.
+// The first task uses the implicit token of the process, and other tasks read a token from the jobserver and write it back when they finish.
+//
+// ExecJobs run by a Runner using a Jobserver share its tokens.
+// MAKEFLAGS and the jobserver are passed to the command, so that a nested make uses the same tokens as the build.
+type Jobserver struct {
+	// r and w are the ends of the jobserver pipe or fifo
+	r, w *os.File
+	// fifo is the path of the jobserver fifo, or "" if the jobserver uses a pipe
+	fifo string
+	// makeflags are the flags passed to commands in MAKEFLAGS, without the jobserver auth
+	makeflags string
+	// own is whether the Jobserver created the pipe, and closes it on Close
+	own bool
+
+	lck sync.Mutex
+	// implicit is whether the implicit token is free
+	implicit bool
+	// waiters are tasks waiting for a token
+	waiters []chan *jobserverToken
+	// held is the set of tokens from the jobserver which are held by running tasks
+	held map[*jobserverToken]bool
+	// reading is whether a goroutine is reading tokens for the waiters
+	reading bool
+	// broken is set if the jobserver can no longer be read from, after which only the held tokens are used
+	broken bool
+
+	wg sync.WaitGroup
+}
+
+// jobserverToken is a token held by a running task.
+// A task holding a token from the jobserver may be given the implicit token instead while it runs.
+type jobserverToken struct {
+	// implicit is whether this is the implicit token
+	implicit bool
+	// b is the byte read from the jobserver
+	b byte
+}
+
+// JobserverFromEnv returns a Jobserver which is a client of the jobserver in the MAKEFLAGS environment variable.
+// This is set when the program is run from a make recipe with "make -j".
+// Returns ErrNoJobserver if MAKEFLAGS does not specify a jobserver.
+func JobserverFromEnv() (*Jobserver, error) {
+	return JoinJobserver(os.Getenv("MAKEFLAGS"))
+}
+
+// JoinJobserver returns a Jobserver which is a client of the jobserver specified in a MAKEFLAGS value.
+// Both "--jobserver-auth=R,W" (or "--jobserver-fds=R,W") with inherited file descriptors, and "--jobserver-auth=fifo:PATH" are supported.
+// Returns ErrNoJobserver if makeflags does not specify a jobserver.
+func JoinJobserver(makeflags string) (*Jobserver, error) {
+	auth, rest := parseMakeflags(makeflags)
+	if auth == "" {
+		return nil, ErrNoJobserver
+	}
+	js := &Jobserver{
+		makeflags: rest,
+		implicit:  true,
+		held:      make(map[*jobserverToken]bool),
+	}
+	if strings.HasPrefix(auth, "fifo:") {
+		js.fifo = strings.TrimPrefix(auth, "fifo:")
+	}
+	r, w, err := openJobserver(auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open jobserver %q: %w", auth, err)
+	}
+	js.r, js.w = r, w
+	return js, nil
+}
+
+// NewJobserver starts a jobserver with a number of tokens.
+// If parallel is 0, one token is used per CPU.
+// The Jobserver is passed to ExecJobs, so nested makes share the tokens.
+func NewJobserver(parallel int) (*Jobserver, error) {
+	if parallel == 0 {
+		parallel = runtime.NumCPU()
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	//the implicit token is one of the tokens
+	if _, err := w.Write([]byte(strings.Repeat("+", parallel-1))); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	return &Jobserver{
+		r:         r,
+		w:         w,
+		makeflags: fmt.Sprintf("-j%d", parallel),
+		own:       true,
+		implicit:  true,
+		held:      make(map[*jobserverToken]bool),
+	}, nil
+}
+
+// parseMakeflags finds the jobserver auth in a MAKEFLAGS value.
+// Returns the auth (or "" if there is none), and the rest of the flags.
+func parseMakeflags(makeflags string) (auth string, rest string) {
+	rest = makeflags
+	for _, f := range strings.Fields(makeflags) {
+		for _, prefix := range []string{"--jobserver-auth=", "--jobserver-fds="} {
+			if strings.HasPrefix(f, prefix) {
+				auth = strings.TrimPrefix(f, prefix)
+				rest = strings.Replace(rest, f, "", 1)
+			}
+		}
+	}
+	return auth, strings.Join(strings.Fields(rest), " ")
+}
+
+// acquire waits for a token.
+func (js *Jobserver) acquire() *jobserverToken {
+	js.lck.Lock()
+	if js.implicit {
+		js.implicit = false
+		js.lck.Unlock()
+		return &jobserverToken{implicit: true}
+	}
+	ch := make(chan *jobserverToken, 1)
+	js.waiters = append(js.waiters, ch)
+	if !js.reading && !js.broken {
+		js.reading = true
+		go js.read()
+	}
+	js.lck.Unlock()
+	return <-ch
+}
+
+// release passes a token to a waiting task, or returns it.
+// If the implicit token is returned while other tasks hold tokens from the jobserver, one of them takes the implicit token, and its token is returned to the jobserver instead.
+// Otherwise the implicit token could be left unused while the jobserver is empty, and a nested make would wait for a token which is never returned.
+func (js *Jobserver) release(t *jobserverToken) {
+	js.lck.Lock()
+	delete(js.held, t)
+	if len(js.waiters) > 0 {
+		ch := js.waiters[0]
+		js.waiters = js.waiters[1:]
+		if !t.implicit {
+			js.held[t] = true
+		}
+		js.lck.Unlock()
+		ch <- t
+		return
+	}
+	if t.implicit {
+		for h := range js.held {
+			delete(js.held, h)
+			b := h.b
+			h.implicit = true
+			js.lck.Unlock()
+			js.w.Write([]byte{b})
+			return
+		}
+		js.implicit = true
+		js.lck.Unlock()
+		return
+	}
+	js.lck.Unlock()
+	js.w.Write([]byte{t.b})
+}
+
+// read reads tokens from the jobserver until there are no more waiters.
+// If a token is read after the waiters have been given other tokens, it is written back.
+func (js *Jobserver) read() {
+	buf := make([]byte, 1)
+	for {
+		_, err := js.r.Read(buf)
+		js.lck.Lock()
+		if err != nil {
+			//the waiters are given the tokens held by running tasks instead
+			js.broken = true
+			js.reading = false
+			js.lck.Unlock()
+			return
+		}
+		if len(js.waiters) == 0 {
+			js.reading = false
+			js.lck.Unlock()
+			js.w.Write(buf)
+			return
+		}
+		ch := js.waiters[0]
+		js.waiters = js.waiters[1:]
+		done := len(js.waiters) == 0
+		if done {
+			js.reading = false
+		}
+		t := &jobserverToken{b: buf[0]}
+		js.held[t] = true
+		js.lck.Unlock()
+		ch <- t
+		if done {
+			return
+		}
+	}
+}
+
+// DoTask runs a task on a new goroutine after acquiring a token.
+func (js *Jobserver) DoTask(task Task, tracker WorkTracker) {
+	js.wg.Add(1)
+	go func() {
+		defer js.wg.Done()
+		t := js.acquire()
+		defer js.release(t)
+		task.Run(tracker)
+	}()
+}
+
+// jobserverKey is the context key for the Jobserver running a Job.
+type jobserverKey struct{}
+
+// RunJob runs a Job with the Jobserver in its context, so that ExecJobs share it (implements JobRunner).
+func (js *Jobserver) RunJob(ctx context.Context, job Job) error {
+	return job.Run(context.WithValue(ctx, jobserverKey{}, js))
+}
+
+// makeFlags returns the MAKEFLAGS value for a command sharing the Jobserver, given the jobserver auth.
+func (js *Jobserver) makeFlags(auth string) string {
+	return strings.TrimSpace(js.makeflags + " --jobserver-auth=" + auth)
+}
+
+// setupJobserver passes the Jobserver from the context to a command, if there is one.
+func setupJobserver(ctx context.Context, cmd *exec.Cmd) {
+	js, ok := ctx.Value(jobserverKey{}).(*Jobserver)
+	if !ok {
+		return
+	}
+	var auth string
+	if js.fifo != "" {
+		auth = "fifo:" + js.fifo
+	} else if auth = exportJobserver(cmd, js.r, js.w); auth == "" {
+		return
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "MAKEFLAGS="+js.makeFlags(auth))
+}
+
+// Close waits for running tasks to finish.
+// If the Jobserver was created by NewJobserver, the jobserver is closed.
+func (js *Jobserver) Close() error {
+	js.wg.Wait()
+	if js.own {
+		js.r.Close()
+		js.w.Close()
+	}
+	return nil
+}
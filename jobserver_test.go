@@ -0,0 +1,216 @@
+//go:build !windows
+// +build !windows
+
+package xgraph
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runConcurrent runs jobs with a WorkRunner, and returns the maximum number of jobs which ran at once.
+func runConcurrent(wr WorkRunner, n int) (int, error) {
+	var lck sync.Mutex
+	running, max := 0, 0
+	g := New()
+	targets := []string{}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("job%d", i)
+		g.AddJob(BasicJob{JobName: name, RunCallback: func() error {
+			lck.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			lck.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			lck.Lock()
+			running--
+			lck.Unlock()
+			return nil
+		}})
+		targets = append(targets, name)
+	}
+	res := (&Runner{Graph: g, WorkRunner: wr}).Run(context.Background(), targets...)
+	if failed := res.Failed(); len(failed) > 0 {
+		return 0, fmt.Errorf("jobs failed: %v", failed)
+	}
+	return max, nil
+}
+
+func TestJobserver(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "server",
+			Func: func() (int, error) {
+				defer timeout()()
+				js, err := NewJobserver(3)
+				if err != nil {
+					return 0, err
+				}
+				defer js.Close()
+				return runConcurrent(js, 8)
+			},
+			Expect: []interface{}{3, nil},
+		},
+		{
+			Name: "client-fifo",
+			Func: func() (int, error) {
+				defer timeout()()
+				path := filepath.Join(t.TempDir(), "fifo")
+				if err := syscall.Mkfifo(path, 0600); err != nil {
+					return 0, err
+				}
+				f, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					return 0, err
+				}
+				defer f.Close()
+				if _, err := f.Write([]byte("++")); err != nil {
+					return 0, err
+				}
+				js, err := JoinJobserver("-j3 --jobserver-auth=fifo:" + path)
+				if err != nil {
+					return 0, err
+				}
+				max, err := runConcurrent(js, 8)
+				if err != nil {
+					return 0, err
+				}
+				js.Close()
+
+				//all tokens should have been returned
+				f.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+				buf := make([]byte, 4)
+				n, _ := f.Read(buf)
+				if n != 2 {
+					return 0, fmt.Errorf("expected 2 tokens to be returned but got %d", n)
+				}
+				return max, nil
+			},
+			Expect: []interface{}{3, nil},
+		},
+		{
+			Name: "client-fds",
+			Func: func() error {
+				r, w, err := os.Pipe()
+				if err != nil {
+					return err
+				}
+				defer r.Close()
+				defer w.Close()
+				//the Jobserver takes ownership of the descriptors
+				rfd, err := syscall.Dup(int(r.Fd()))
+				if err != nil {
+					return err
+				}
+				wfd, err := syscall.Dup(int(w.Fd()))
+				if err != nil {
+					return err
+				}
+				js, err := JoinJobserver(fmt.Sprintf("-k --jobserver-fds=%d,%d -j", rfd, wfd))
+				if err != nil {
+					return err
+				}
+				js.r.Close()
+				js.w.Close()
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "no-jobserver",
+			Func: func() error {
+				_, err := JoinJobserver("-k -j")
+				return err
+			},
+			Expect: []interface{}{ErrNoJobserver},
+		},
+		{
+			Name: "exec",
+			Func: func() error {
+				defer timeout()()
+				js, err := NewJobserver(2)
+				if err != nil {
+					return err
+				}
+				defer js.Close()
+				//take the token from the jobserver and give it back
+				g := New().AddJob(ExecJob{JobName: "make", Command: "sh", Args: []string{"-c", `
+					test "$MAKEFLAGS" = "-j2 --jobserver-auth=3,4" || exit 1
+					dd bs=1 count=1 <&3 >&4 2>/dev/null
+				`}})
+				return (&Runner{Graph: g, WorkRunner: js}).Run(context.Background(), "make").Jobs["make"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "make",
+			Func: func() error {
+				if _, err := exec.LookPath("make"); err != nil {
+					return nil
+				}
+				defer timeout()()
+				dir := t.TempDir()
+				err := os.WriteFile(filepath.Join(dir, "Makefile"), []byte("all: a b c\na b c:\n\t@sleep 0.05\n"), 0644)
+				if err != nil {
+					return err
+				}
+				js, err := NewJobserver(2)
+				if err != nil {
+					return err
+				}
+				defer js.Close()
+				//make warns if it cannot use the jobserver
+				g := New().AddJob(ExecJob{JobName: "make", Command: "sh", Args: []string{"-c", `
+					out=$(make -C "$1" 2>&1) || { echo "$out"; exit 1; }
+					case "$out" in *warning*) echo "$out"; exit 1;; esac
+				`, "sh", dir}})
+				return (&Runner{Graph: g, WorkRunner: js}).Run(context.Background(), "make").Jobs["make"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestParseMakeflags(t *testing.T) {
+	tests := []testCase{
+		{
+			Name:   "auth",
+			Func:   parseMakeflags,
+			Args:   []interface{}{" -j8 --jobserver-auth=3,4"},
+			Expect: []interface{}{"3,4", "-j8"},
+		},
+		{
+			Name:   "fds",
+			Func:   parseMakeflags,
+			Args:   []interface{}{"ks --jobserver-fds=5,6 -j -- X=1"},
+			Expect: []interface{}{"5,6", "ks -j -- X=1"},
+		},
+		{
+			Name:   "fifo",
+			Func:   parseMakeflags,
+			Args:   []interface{}{"-j4 --jobserver-auth=fifo:/tmp/GMfifo1"},
+			Expect: []interface{}{"fifo:/tmp/GMfifo1", "-j4"},
+		},
+		{
+			Name:   "none",
+			Func:   parseMakeflags,
+			Args:   []interface{}{"-k"},
+			Expect: []interface{}{"", "-k"},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
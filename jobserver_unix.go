@@ -0,0 +1,47 @@
+//go:build !windows
+// +build !windows
+
+package xgraph
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// openJobserver opens the jobserver specified by a jobserver auth.
+func openJobserver(auth string) (r, w *os.File, err error) {
+	if strings.HasPrefix(auth, "fifo:") {
+		f, err := os.OpenFile(strings.TrimPrefix(auth, "fifo:"), os.O_RDWR, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		return f, f, nil
+	}
+	fds := strings.Split(auth, ",")
+	if len(fds) != 2 {
+		return nil, nil, fmt.Errorf("invalid jobserver auth %q", auth)
+	}
+	files := make([]*os.File, 2)
+	for i, v := range fds {
+		fd, err := strconv.Atoi(v)
+		if err != nil || fd < 0 {
+			return nil, nil, fmt.Errorf("invalid jobserver auth %q", auth)
+		}
+		files[i] = os.NewFile(uintptr(fd), fmt.Sprintf("jobserver-%d", fd))
+		//the descriptors are not inherited if the make recipe was not marked as recursive
+		if _, err := files[i].Stat(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return files[0], files[1], nil
+}
+
+// exportJobserver passes a jobserver pipe to a command, and returns the jobserver auth for the command.
+func exportJobserver(cmd *exec.Cmd, r, w *os.File) string {
+	fd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, r, w)
+	return fmt.Sprintf("%d,%d", fd, fd+1)
+}
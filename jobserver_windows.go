@@ -0,0 +1,17 @@
+package xgraph
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// openJobserver fails, because make uses a semaphore for the jobserver on Windows.
+func openJobserver(auth string) (r, w *os.File, err error) {
+	return nil, nil, errors.New("jobserver not supported on windows")
+}
+
+// exportJobserver does nothing, because a pipe cannot be passed to a command on Windows.
+func exportJobserver(cmd *exec.Cmd, r, w *os.File) string {
+	return ""
+}
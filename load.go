@@ -0,0 +1,57 @@
+package xgraph
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SystemLoad is the load of the system.
+type SystemLoad struct {
+	// Load is the 1 minute load average per CPU.
+	Load float64
+
+	// Memory is the fraction of memory which is available.
+	Memory float64
+}
+
+// parseLoadavg parses the 1 minute load average from the contents of /proc/loadavg.
+func parseLoadavg(loadavg string) (float64, error) {
+	fields := strings.Fields(loadavg)
+	if len(fields) == 0 {
+		return 0, errors.New("empty loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// parseMeminfo parses the fraction of memory available from the contents of /proc/meminfo.
+func parseMeminfo(meminfo string) (float64, error) {
+	var total, avail float64
+	s := bufio.NewScanner(strings.NewReader(meminfo))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var dst *float64
+		switch fields[0] {
+		case "MemTotal:":
+			dst = &total
+		case "MemAvailable:":
+			dst = &avail
+		default:
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid meminfo line %q: %w", s.Text(), err)
+		}
+		*dst = v
+	}
+	if total == 0 {
+		return 0, errors.New("missing MemTotal in meminfo")
+	}
+	return avail / total, nil
+}
@@ -0,0 +1,31 @@
+package xgraph
+
+import (
+	"os"
+	"runtime"
+)
+
+// ReadSystemLoad reads the load of the system from /proc/loadavg and /proc/meminfo.
+// Returns an error on systems other than Linux.
+func ReadSystemLoad() (SystemLoad, error) {
+	loadavg, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return SystemLoad{}, err
+	}
+	load, err := parseLoadavg(string(loadavg))
+	if err != nil {
+		return SystemLoad{}, err
+	}
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return SystemLoad{}, err
+	}
+	mem, err := parseMeminfo(string(meminfo))
+	if err != nil {
+		return SystemLoad{}, err
+	}
+	return SystemLoad{
+		Load:   load / float64(runtime.NumCPU()),
+		Memory: mem,
+	}, nil
+}
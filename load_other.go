@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package xgraph
+
+import "errors"
+
+// errLoadUnsupported is returned by ReadSystemLoad on systems other than Linux.
+var errLoadUnsupported = errors.New("system load not supported")
+
+// ReadSystemLoad reads the load of the system from /proc/loadavg and /proc/meminfo.
+// Returns an error on systems other than Linux.
+func ReadSystemLoad() (SystemLoad, error) {
+	return SystemLoad{}, errLoadUnsupported
+}
@@ -0,0 +1,62 @@
+package xgraph
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// JobPanicError is an error indicating that a method of a Job panicked.
+type JobPanicError struct {
+	// Job is the name of the Job.
+	Job string
+
+	// Method is the method which panicked ("Run", "ShouldRun", "Dependencies" or "Inputs").
+	Method string
+
+	// Value is the value passed to panic.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine which panicked.
+	Stack []byte
+}
+
+func (err *JobPanicError) Error() string {
+	return fmt.Sprintf("job %q panicked in %s: %v", err.Job, err.Method, err.Value)
+}
+
+// catchPanic recovers a panic in a method of a Job, and stores it in err as a *JobPanicError.
+// It must be deferred directly.
+func catchPanic(j Job, method string, err *error) {
+	if v := recover(); v != nil {
+		*err = &JobPanicError{
+			Job:    j.Name(),
+			Method: method,
+			Value:  v,
+			Stack:  debug.Stack(),
+		}
+	}
+}
+
+// runJob runs a Job, recovering panics.
+func runJob(run func() error, j Job) (err error) {
+	defer catchPanic(j, "Run", &err)
+	return run()
+}
+
+// shouldRun calls the ShouldRun method of a Job, recovering panics.
+func shouldRun(j Job) (sr bool, err error) {
+	defer catchPanic(j, "ShouldRun", &err)
+	return j.ShouldRun()
+}
+
+// listDependencies gets the dependencies of a Job, recovering panics.
+func listDependencies(j Job) (deps []Dependency, err error) {
+	defer catchPanic(j, "Dependencies", &err)
+	return dependencyList(j)
+}
+
+// listInputs gets the inputs of a Job, recovering panics.
+func listInputs(j Job) (inputs []string, err error) {
+	defer catchPanic(j, "Inputs", &err)
+	return jobInputs(j)
+}
@@ -0,0 +1,92 @@
+package xgraph
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// panicDepsJob is a Job which panics when its dependencies are listed.
+type panicDepsJob struct {
+	BasicJob
+}
+
+func (pdj panicDepsJob) DependencyList() ([]Dependency, error) {
+	panic("boom")
+}
+
+// errorRecorder is an EventHandler which records the errors of failed jobs.
+type errorRecorder struct {
+	nophandler
+	lck  sync.Mutex
+	errs map[string]error
+}
+
+func (er *errorRecorder) OnError(job string, err error) {
+	er.lck.Lock()
+	defer er.lck.Unlock()
+	er.errs[job] = err
+}
+
+func TestJobPanic(t *testing.T) {
+	g := New().
+		AddJob(BasicJob{JobName: "run", RunCallback: func() error { panic("boom") }}).
+		AddJob(BasicJob{JobName: "should", ShouldRunCallback: func() (bool, error) { panic("boom") }}).
+		AddJob(panicDepsJob{BasicJob{JobName: "deps"}}).
+		AddJob(BasicJob{JobName: "ok", RunCallback: func() error { return nil }}).
+		AddJob(BasicJob{JobName: "top", Deps: []string{"run", "should", "deps", "ok"}, RunCallback: func() error { return nil }})
+	run := func() map[string]error {
+		defer timeout()()
+		wp := NewWorkPool(2)
+		defer wp.Close()
+		er := &errorRecorder{errs: make(map[string]error)}
+		(&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: er,
+		}).Run(context.Background(), "top")
+		return er.errs
+	}
+	tests := []testCase{
+		{
+			Name: "methods",
+			Func: func() []string {
+				methods := []string{}
+				for name, err := range run() {
+					if perr, ok := err.(*JobPanicError); ok && perr.Job == name {
+						methods = append(methods, fmt.Sprintf("%s:%s:%v", perr.Job, perr.Method, perr.Value))
+					}
+				}
+				sort.Strings(methods)
+				return methods
+			},
+			Expect: []interface{}{[]string{"deps:Dependencies:boom", "run:Run:boom", "should:ShouldRun:boom"}},
+		},
+		{
+			Name: "stack",
+			Func: func() bool {
+				perr := run()["run"].(*JobPanicError)
+				return strings.Contains(string(perr.Stack), "panic_test.go")
+			},
+			Expect: []interface{}{true},
+		},
+		{
+			Name: "subtree",
+			Func: func() []string {
+				failed := []string{}
+				for name := range run() {
+					failed = append(failed, name)
+				}
+				sort.Strings(failed)
+				return failed
+			},
+			Expect: []interface{}{[]string{"deps", "run", "should", "top"}},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,402 @@
+package xgraph
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ProcessWorkerEnv is an environment variable which is set on worker processes started by a ProcessRunner.
+const ProcessWorkerEnv = "XGRAPH_PROCESS_WORKER"
+
+// ProcessWorkerMain serves tasks on stdin and stdout and exits, if the process was started as a worker by a ProcessRunner.
+// Otherwise, it returns immediately.
+// It should be called at the start of main, after task kinds have been registered.
+// While serving, os.Stdout is redirected to os.Stderr so that output does not corrupt the protocol.
+func ProcessWorkerMain() {
+	if os.Getenv(ProcessWorkerEnv) == "" {
+		return
+	}
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if err := ServeProcess(os.Stdin, out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// processRequest is a request to run a task in a worker process.
+type processRequest struct {
+	ID   uint64      `json:"id"`
+	Task *RemoteTask `json:"task"`
+}
+
+// processResponse is the result of a processRequest.
+type processResponse struct {
+	ID     uint64 `json:"id"`
+	Failed bool   `json:"failed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// writeFrame writes a JSON value prefixed with its length as a 4 byte big-endian integer.
+func writeFrame(w io.Writer, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(dat))
+	binary.BigEndian.PutUint32(buf, uint32(len(dat)))
+	copy(buf[4:], dat)
+	_, err = w.Write(buf)
+	return err
+}
+
+// readFrame reads a JSON value written by writeFrame.
+// Returns io.EOF if there are no more frames.
+func readFrame(r io.Reader, v interface{}) error {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	dat := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := io.ReadFull(r, dat); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// ServeProcess runs tasks requested by a ProcessRunner, one at a time, until r is closed.
+// Each request and response is a JSON object prefixed by its length as a 4 byte big-endian integer.
+// Returns nil when r reaches EOF.
+func ServeProcess(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+	for {
+		var req processRequest
+		if err := readFrame(br, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		resp := processResponse{ID: req.ID}
+		if req.Task == nil {
+			resp.Failed, resp.Error = true, "missing task"
+		} else if err := RunTask(context.Background(), req.Task); err != nil {
+			resp.Failed, resp.Error = true, err.Error()
+		}
+		if err := writeFrame(w, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// ProcessCrashError is an error indicating that a worker process exited while running a Job.
+type ProcessCrashError struct {
+	// Job is the name of the Job.
+	Job string
+
+	// Err is the error from waiting for the process.
+	Err error
+
+	// Output is the end of the stderr of the process while running the Job.
+	Output []byte
+}
+
+func (err *ProcessCrashError) Error() string {
+	if len(err.Output) == 0 {
+		return fmt.Sprintf("worker process crashed running %q: %v", err.Job, err.Err)
+	}
+	return fmt.Sprintf("worker process crashed running %q: %v\n%s", err.Job, err.Err, err.Output)
+}
+
+func (err *ProcessCrashError) Unwrap() error {
+	return err.Err
+}
+
+// ProcessRunner is a WorkRunner which runs Jobs in worker processes.
+// Jobs which implement RemoteJob are sent to an idle worker process, which is reused for later Jobs.
+// Other Jobs are run locally.
+// If a worker process exits while running a Job, the Job fails with a *ProcessCrashError, and a new process is started for the next Job.
+//
+// The fields must not be changed after the ProcessRunner is first used.
+type ProcessRunner struct {
+	// Command is the command used to start a worker process, which must call ServeProcess on its stdin and stdout.
+	// Defaults to the current executable, which should call ProcessWorkerMain.
+	Command []string
+
+	// Env is a list of "KEY=value" entries added to the environment of worker processes.
+	// ProcessWorkerEnv is always set.
+	Env []string
+
+	// Processes is the maximum number of worker processes.
+	// If 0, one per CPU.
+	Processes int
+
+	// MaxTasks is the number of Jobs a worker process runs before it is replaced, to limit the effect of leaks.
+	// If 0, worker processes are reused indefinitely.
+	MaxTasks int
+
+	// Local is the number of Jobs which may be run locally at once.
+	// If 0, one per CPU.
+	Local int
+
+	// Stderr receives the stderr of the worker processes.
+	// Defaults to os.Stderr.
+	Stderr io.Writer
+
+	once     sync.Once
+	lck      sync.Mutex
+	closed   bool
+	idle     []*workerProcess
+	slots    chan struct{}
+	localsem chan struct{}
+	tasksem  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// workerProcess is a worker process started by a ProcessRunner.
+type workerProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	stderr *tailBuffer
+	// tasks is the number of tasks sent to the process
+	tasks int
+}
+
+func (pr *ProcessRunner) init() {
+	pr.once.Do(func() {
+		if pr.Processes == 0 {
+			pr.Processes = runtime.NumCPU()
+		}
+		if pr.Local == 0 {
+			pr.Local = runtime.NumCPU()
+		}
+		if pr.Stderr == nil {
+			pr.Stderr = os.Stderr
+		}
+		pr.slots = make(chan struct{}, pr.Processes)
+		pr.localsem = make(chan struct{}, pr.Local)
+		pr.tasksem = make(chan struct{}, pr.Processes+pr.Local)
+	})
+}
+
+// start starts a new worker process.
+func (pr *ProcessRunner) start() (*workerProcess, error) {
+	cmdline := pr.Command
+	if len(cmdline) == 0 {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmdline = []string{exe}
+	}
+	cmd := exec.Command(cmdline[0], cmdline[1:]...)
+	cmd.Env = append(append(os.Environ(), pr.Env...), ProcessWorkerEnv+"=1")
+	wp := &workerProcess{
+		cmd:    cmd,
+		stderr: &tailBuffer{w: pr.Stderr, max: 4096},
+	}
+	cmd.Stderr = wp.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	wp.stdin, wp.stdout = stdin, bufio.NewReader(stdout)
+	return wp, nil
+}
+
+// stop shuts down a worker process by closing its stdin, and waits for it to exit.
+// The process is killed if it does not exit within a second.
+func (wp *workerProcess) stop() {
+	t := time.AfterFunc(time.Second, func() { wp.cmd.Process.Kill() })
+	defer t.Stop()
+	wp.stdin.Close()
+	wp.cmd.Wait()
+}
+
+// acquire gets an idle worker process, or starts a new one if there are none.
+func (pr *ProcessRunner) acquire(ctx context.Context) (*workerProcess, error) {
+	select {
+	case pr.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	pr.lck.Lock()
+	if pr.closed {
+		pr.lck.Unlock()
+		<-pr.slots
+		return nil, ErrRunnerClosed
+	}
+	if n := len(pr.idle); n > 0 {
+		wp := pr.idle[n-1]
+		pr.idle = pr.idle[:n-1]
+		pr.lck.Unlock()
+		return wp, nil
+	}
+	pr.lck.Unlock()
+	wp, err := pr.start()
+	if err != nil {
+		<-pr.slots
+		return nil, err
+	}
+	return wp, nil
+}
+
+// release returns a worker process after running a task.
+// If the process is broken or has run MaxTasks tasks, it is stopped.
+func (pr *ProcessRunner) release(wp *workerProcess, broken bool) {
+	defer func() { <-pr.slots }()
+	pr.lck.Lock()
+	if broken || pr.closed || (pr.MaxTasks > 0 && wp.tasks >= pr.MaxTasks) {
+		pr.lck.Unlock()
+		wp.stop()
+		return
+	}
+	pr.idle = append(pr.idle, wp)
+	pr.lck.Unlock()
+}
+
+// RunJob runs a Job, sending it to a worker process if it implements RemoteJob (implements JobRunner).
+func (pr *ProcessRunner) RunJob(ctx context.Context, job Job) error {
+	pr.init()
+	task, err := remoteTask(job)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		select {
+		case pr.localsem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		defer func() { <-pr.localsem }()
+		return job.Run(ctx)
+	}
+
+	wp, err := pr.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	wp.tasks++
+	wp.stderr.reset()
+	resch := make(chan error, 1)
+	go func() {
+		var resp processResponse
+		if err := writeFrame(wp.stdin, processRequest{ID: uint64(wp.tasks), Task: task}); err != nil {
+			resch <- err
+			return
+		}
+		if err := readFrame(wp.stdout, &resp); err != nil {
+			resch <- err
+			return
+		}
+		if resp.ID != uint64(wp.tasks) {
+			resch <- fmt.Errorf("worker process sent response %d to request %d", resp.ID, wp.tasks)
+			return
+		}
+		if resp.Failed {
+			resch <- &RemoteError{Worker: fmt.Sprintf("process %d", wp.cmd.Process.Pid), Message: resp.Error}
+			return
+		}
+		resch <- nil
+	}()
+
+	select {
+	case err := <-resch:
+		switch err.(type) {
+		case nil, *RemoteError:
+			pr.release(wp, false)
+			return err
+		}
+		//the process crashed or broke the protocol
+		pr.release(wp, true)
+		if ps := wp.cmd.ProcessState; ps != nil && !ps.Success() {
+			err = &exec.ExitError{ProcessState: ps}
+		}
+		return &ProcessCrashError{Job: job.Name(), Err: err, Output: wp.stderr.bytes()}
+	case <-ctx.Done():
+		wp.cmd.Process.Kill()
+		pr.release(wp, true)
+		<-resch
+		return ctx.Err()
+	}
+}
+
+// DoTask runs a task on a new goroutine.
+// Tasks from a Runner call RunJob, which limits the number of Jobs running locally and in worker processes.
+// At most Processes plus Local tasks run at once, and DoTask blocks until one can be started.
+func (pr *ProcessRunner) DoTask(task Task, tracker WorkTracker) {
+	pr.init()
+	pr.tasksem <- struct{}{}
+	pr.wg.Add(1)
+	go func() {
+		defer pr.wg.Done()
+		defer func() { <-pr.tasksem }()
+		task.Run(tracker)
+	}()
+}
+
+// Close waits for running tasks to finish, and then stops the worker processes.
+func (pr *ProcessRunner) Close() error {
+	pr.init()
+	pr.wg.Wait()
+	pr.lck.Lock()
+	pr.closed = true
+	idle := pr.idle
+	pr.idle = nil
+	pr.lck.Unlock()
+	for _, wp := range idle {
+		wp.stop()
+	}
+	return nil
+}
+
+// tailBuffer is a Writer which forwards writes to another Writer, and keeps the last max bytes written since the last reset.
+type tailBuffer struct {
+	lck sync.Mutex
+	w   io.Writer
+	max int
+	buf []byte
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.lck.Lock()
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > tb.max {
+		tb.buf = append([]byte(nil), tb.buf[len(tb.buf)-tb.max:]...)
+	}
+	tb.lck.Unlock()
+	return tb.w.Write(p)
+}
+
+func (tb *tailBuffer) reset() {
+	tb.lck.Lock()
+	defer tb.lck.Unlock()
+	tb.buf = nil
+}
+
+func (tb *tailBuffer) bytes() []byte {
+	tb.lck.Lock()
+	defer tb.lck.Unlock()
+	return append([]byte(nil), tb.buf...)
+}
@@ -0,0 +1,208 @@
+package xgraph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterTaskKind("panic", func(ctx context.Context, data json.RawMessage) error {
+		panic("boom")
+	})
+	RegisterTaskKind("sleep", func(ctx context.Context, data json.RawMessage) error {
+		time.Sleep(time.Minute)
+		return nil
+	})
+}
+
+// TestHelperProcess is run in a subprocess by a ProcessRunner.
+func TestHelperProcess(t *testing.T) {
+	ProcessWorkerMain()
+	t.Skip("not a worker process")
+}
+
+// helperProcessRunner returns a ProcessRunner using TestHelperProcess.
+func helperProcessRunner() *ProcessRunner {
+	return &ProcessRunner{
+		Command: []string{os.Args[0], "-test.run=^TestHelperProcess$"},
+		Stderr:  io.Discard,
+	}
+}
+
+// runPids runs jobs which write their pid to a file, and returns the pids.
+func runPids(pr *ProcessRunner, dir string, n int) ([]string, error) {
+	pids := make([]string, n)
+	for i := range pids {
+		path := fmt.Sprintf("%s/%d", dir, i)
+		err := pr.RunJob(context.Background(), remoteJob{BasicJob: BasicJob{JobName: "pid"}, kind: "pid", data: path})
+		if err != nil {
+			return nil, err
+		}
+		dat, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		pids[i] = string(dat)
+	}
+	return pids, nil
+}
+
+func TestProcessRunner(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping worker processes in short mode")
+	}
+	tests := []testCase{
+		{
+			Name: "reuse",
+			Func: func() error {
+				defer timeout()()
+				pr := helperProcessRunner()
+				pr.Processes = 1
+				defer pr.Close()
+				pids, err := runPids(pr, t.TempDir(), 3)
+				if err != nil {
+					return err
+				}
+				if pids[0] == fmt.Sprint(os.Getpid()) || pids[1] != pids[0] || pids[2] != pids[0] {
+					return fmt.Errorf("expected one worker process but got pids %v", pids)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "task-limit",
+			Func: func() (bool, int) {
+				defer timeout()()
+				pr := &ProcessRunner{Processes: 1, Local: 1}
+				defer pr.Close()
+				var lck sync.Mutex
+				running, max, count := 0, 0, 0
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					pr.DoTask(func() error {
+						lck.Lock()
+						running++
+						count++
+						if running > max {
+							max = running
+						}
+						lck.Unlock()
+						time.Sleep(5 * time.Millisecond)
+						lck.Lock()
+						running--
+						lck.Unlock()
+						return nil
+					}, CallbackTracker(func(error) { wg.Done() }))
+				}
+				wg.Wait()
+				return max <= 2, count
+			},
+			Expect: []interface{}{true, 8},
+		},
+		{
+			Name: "max-tasks",
+			Func: func() error {
+				defer timeout()()
+				pr := helperProcessRunner()
+				pr.Processes = 1
+				pr.MaxTasks = 1
+				defer pr.Close()
+				pids, err := runPids(pr, t.TempDir(), 2)
+				if err != nil {
+					return err
+				}
+				if pids[1] == pids[0] {
+					return fmt.Errorf("expected process to be replaced but got pids %v", pids)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "crash",
+			Func: func() error {
+				defer timeout()()
+				pr := helperProcessRunner()
+				pr.Processes = 1
+				defer pr.Close()
+				err := pr.RunJob(context.Background(), remoteJob{BasicJob: BasicJob{JobName: "panic"}, kind: "panic"})
+				cerr, ok := err.(*ProcessCrashError)
+				if !ok || cerr.Job != "panic" || !strings.Contains(string(cerr.Output), "boom") {
+					return fmt.Errorf("expected ProcessCrashError but got %v", err)
+				}
+				//a new process is started
+				_, err = runPids(pr, t.TempDir(), 1)
+				return err
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "build",
+			Func: func() error {
+				defer timeout()()
+				pr := helperProcessRunner()
+				defer pr.Close()
+				g := New().
+					AddJob(remoteJob{BasicJob: BasicJob{JobName: "panic"}, kind: "panic"}).
+					AddJob(remoteJob{BasicJob: BasicJob{JobName: "unknown"}, kind: "nope"}).
+					AddJob(BasicJob{JobName: "local", SoftDeps: []string{"panic", "unknown"}, RunCallback: func() error { return nil }})
+				res := (&Runner{Graph: g, WorkRunner: pr}).Run(context.Background(), "local")
+				if _, ok := res.Jobs["panic"].Err.(*ProcessCrashError); !ok {
+					return fmt.Errorf("expected ProcessCrashError but got %v", res.Jobs["panic"].Err)
+				}
+				if rerr, ok := res.Jobs["unknown"].Err.(*RemoteError); !ok || rerr.Message != `unknown task kind: "nope"` {
+					return fmt.Errorf("unexpected error: %v", res.Jobs["unknown"].Err)
+				}
+				return res.Jobs["local"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "cancel",
+			Func: func() error {
+				defer timeout()()
+				pr := helperProcessRunner()
+				defer pr.Close()
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				return pr.RunJob(ctx, remoteJob{BasicJob: BasicJob{JobName: "sleep"}, kind: "sleep"})
+			},
+			Expect: []interface{}{context.DeadlineExceeded},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	for i := uint64(1); i <= 2; i++ {
+		if err := writeFrame(&buf, processResponse{ID: i, Failed: true, Error: "bad"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := buf.Len(); n != 2*(4+len(`{"id":1,"failed":true,"error":"bad"}`)) {
+		t.Errorf("unexpected length %d", n)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		var resp processResponse
+		if err := readFrame(&buf, &resp); err != nil || resp.ID != i {
+			t.Errorf("unexpected frame %v (%v)", resp, err)
+		}
+	}
+	var resp processResponse
+	if err := readFrame(&buf, &resp); err != io.EOF {
+		t.Errorf("expected EOF but got %v", err)
+	}
+}
@@ -1,124 +1,286 @@
 package xgraph
 
 import (
+	"context"
 	"fmt"
-	"sort"
 	"strings"
+	"sync"
 )
 
-// Promise is a future
-type Promise struct {
-	fun               func(FinishHandler, FailHandler)
+// Promise is a future which eventually resolves to a value of type T, or fails with an error.
+// The promise function is run when the Promise is first used (by Then or Wait).
+// A Promise is safe for concurrent use.
+//
+// Promise is a general-purpose API for code outside of the Runner, such as Jobs which wait on asynchronous work.
+// Builds do not use it: a Promise per Job costs several allocations and closures,
+// so the Runner tracks the completion of Jobs with integer-indexed counters instead.
+type Promise[T any] struct {
+	lck               sync.Mutex
+	fun               func(FinishHandler[T], FailHandler)
 	started, finished bool
+	val               T
 	err               error
-	sfs               []FinishHandler
-	efs               []FailHandler
+	cbs               []func(T, error)
+	done              chan struct{}
+}
+
+//FinishHandler is a type of function used as a callback for a Promise on success
+type FinishHandler[T any] func(T)
+
+//FailHandler is a type of function used as a callback for a Promise on failure
+type FailHandler func(error)
+
+//NewPromise returns a *Promise using the given function.
+//The function should call exactly one of the handlers, possibly from another goroutine.
+//Later calls to the handlers are ignored.
+func NewPromise[T any](fun func(FinishHandler[T], FailHandler)) *Promise[T] {
+	return &Promise[T]{
+		fun:  fun,
+		done: make(chan struct{}),
+	}
+}
+
+// Resolved returns a Promise which has already succeeded with the value v.
+func Resolved[T any](v T) *Promise[T] {
+	p := &Promise[T]{done: make(chan struct{})}
+	p.started = true
+	p.onFinish(v)
+	return p
+}
+
+// Rejected returns a Promise which has already failed with the error err.
+func Rejected[T any](err error) *Promise[T] {
+	p := &Promise[T]{done: make(chan struct{})}
+	p.started = true
+	p.onFail(err)
+	return p
+}
+
+// pending returns a started Promise which is completed by calling onFinish or onFail.
+func pending[T any]() *Promise[T] {
+	return &Promise[T]{
+		started: true,
+		done:    make(chan struct{}),
+	}
 }
 
 // Then registers callbacks and starts the Promise if it has not been already started.
-// If the Promise has already completed, the success/failure handler is immediately called with the resu;t.
+// If the Promise has already completed, the success/failure handler is immediately called with the result.
+// Otherwise the handler is called on the goroutine which completes the Promise.
+// Returns a Promise which completes with the same result after the handler has returned, for chaining.
 // This is like Promise.then in JavaScript.
-func (p *Promise) Then(success FinishHandler, failure FailHandler) {
-	if p.finished {
-		if p.err == nil {
+func (p *Promise[T]) Then(success FinishHandler[T], failure FailHandler) *Promise[T] {
+	next := pending[T]()
+	p.subscribe(func(v T, err error) {
+		if err == nil {
 			if success != nil {
-				success()
+				success(v)
 			}
+			next.onFinish(v)
 		} else {
 			if failure != nil {
-				failure(p.err)
+				failure(err)
 			}
+			next.onFail(err)
 		}
-	} else {
-		if success != nil {
-			p.sfs = append(p.sfs, success)
-		}
-		if failure != nil {
-			p.efs = append(p.efs, failure)
-		}
-		if !p.started {
-			p.fun(p.onFinish, p.onFail)
-			p.started = true
-		}
-	}
+	})
+	return next
 }
 
-// onFinish is the FinishHandler passed to the promise function
-func (p *Promise) onFinish() {
-	p.finished = true
-	for _, v := range p.sfs {
-		v()
+// Wait starts the Promise if it has not been already started, and waits for it to complete.
+// Returns ctx.Err() if the context is cancelled before the Promise completes.
+func (p *Promise[T]) Wait(ctx context.Context) (T, error) {
+	p.subscribe(func(T, error) {})
+	select {
+	case <-p.done:
+		return p.val, p.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
 	}
-	//save memory
-	p.sfs = nil
-	p.efs = nil
 }
 
-// onFail is the FailHandler passed to the promise function
-func (p *Promise) onFail(err error) {
-	p.finished = true
-	p.err = err
-	for _, v := range p.efs {
-		v(err)
+// subscribe registers a callback for completion, and starts the Promise if it has not been already started.
+func (p *Promise[T]) subscribe(cb func(T, error)) {
+	p.lck.Lock()
+	if p.finished {
+		p.lck.Unlock()
+		cb(p.val, p.err)
+		return
+	}
+	p.cbs = append(p.cbs, cb)
+	if p.started {
+		p.lck.Unlock()
+		return
 	}
-	//save memory
-	p.sfs = nil
-	p.efs = nil
+	p.started = true
+	fun := p.fun
+	p.fun = nil
+	p.lck.Unlock()
+	fun(p.onFinish, p.onFail)
 }
 
-//FinishHandler is a type of function used as a callback for a Promise on success
-type FinishHandler func()
+// onFinish is the FinishHandler passed to the promise function
+func (p *Promise[T]) onFinish(v T) {
+	p.complete(v, nil)
+}
 
-//FailHandler is a type of function used as a callback for a Promise on failure
-type FailHandler func(error)
+// onFail is the FailHandler passed to the promise function
+func (p *Promise[T]) onFail(err error) {
+	var zero T
+	p.complete(zero, err)
+}
 
-//NewPromise returns a *Promise using the given function
-func NewPromise(fun func(FinishHandler, FailHandler)) *Promise {
-	return &Promise{
-		fun: fun,
-		sfs: []FinishHandler{},
-		efs: []FailHandler{},
+// complete stores the result of the Promise and calls the callbacks.
+// Only the first call has any effect.
+func (p *Promise[T]) complete(v T, err error) {
+	p.lck.Lock()
+	if p.finished {
+		p.lck.Unlock()
+		return
+	}
+	p.finished = true
+	p.val, p.err = v, err
+	cbs := p.cbs
+	p.cbs = nil //save memory
+	close(p.done)
+	p.lck.Unlock()
+	for _, cb := range cbs {
+		cb(v, err)
 	}
 }
 
-// BuildDependencyError is an error indicating that dependencies failed
-type BuildDependencyError []string
+// Chain returns a Promise which applies fn to the value of p when p succeeds.
+// If p fails, the returned Promise fails with the same error.
+func Chain[T, U any](p *Promise[T], fn func(T) (U, error)) *Promise[U] {
+	return NewPromise(func(s FinishHandler[U], f FailHandler) {
+		p.Then(func(v T) {
+			u, err := fn(v)
+			if err != nil {
+				f(err)
+				return
+			}
+			s(u)
+		}, f)
+	})
+}
 
-func (bde BuildDependencyError) Error() string {
-	return fmt.Sprintf("dependencies failed: (%s)", strings.Join([]string(bde), ","))
+// Settled is the result of a completed Promise.
+type Settled[T any] struct {
+	// Value is the value of the Promise, if it succeeded.
+	Value T
+
+	// Err is the error from the Promise, or nil if it succeeded.
+	Err error
 }
 
-func newBuildPromise(deps map[string]*Promise) *Promise {
-	return NewPromise(func(s FinishHandler, f FailHandler) {
-		fails := make(map[string]struct{})
-		n := len(deps)
-		meh := func() {
-			if n == 0 {
-				if len(fails) == 0 {
-					s()
-				} else {
-					flst := make([]string, len(fails))
-					i := 0
-					for n := range fails {
-						flst[i] = n
-						i++
-					}
-					sort.Strings(flst)
-					f(BuildDependencyError(flst))
+// AllSettled returns a Promise which succeeds with the results of all of the promises once they have all completed.
+// The results are in the same order as the promises.
+func AllSettled[T any](promises ...*Promise[T]) *Promise[[]Settled[T]] {
+	return NewPromise(func(s FinishHandler[[]Settled[T]], f FailHandler) {
+		results := make([]Settled[T], len(promises))
+		var lck sync.Mutex
+		n := len(promises)
+		if n == 0 {
+			s(results)
+			return
+		}
+		for i, p := range promises {
+			i := i
+			p.subscribe(func(v T, err error) {
+				lck.Lock()
+				results[i] = Settled[T]{Value: v, Err: err}
+				n--
+				last := n == 0
+				lck.Unlock()
+				if last {
+					s(results)
 				}
-				fails = nil
-			}
+			})
+		}
+	})
+}
+
+// All returns a Promise which succeeds with the values of all of the promises if they all succeed.
+// The values are in the same order as the promises.
+// If any of the promises fails, the returned Promise fails with the first error.
+func All[T any](promises ...*Promise[T]) *Promise[[]T] {
+	return NewPromise(func(s FinishHandler[[]T], f FailHandler) {
+		vals := make([]T, len(promises))
+		var lck sync.Mutex
+		n := len(promises)
+		if n == 0 {
+			s(vals)
+			return
 		}
-		for i, v := range deps {
-			name := i
-			v.Then(func() {
+		for i, p := range promises {
+			i := i
+			p.Then(func(v T) {
+				lck.Lock()
+				vals[i] = v
 				n--
-				meh()
-			}, func(error) {
+				last := n == 0
+				lck.Unlock()
+				if last {
+					s(vals)
+				}
+			}, f)
+		}
+	})
+}
+
+// Any returns a Promise which succeeds with the value of the first of the promises to succeed.
+// If all of the promises fail, the returned Promise fails with an AggregateError.
+func Any[T any](promises ...*Promise[T]) *Promise[T] {
+	return NewPromise(func(s FinishHandler[T], f FailHandler) {
+		errs := make(AggregateError, len(promises))
+		var lck sync.Mutex
+		n := len(promises)
+		if n == 0 {
+			f(errs)
+			return
+		}
+		for i, p := range promises {
+			i := i
+			p.Then(s, func(err error) {
+				lck.Lock()
+				errs[i] = err
 				n--
-				fails[name] = struct{}{}
-				meh()
+				last := n == 0
+				lck.Unlock()
+				if last {
+					f(errs)
+				}
 			})
 		}
 	})
 }
+
+// Race returns a Promise which completes with the result of the first of the promises to complete.
+// If there are no promises, the returned Promise never completes.
+func Race[T any](promises ...*Promise[T]) *Promise[T] {
+	return NewPromise(func(s FinishHandler[T], f FailHandler) {
+		for _, p := range promises {
+			p.Then(s, f)
+		}
+	})
+}
+
+// AggregateError is an error indicating that all of the promises passed to Any failed.
+// The errors are in the same order as the promises.
+type AggregateError []error
+
+func (ae AggregateError) Error() string {
+	strs := make([]string, len(ae))
+	for i, v := range ae {
+		strs[i] = v.Error()
+	}
+	return fmt.Sprintf("all promises failed: (%s)", strings.Join(strs, ","))
+}
+
+// BuildDependencyError is an error indicating that dependencies failed
+type BuildDependencyError []string
+
+func (bde BuildDependencyError) Error() string {
+	return fmt.Sprintf("dependencies failed: (%s)", strings.Join([]string(bde), ","))
+}
@@ -1,7 +1,9 @@
 package xgraph
 
 import (
+	"context"
 	"errors"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -28,9 +30,9 @@ func TestPromise(t *testing.T) {
 				defer timeout()()
 				var run bool
 				var e error
-				NewPromise(func(s FinishHandler, f FailHandler) {
-					s()
-				}).Then(func() { run = true }, func(err error) { e = err })
+				NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
+					s(struct{}{})
+				}).Then(func(struct{}) { run = true }, func(err error) { e = err })
 				return run, e
 			},
 			Expect: []interface{}{true, nil},
@@ -41,9 +43,9 @@ func TestPromise(t *testing.T) {
 				defer timeout()()
 				var run bool
 				var e error
-				NewPromise(func(s FinishHandler, f FailHandler) {
+				NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
 					f(errors.New("this is an error"))
-				}).Then(func() { run = true }, func(err error) { e = err })
+				}).Then(func(struct{}) { run = true }, func(err error) { e = err })
 				return run, e
 			},
 			Expect: []interface{}{false, errors.New("this is an error")},
@@ -54,11 +56,11 @@ func TestPromise(t *testing.T) {
 				defer timeout()()
 				var run1, run2 bool
 				var e1, e2 error
-				p := NewPromise(func(s FinishHandler, f FailHandler) {
+				p := NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
 					f(errors.New("this is an error"))
 				})
-				p.Then(func() { run1 = true }, func(err error) { e1 = err })
-				p.Then(func() { run2 = true }, func(err error) { e2 = err })
+				p.Then(func(struct{}) { run1 = true }, func(err error) { e1 = err })
+				p.Then(func(struct{}) { run2 = true }, func(err error) { e2 = err })
 				return run1, run2, e1, e2
 			},
 			Expect: []interface{}{false, false, errors.New("this is an error"), errors.New("this is an error")},
@@ -69,11 +71,11 @@ func TestPromise(t *testing.T) {
 				defer timeout()()
 				var run1, run2 bool
 				var e1, e2 error
-				p := NewPromise(func(s FinishHandler, f FailHandler) {
-					s()
+				p := NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
+					s(struct{}{})
 				})
-				p.Then(func() { run1 = true }, func(err error) { e1 = err })
-				p.Then(func() { run2 = true }, func(err error) { e2 = err })
+				p.Then(func(struct{}) { run1 = true }, func(err error) { e1 = err })
+				p.Then(func(struct{}) { run2 = true }, func(err error) { e2 = err })
 				return run1, run2, e1, e2
 			},
 			Expect: []interface{}{true, true, nil, nil},
@@ -83,12 +85,12 @@ func TestPromise(t *testing.T) {
 			Func: func() int {
 				defer timeout()()
 				runs := 0
-				p := NewPromise(func(s FinishHandler, f FailHandler) {
+				p := NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
 					runs++
-					s()
+					s(struct{}{})
 				})
-				p.Then(func() {}, func(err error) {})
-				p.Then(func() {}, func(err error) {})
+				p.Then(func(struct{}) {}, func(err error) {})
+				p.Then(func(struct{}) {}, func(err error) {})
 				return runs
 			},
 			Expect: []interface{}{1},
@@ -100,16 +102,16 @@ func TestPromise(t *testing.T) {
 				runs := 0
 				var lck sync.Mutex
 				lck.Lock()
-				p := NewPromise(func(s FinishHandler, f FailHandler) {
+				p := NewPromise(func(s FinishHandler[struct{}], f FailHandler) {
 					runs++
 					go func() {
 						lck.Lock()
 						defer lck.Unlock()
-						s()
+						s(struct{}{})
 					}()
 				})
-				p.Then(func() {}, func(err error) {})
-				p.Then(func() {}, func(err error) {})
+				p.Then(func(struct{}) {}, func(err error) {})
+				p.Then(func(struct{}) {}, func(err error) {})
 				lck.Unlock()
 				return runs
 			},
@@ -120,3 +122,185 @@ func TestPromise(t *testing.T) {
 		tv.genTest(t)
 	}
 }
+
+// later returns a Promise which resolves to v after a delay on another goroutine.
+func later[T any](v T, d time.Duration) *Promise[T] {
+	return NewPromise(func(s FinishHandler[T], f FailHandler) {
+		go func() {
+			time.Sleep(d)
+			s(v)
+		}()
+	})
+}
+
+// laterErr returns a Promise which fails with err after a delay on another goroutine.
+func laterErr[T any](err error, d time.Duration) *Promise[T] {
+	return NewPromise(func(s FinishHandler[T], f FailHandler) {
+		go func() {
+			time.Sleep(d)
+			f(err)
+		}()
+	})
+}
+
+func TestPromiseGeneric(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "wait",
+			Func: func() (int, error) {
+				defer timeout()()
+				return later(1, time.Millisecond).Wait(context.Background())
+			},
+			Expect: []interface{}{1, nil},
+		},
+		{
+			Name: "wait-cancel",
+			Func: func() (int, error) {
+				defer timeout()()
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return NewPromise(func(s FinishHandler[int], f FailHandler) {}).Wait(ctx)
+			},
+			Expect: []interface{}{0, context.Canceled},
+		},
+		{
+			Name: "resolved",
+			Func: func() (string, error) {
+				return Resolved("x").Wait(context.Background())
+			},
+			Expect: []interface{}{"x", nil},
+		},
+		{
+			Name: "rejected",
+			Func: func() (string, error) {
+				return Rejected[string](errors.New("bad")).Wait(context.Background())
+			},
+			Expect: []interface{}{"", errors.New("bad")},
+		},
+		{
+			Name: "then-chain",
+			Func: func() ([]int, int, error) {
+				defer timeout()()
+				var lck sync.Mutex
+				order := []int{}
+				add := func(i int) FinishHandler[int] {
+					return func(int) {
+						lck.Lock()
+						defer lck.Unlock()
+						order = append(order, i)
+					}
+				}
+				v, err := later(5, time.Millisecond).Then(add(1), nil).Then(add(2), nil).Wait(context.Background())
+				return order, v, err
+			},
+			Expect: []interface{}{[]int{1, 2}, 5, nil},
+		},
+		{
+			Name: "chain",
+			Func: func() (string, error) {
+				defer timeout()()
+				return Chain(later(5, time.Millisecond), func(v int) (string, error) {
+					return strconv.Itoa(v * 2), nil
+				}).Wait(context.Background())
+			},
+			Expect: []interface{}{"10", nil},
+		},
+		{
+			Name: "chain-error",
+			Func: func() (string, error) {
+				defer timeout()()
+				return Chain(laterErr[int](errors.New("bad"), time.Millisecond), func(v int) (string, error) {
+					return "unreachable", nil
+				}).Wait(context.Background())
+			},
+			Expect: []interface{}{"", errors.New("bad")},
+		},
+		{
+			Name: "all",
+			Func: func() ([]int, error) {
+				defer timeout()()
+				return All(later(1, 3*time.Millisecond), later(2, time.Millisecond), Resolved(3)).Wait(context.Background())
+			},
+			Expect: []interface{}{[]int{1, 2, 3}, nil},
+		},
+		{
+			Name: "all-empty",
+			Func: func() ([]int, error) {
+				return All[int]().Wait(context.Background())
+			},
+			Expect: []interface{}{[]int{}, nil},
+		},
+		{
+			Name: "all-error",
+			Func: func() ([]int, error) {
+				defer timeout()()
+				return All(later(1, time.Millisecond), laterErr[int](errors.New("bad"), time.Millisecond)).Wait(context.Background())
+			},
+			Expect: []interface{}{[]int(nil), errors.New("bad")},
+		},
+		{
+			Name: "all-settled",
+			Func: func() ([]Settled[int], error) {
+				defer timeout()()
+				return AllSettled(later(1, time.Millisecond), laterErr[int](errors.New("bad"), time.Millisecond)).Wait(context.Background())
+			},
+			Expect: []interface{}{[]Settled[int]{{Value: 1}, {Err: errors.New("bad")}}, nil},
+		},
+		{
+			Name: "any",
+			Func: func() (int, error) {
+				defer timeout()()
+				return Any(laterErr[int](errors.New("bad"), time.Millisecond), later(2, 5*time.Millisecond)).Wait(context.Background())
+			},
+			Expect: []interface{}{2, nil},
+		},
+		{
+			Name: "any-error",
+			Func: func() (int, error) {
+				defer timeout()()
+				return Any(laterErr[int](errors.New("bad1"), time.Millisecond), Rejected[int](errors.New("bad2"))).Wait(context.Background())
+			},
+			Expect: []interface{}{0, AggregateError{errors.New("bad1"), errors.New("bad2")}},
+		},
+		{
+			Name:   "aggregate-error",
+			Func:   AggregateError{errors.New("bad1"), errors.New("bad2")}.Error,
+			Expect: []interface{}{"all promises failed: (bad1,bad2)"},
+		},
+		{
+			Name: "race",
+			Func: func() (int, error) {
+				defer timeout()()
+				return Race(later(1, time.Second), laterErr[int](errors.New("bad"), time.Millisecond)).Wait(context.Background())
+			},
+			Expect: []interface{}{0, errors.New("bad")},
+		},
+		{
+			Name: "concurrent-then",
+			Func: func() (int, int) {
+				defer timeout()()
+				p := later(1, time.Millisecond)
+				var lck sync.Mutex
+				calls := 0
+				var wg sync.WaitGroup
+				for i := 0; i < 32; i++ {
+					wg.Add(1)
+					go func() {
+						p.Then(func(int) {
+							lck.Lock()
+							defer lck.Unlock()
+							calls++
+						}, nil).Then(func(int) { wg.Done() }, nil)
+					}()
+				}
+				wg.Wait()
+				v, _ := p.Wait(context.Background())
+				return calls, v
+			},
+			Expect: []interface{}{32, 1},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
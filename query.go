@@ -0,0 +1,724 @@
+package xgraph
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// QueryResult is the result of a query on a Graph.
+type QueryResult struct {
+	// Jobs is the sorted list of the names of the Jobs matched by the query.
+	Jobs []string
+
+	// Edges is the sorted list of the dependencies between the Jobs matched by the query.
+	Edges []QueryEdge
+}
+
+// QueryEdge is a dependency between two Jobs in a QueryResult.
+type QueryEdge struct {
+	// From is the name of the dependent Job.
+	From string
+
+	// To is the name of the Job depended on.
+	To string
+
+	// Type is the kind of dependency.
+	Type DependencyType
+}
+
+// QueryError is an error in the syntax of a query.
+type QueryError struct {
+	// Pos is the byte offset in the query where the error was found.
+	Pos int
+
+	// Msg is a description of the error.
+	Msg string
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("query syntax error at offset %d: %s", err.Pos, err.Msg)
+}
+
+// Query evaluates a query expression on the Graph, and returns the matching Jobs and the dependencies between them.
+// Jobs are looked up as they are needed by the query, including Jobs created by generators.
+//
+// An expression is a set of Jobs, and may be:
+//
+//	name                    the Job with the name, or the targets of the alias with the name (see AddAlias)
+//	pattern                 the Jobs added to the Graph (see Jobs) with names matching a pattern, where * matches any sequence of characters
+//	deps(x [, depth])       x and its transitive dependencies, up to an optional depth
+//	rdeps(u, x [, depth])   the Jobs in deps(u) which transitively depend on x, up to an optional depth
+//	somepath(a, b)          the Jobs on a path of dependencies from a Job in a to a Job in b
+//	allpaths(a, b)          the Jobs on any path of dependencies from a Job in a to a Job in b
+//	filter(regexp, x)       the Jobs in x with names matching the regular expression
+//	tag(tag, x)             the Jobs in x with the tag (see TaggedJob)
+//	x union y, x + y        the Jobs in either x or y
+//	x intersect y, x ^ y    the Jobs in both x and y
+//	x except y, x - y       the Jobs in x but not in y
+//	(x)                     grouping
+//
+// Set operators are left-associative and have equal precedence.
+// Names, patterns and regular expressions may be quoted with double quotes.
+// Dependencies are followed along hard and soft dependencies, since order-only dependencies do not add Jobs to a build.
+// Order-only dependencies between matching Jobs are included in the Edges of the result.
+func (g *Graph) Query(expr string) (*QueryResult, error) {
+	qp := &queryParser{src: expr}
+	qp.next()
+	q, err := qp.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if qp.err != nil {
+		return nil, qp.err
+	}
+	if qp.tok.kind != tokEOF {
+		return nil, qp.errorf("unexpected %s", qp.tok)
+	}
+
+	qe := &queryEval{g: g, nodes: make(map[string]*queryNode)}
+	set, err := q.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	res := &QueryResult{
+		Jobs:  set.sorted(),
+		Edges: []QueryEdge{},
+	}
+	for _, name := range res.Jobs {
+		n, err := qe.node(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range n.deps {
+			if set[d.Name] {
+				res.Edges = append(res.Edges, QueryEdge{From: name, To: d.Name, Type: d.Type})
+			}
+		}
+	}
+	sort.Slice(res.Edges, func(i, j int) bool {
+		a, b := res.Edges[i], res.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Type < b.Type
+	})
+	return res, nil
+}
+
+// jobSet is a set of names of Jobs.
+type jobSet map[string]bool
+
+func (s jobSet) sorted() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// queryNode is a Job which has been looked up by a query.
+type queryNode struct {
+	job Job
+
+	// deps is the dependencies of the job, with absolute names
+	deps []Dependency
+}
+
+// queryEval is the state of the evaluation of a query.
+type queryEval struct {
+	g *Graph
+
+	// nodes is the Jobs which have been looked up, indexed by name
+	nodes map[string]*queryNode
+}
+
+// node looks up a Job and lists its dependencies.
+func (qe *queryEval) node(name string) (*queryNode, error) {
+	if n := qe.nodes[name]; n != nil {
+		return n, nil
+	}
+	j, err := qe.g.GetJob(name)
+	if err != nil {
+		return nil, err
+	}
+	deps, err := listDependencies(j)
+	if err != nil {
+		return nil, err
+	}
+	deps = qe.g.expandDeps(deps)
+	n := &queryNode{job: j, deps: make([]Dependency, len(deps))}
+	for i, d := range deps {
+		n.deps[i] = Dependency{Name: strings.TrimPrefix(d.Name, "/"), Type: d.Type}
+	}
+	qe.nodes[name] = n
+	return n, nil
+}
+
+// follow lists the dependencies of a Job which are followed by a query.
+func (qe *queryEval) follow(name string) ([]string, error) {
+	n, err := qe.node(name)
+	if err != nil {
+		return nil, err
+	}
+	deps := make([]string, 0, len(n.deps))
+	for _, d := range n.deps {
+		if d.Type != OrderDependency {
+			deps = append(deps, d.Name)
+		}
+	}
+	return deps, nil
+}
+
+// closure finds a set of Jobs and their dependencies, up to a depth (or unlimited if depth < 0).
+func (qe *queryEval) closure(set jobSet, depth int) (jobSet, error) {
+	out := make(jobSet, len(set))
+	level := set.sorted()
+	for _, name := range level {
+		out[name] = true
+	}
+	for ; len(level) > 0 && depth != 0; depth-- {
+		var next []string
+		for _, name := range level {
+			deps, err := qe.follow(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range deps {
+				if !out[d] {
+					out[d] = true
+					next = append(next, d)
+				}
+			}
+		}
+		level = next
+	}
+	return out, nil
+}
+
+// reverse finds the reverse dependencies of the Jobs in a universe.
+func (qe *queryEval) reverse(universe jobSet) (map[string][]string, error) {
+	rdeps := make(map[string][]string)
+	for _, name := range universe.sorted() {
+		deps, err := qe.follow(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps {
+			rdeps[d] = append(rdeps[d], name)
+		}
+	}
+	return rdeps, nil
+}
+
+// queryExpr is a parsed query expression.
+type queryExpr interface {
+	eval(qe *queryEval) (jobSet, error)
+}
+
+// queryName is a name or pattern.
+type queryName string
+
+func (qn queryName) eval(qe *queryEval) (jobSet, error) {
+	name := strings.TrimPrefix(string(qn), "/")
+	if !strings.Contains(name, "*") {
+		set := make(jobSet)
+		for _, v := range qe.g.expand([]string{name}) {
+			v = strings.TrimPrefix(v, "/")
+			if _, err := qe.node(v); err != nil {
+				return nil, err
+			}
+			set[v] = true
+		}
+		return set, nil
+	}
+	re := regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(name), `\*`, ".*") + "$")
+	set := make(jobSet)
+	for _, name := range qe.g.Jobs() {
+		if re.MatchString(name) {
+			set[name] = true
+		}
+	}
+	return set, nil
+}
+
+// queryOp is a set operation.
+type queryOp struct {
+	op   string
+	l, r queryExpr
+}
+
+func (qo queryOp) eval(qe *queryEval) (jobSet, error) {
+	l, err := qo.l.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	r, err := qo.r.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	out := make(jobSet)
+	switch qo.op {
+	case "union":
+		for name := range l {
+			out[name] = true
+		}
+		for name := range r {
+			out[name] = true
+		}
+	case "intersect":
+		for name := range l {
+			if r[name] {
+				out[name] = true
+			}
+		}
+	case "except":
+		for name := range l {
+			if !r[name] {
+				out[name] = true
+			}
+		}
+	}
+	return out, nil
+}
+
+// queryDeps is deps(x, depth).
+type queryDeps struct {
+	x     queryExpr
+	depth int
+}
+
+func (qd queryDeps) eval(qe *queryEval) (jobSet, error) {
+	x, err := qd.x.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	return qe.closure(x, qd.depth)
+}
+
+// queryRdeps is rdeps(u, x, depth).
+type queryRdeps struct {
+	u, x  queryExpr
+	depth int
+}
+
+func (qr queryRdeps) eval(qe *queryEval) (jobSet, error) {
+	u, err := qr.u.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	x, err := qr.x.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	universe, err := qe.closure(u, -1)
+	if err != nil {
+		return nil, err
+	}
+	rdeps, err := qe.reverse(universe)
+	if err != nil {
+		return nil, err
+	}
+	out := make(jobSet)
+	var level []string
+	for _, name := range x.sorted() {
+		if universe[name] {
+			out[name] = true
+			level = append(level, name)
+		}
+	}
+	for depth := qr.depth; len(level) > 0 && depth != 0; depth-- {
+		var next []string
+		for _, name := range level {
+			for _, r := range rdeps[name] {
+				if !out[r] {
+					out[r] = true
+					next = append(next, r)
+				}
+			}
+		}
+		level = next
+	}
+	return out, nil
+}
+
+// querySomepath is somepath(a, b).
+type querySomepath struct {
+	a, b queryExpr
+}
+
+func (qs querySomepath) eval(qe *queryEval) (jobSet, error) {
+	a, err := qs.a.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	b, err := qs.b.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+
+	//breadth-first search for the shortest path
+	from := make(map[string]string)
+	queue := a.sorted()
+	for _, name := range queue {
+		from[name] = ""
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if b[name] {
+			out := make(jobSet)
+			for ; name != ""; name = from[name] {
+				out[name] = true
+			}
+			return out, nil
+		}
+		deps, err := qe.follow(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deps {
+			if _, ok := from[d]; !ok {
+				from[d] = name
+				queue = append(queue, d)
+			}
+		}
+	}
+	return jobSet{}, nil
+}
+
+// queryAllpaths is allpaths(a, b).
+type queryAllpaths struct {
+	a, b queryExpr
+}
+
+func (qa queryAllpaths) eval(qe *queryEval) (jobSet, error) {
+	a, err := qa.a.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	b, err := qa.b.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	reach, err := qe.closure(a, -1)
+	if err != nil {
+		return nil, err
+	}
+	rdeps, err := qe.reverse(reach)
+	if err != nil {
+		return nil, err
+	}
+
+	//find the reachable Jobs which lead to b
+	out := make(jobSet)
+	var stack []string
+	for name := range b {
+		if reach[name] {
+			out[name] = true
+			stack = append(stack, name)
+		}
+	}
+	for len(stack) > 0 {
+		name := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, r := range rdeps[name] {
+			if !out[r] {
+				out[r] = true
+				stack = append(stack, r)
+			}
+		}
+	}
+	return out, nil
+}
+
+// queryFilter is filter(regexp, x).
+type queryFilter struct {
+	re *regexp.Regexp
+	x  queryExpr
+}
+
+func (qf queryFilter) eval(qe *queryEval) (jobSet, error) {
+	x, err := qf.x.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	out := make(jobSet)
+	for name := range x {
+		if qf.re.MatchString(name) {
+			out[name] = true
+		}
+	}
+	return out, nil
+}
+
+// queryTag is tag(tag, x).
+type queryTag struct {
+	tag string
+	x   queryExpr
+}
+
+func (qt queryTag) eval(qe *queryEval) (jobSet, error) {
+	x, err := qt.x.eval(qe)
+	if err != nil {
+		return nil, err
+	}
+	out := make(jobSet)
+	for name := range x {
+		n, err := qe.node(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range jobTags(n.job) {
+			if t == qt.tag {
+				out[name] = true
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// tokenKind is a kind of token in a query.
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokPunct
+)
+
+// token is a token in a query.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// queryParser is a recursive descent parser for queries.
+type queryParser struct {
+	src string
+	pos int
+	tok token
+	err error
+}
+
+func (qp *queryParser) errorf(format string, args ...interface{}) error {
+	if qp.err != nil {
+		return qp.err
+	}
+	return &QueryError{Pos: qp.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next reads the next token.
+func (qp *queryParser) next() {
+	for qp.pos < len(qp.src) && strings.IndexByte(" \t\r\n", qp.src[qp.pos]) >= 0 {
+		qp.pos++
+	}
+	start := qp.pos
+	if qp.pos == len(qp.src) {
+		qp.tok = token{kind: tokEOF, pos: start}
+		return
+	}
+	switch c := qp.src[qp.pos]; {
+	case strings.IndexByte("(),+^", c) >= 0:
+		qp.pos++
+		qp.tok = token{kind: tokPunct, text: string(c), pos: start}
+	case c == '"':
+		end := strings.IndexByte(qp.src[start+1:], '"')
+		if end < 0 {
+			qp.tok = token{kind: tokEOF, pos: start}
+			qp.err = &QueryError{Pos: start, Msg: "unterminated string"}
+			qp.pos = len(qp.src)
+			return
+		}
+		qp.pos = start + end + 2
+		qp.tok = token{kind: tokString, text: qp.src[start+1 : start+1+end], pos: start}
+	default:
+		for qp.pos < len(qp.src) && strings.IndexByte(" \t\r\n(),+^\"", qp.src[qp.pos]) < 0 {
+			qp.pos++
+		}
+		qp.tok = token{kind: tokWord, text: qp.src[start:qp.pos], pos: start}
+	}
+}
+
+// setOps maps the set operators to their names.
+var setOps = map[string]string{
+	"union":     "union",
+	"+":         "union",
+	"intersect": "intersect",
+	"^":         "intersect",
+	"except":    "except",
+	"-":         "except",
+}
+
+// parseExpr parses a sequence of set operations.
+func (qp *queryParser) parseExpr() (queryExpr, error) {
+	x, err := qp.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := setOps[qp.tok.text]
+		if !ok || qp.tok.kind == tokString {
+			return x, nil
+		}
+		qp.next()
+		y, err := qp.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		x = queryOp{op: op, l: x, r: y}
+	}
+}
+
+// parseTerm parses a name, function call or parenthesized expression.
+func (qp *queryParser) parseTerm() (queryExpr, error) {
+	t := qp.tok
+	switch {
+	case t.kind == tokPunct && t.text == "(":
+		qp.next()
+		x, err := qp.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := qp.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	case t.kind == tokString:
+		qp.next()
+		return queryName(t.text), nil
+	case t.kind == tokWord:
+		if _, ok := setOps[t.text]; ok {
+			return nil, qp.errorf("unexpected %s", t)
+		}
+		qp.next()
+		if qp.tok.kind != tokPunct || qp.tok.text != "(" {
+			return queryName(t.text), nil
+		}
+		return qp.parseCall(t)
+	default:
+		return nil, qp.errorf("unexpected %s", t)
+	}
+}
+
+// parseCall parses the arguments of a function call.
+func (qp *queryParser) parseCall(fn token) (queryExpr, error) {
+	qp.next()
+	var x queryExpr
+	var err error
+	switch fn.text {
+	case "deps":
+		q := queryDeps{depth: -1}
+		if q.x, err = qp.parseExpr(); err != nil {
+			return nil, err
+		}
+		if q.depth, err = qp.parseDepth(); err != nil {
+			return nil, err
+		}
+		x = q
+	case "rdeps":
+		q := queryRdeps{depth: -1}
+		if q.u, err = qp.parseExpr(); err != nil {
+			return nil, err
+		}
+		if err = qp.expect(","); err != nil {
+			return nil, err
+		}
+		if q.x, err = qp.parseExpr(); err != nil {
+			return nil, err
+		}
+		if q.depth, err = qp.parseDepth(); err != nil {
+			return nil, err
+		}
+		x = q
+	case "somepath", "allpaths":
+		a, err := qp.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err = qp.expect(","); err != nil {
+			return nil, err
+		}
+		b, err := qp.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if fn.text == "somepath" {
+			x = querySomepath{a: a, b: b}
+		} else {
+			x = queryAllpaths{a: a, b: b}
+		}
+	case "filter", "tag":
+		arg := qp.tok
+		if arg.kind != tokWord && arg.kind != tokString {
+			return nil, qp.errorf("expected argument of %s but found %s", fn.text, arg)
+		}
+		qp.next()
+		if err = qp.expect(","); err != nil {
+			return nil, err
+		}
+		sub, err := qp.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if fn.text == "tag" {
+			x = queryTag{tag: arg.text, x: sub}
+			break
+		}
+		re, err := regexp.Compile(arg.text)
+		if err != nil {
+			return nil, &QueryError{Pos: arg.pos, Msg: err.Error()}
+		}
+		x = queryFilter{re: re, x: sub}
+	default:
+		return nil, &QueryError{Pos: fn.pos, Msg: fmt.Sprintf("unknown function %q", fn.text)}
+	}
+	if err := qp.expect(")"); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// parseDepth parses an optional depth argument.
+// Returns -1 if there is no depth.
+func (qp *queryParser) parseDepth() (int, error) {
+	if qp.tok.kind != tokPunct || qp.tok.text != "," {
+		return -1, nil
+	}
+	qp.next()
+	depth, err := strconv.Atoi(qp.tok.text)
+	if qp.tok.kind != tokWord || err != nil || depth < 0 {
+		return 0, qp.errorf("expected depth but found %s", qp.tok)
+	}
+	qp.next()
+	return depth, nil
+}
+
+// expect consumes a punctuation token.
+func (qp *queryParser) expect(p string) error {
+	if qp.tok.kind != tokPunct || qp.tok.text != p {
+		return qp.errorf("expected %q but found %s", p, qp.tok)
+	}
+	qp.next()
+	return nil
+}
@@ -0,0 +1,217 @@
+package xgraph
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	nop := func() error { return nil }
+	errDeps := errors.New("deps failed")
+	sub := New().AddGenerator(func(name string) (Job, error) {
+		switch name {
+		case "bad":
+			return depErrJob{BasicJob{JobName: name}, errDeps}, nil
+		case "gen":
+			return BasicJob{JobName: name, Deps: []string{"/lib"}, RunCallback: nop}, nil
+		}
+		return nil, nil
+	})
+	g := New().AddJob(BasicJob{
+		JobName:     "lib",
+		RunCallback: nop,
+	}).AddJob(BasicJob{
+		JobName:     "codegen",
+		RunCallback: nop,
+	}).AddJob(BasicJob{
+		JobName:     "app",
+		Deps:        []string{"lib"},
+		OrderDeps:   []string{"codegen"},
+		RunCallback: nop,
+		JobTags:     []string{"release"},
+	}).AddJob(BasicJob{
+		JobName:     "test-app",
+		Deps:        []string{"app"},
+		SoftDeps:    []string{"lib"},
+		RunCallback: nop,
+		JobTags:     []string{"test", "unit"},
+	}).AddJob(BasicJob{
+		JobName:     "test-gen",
+		Deps:        []string{"sub/gen"},
+		RunCallback: nop,
+		JobTags:     []string{"test"},
+	}).AddJob(BasicJob{
+		JobName:     "cycle-a",
+		Deps:        []string{"cycle-b"},
+		RunCallback: nop,
+	}).AddJob(BasicJob{
+		JobName:     "cycle-b",
+		Deps:        []string{"cycle-a", "lib"},
+		RunCallback: nop,
+	}).Mount("sub", sub)
+	jobs := func(expr string) ([]string, error) {
+		res, err := g.Query(expr)
+		if err != nil {
+			return nil, err
+		}
+		return res.Jobs, nil
+	}
+	tests := []testCase{
+		{
+			Name:   "name",
+			Func:   jobs,
+			Args:   []interface{}{"app"},
+			Expect: []interface{}{[]string{"app"}, error(nil)},
+		},
+		{
+			Name:   "pattern",
+			Func:   jobs,
+			Args:   []interface{}{`test-* + "cycle-*"`},
+			Expect: []interface{}{[]string{"cycle-a", "cycle-b", "test-app", "test-gen"}, error(nil)},
+		},
+		{
+			Name:   "deps",
+			Func:   jobs,
+			Args:   []interface{}{"deps(test-gen)"},
+			Expect: []interface{}{[]string{"lib", "sub/gen", "test-gen"}, error(nil)},
+		},
+		{
+			Name:   "deps-order-only",
+			Func:   jobs,
+			Args:   []interface{}{"deps(app)"},
+			Expect: []interface{}{[]string{"app", "lib"}, error(nil)},
+		},
+		{
+			Name:   "deps-depth",
+			Func:   jobs,
+			Args:   []interface{}{"deps(test-gen, 1)"},
+			Expect: []interface{}{[]string{"sub/gen", "test-gen"}, error(nil)},
+		},
+		{
+			Name:   "deps-cycle",
+			Func:   jobs,
+			Args:   []interface{}{"deps(cycle-a)"},
+			Expect: []interface{}{[]string{"cycle-a", "cycle-b", "lib"}, error(nil)},
+		},
+		{
+			Name:   "rdeps",
+			Func:   jobs,
+			Args:   []interface{}{"rdeps(test-* + app, lib)"},
+			Expect: []interface{}{[]string{"app", "lib", "sub/gen", "test-app", "test-gen"}, error(nil)},
+		},
+		{
+			Name:   "rdeps-depth",
+			Func:   jobs,
+			Args:   []interface{}{"rdeps(test-*, lib, 1)"},
+			Expect: []interface{}{[]string{"app", "lib", "sub/gen", "test-app"}, error(nil)},
+		},
+		{
+			Name:   "somepath",
+			Func:   jobs,
+			Args:   []interface{}{"somepath(test-app, lib)"},
+			Expect: []interface{}{[]string{"lib", "test-app"}, error(nil)},
+		},
+		{
+			Name:   "somepath-none",
+			Func:   jobs,
+			Args:   []interface{}{"somepath(lib, app)"},
+			Expect: []interface{}{[]string{}, error(nil)},
+		},
+		{
+			Name:   "allpaths",
+			Func:   jobs,
+			Args:   []interface{}{"allpaths(test-app, lib)"},
+			Expect: []interface{}{[]string{"app", "lib", "test-app"}, error(nil)},
+		},
+		{
+			Name:   "filter",
+			Func:   jobs,
+			Args:   []interface{}{`filter("^sub/|b$", deps(test-*))`},
+			Expect: []interface{}{[]string{"lib", "sub/gen"}, error(nil)},
+		},
+		{
+			Name:   "tag",
+			Func:   jobs,
+			Args:   []interface{}{"tag(test, *) except tag(unit, *)"},
+			Expect: []interface{}{[]string{"test-gen"}, error(nil)},
+		},
+		{
+			Name:   "set-operations",
+			Func:   jobs,
+			Args:   []interface{}{"deps(test-app) ^ deps(test-gen) union (app - app) + codegen"},
+			Expect: []interface{}{[]string{"codegen", "lib"}, error(nil)},
+		},
+		{
+			Name:   "missing",
+			Func:   jobs,
+			Args:   []interface{}{"deps(app) + nope"},
+			Expect: []interface{}{[]string(nil), JobNotFoundError("nope")},
+		},
+		{
+			Name:   "deps-error",
+			Func:   jobs,
+			Args:   []interface{}{"deps(sub/bad)"},
+			Expect: []interface{}{[]string(nil), errDeps},
+		},
+		{
+			Name:   "syntax-unexpected",
+			Func:   jobs,
+			Args:   []interface{}{"app lib"},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 4, Msg: `unexpected "lib"`}},
+		},
+		{
+			Name:   "syntax-function",
+			Func:   jobs,
+			Args:   []interface{}{"app + nope(lib)"},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 6, Msg: `unknown function "nope"`}},
+		},
+		{
+			Name:   "syntax-paren",
+			Func:   jobs,
+			Args:   []interface{}{"deps(app"},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 8, Msg: `expected ")" but found end of query`}},
+		},
+		{
+			Name:   "syntax-depth",
+			Func:   jobs,
+			Args:   []interface{}{"deps(app, x)"},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 10, Msg: `expected depth but found "x"`}},
+		},
+		{
+			Name:   "syntax-string",
+			Func:   jobs,
+			Args:   []interface{}{`app "lib`},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 4, Msg: "unterminated string"}},
+		},
+		{
+			Name:   "syntax-regexp",
+			Func:   jobs,
+			Args:   []interface{}{`filter("(", app)`},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 7, Msg: "error parsing regexp: missing closing ): `(`"}},
+		},
+		{
+			Name:   "syntax-operator",
+			Func:   jobs,
+			Args:   []interface{}{"app + - lib"},
+			Expect: []interface{}{[]string(nil), &QueryError{Pos: 6, Msg: `unexpected "-"`}},
+		},
+		{
+			Name: "edges",
+			Func: func() (*QueryResult, error) {
+				return g.Query("deps(test-app) + codegen")
+			},
+			Expect: []interface{}{&QueryResult{
+				Jobs: []string{"app", "codegen", "lib", "test-app"},
+				Edges: []QueryEdge{
+					{From: "app", To: "codegen", Type: OrderDependency},
+					{From: "app", To: "lib", Type: HardDependency},
+					{From: "test-app", To: "app", Type: HardDependency},
+					{From: "test-app", To: "lib", Type: SoftDependency},
+				},
+			}, error(nil)},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,642 @@
+package xgraph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// RemoteTask is a serializable description of the work done by a Job, which can be sent to another process.
+type RemoteTask struct {
+	// Kind is the kind of task, which selects the function used to run it.
+	// See RegisterTaskKind.
+	Kind string `json:"kind"`
+
+	// Data is the JSON-encoded input of the task.
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// RemoteJob is an optional interface implemented by Jobs which can be run in another process.
+type RemoteJob interface {
+	Job
+
+	// RemoteTask returns a description of the work done by Run.
+	// If it returns nil, the Job is run locally.
+	RemoteTask() (*RemoteTask, error)
+}
+
+// remoteTask gets the RemoteTask of a Job, or nil if the Job can only be run locally.
+func remoteTask(j Job) (*RemoteTask, error) {
+	if rj, ok := j.(RemoteJob); ok {
+		return rj.RemoteTask()
+	}
+	return nil, nil
+}
+
+// TaskFunc is a function which runs RemoteTasks of a kind.
+type TaskFunc func(ctx context.Context, data json.RawMessage) error
+
+var taskKinds = struct {
+	sync.RWMutex
+	m map[string]TaskFunc
+}{m: make(map[string]TaskFunc)}
+
+// RegisterTaskKind registers the function used to run RemoteTasks of a kind.
+// A worker can only run kinds which are registered in its process, so this is usually called from an init function.
+// The "exec" kind is used by ExecJob.
+func RegisterTaskKind(kind string, fn TaskFunc) {
+	taskKinds.Lock()
+	defer taskKinds.Unlock()
+	taskKinds.m[kind] = fn
+}
+
+// RunTask runs a RemoteTask using the function registered for its kind.
+func RunTask(ctx context.Context, task *RemoteTask) error {
+	taskKinds.RLock()
+	fn := taskKinds.m[task.Kind]
+	taskKinds.RUnlock()
+	if fn == nil {
+		return UnknownTaskKindError(task.Kind)
+	}
+	return fn(ctx, task.Data)
+}
+
+// UnknownTaskKindError is an error indicating that no function was registered for a kind of RemoteTask.
+// The underlying string is the kind.
+type UnknownTaskKindError string
+
+func (err UnknownTaskKindError) Error() string {
+	return fmt.Sprintf("unknown task kind: %q", string(err))
+}
+
+// RemoteError is an error returned by a task on a worker.
+type RemoteError struct {
+	// Worker is the name of the worker.
+	Worker string
+
+	// Message is the error message from the worker.
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	return fmt.Sprintf("worker %s: %s", err.Worker, err.Message)
+}
+
+// WorkerLostError is an error indicating that a task was lost on too many workers.
+type WorkerLostError struct {
+	// Job is the name of the Job.
+	Job string
+
+	// Attempts is the number of workers the task was sent to.
+	Attempts int
+}
+
+func (err *WorkerLostError) Error() string {
+	return fmt.Sprintf("job %q lost on %d workers", err.Job, err.Attempts)
+}
+
+// ErrRunnerClosed is an error indicating that a RemoteRunner was closed.
+var ErrRunnerClosed = errors.New("remote runner closed")
+
+// DefaultRemoteTimeout is the default time to wait for a message from a worker before it is considered dead.
+const DefaultRemoteTimeout = 30 * time.Second
+
+// remoteMessage is a message in the protocol between a RemoteRunner and a Worker.
+// Messages are encoded as JSON, one per line.
+//
+// A worker starts by sending a "hello" with its name and capacity, and the runner replies with "welcome" and a timeout.
+// The runner then sends "task" messages with an ID, and may send a "cancel" with the same ID.
+// The worker replies to each task with a "result", which has an error message if the task failed.
+// Both sides send a "heartbeat" every third of the timeout, and close the connection if nothing is received within the timeout.
+type remoteMessage struct {
+	Type     string        `json:"type"`
+	ID       uint64        `json:"id,omitempty"`
+	Worker   string        `json:"worker,omitempty"`
+	Capacity int           `json:"capacity,omitempty"`
+	Timeout  time.Duration `json:"timeout,omitempty"`
+	Task     *RemoteTask   `json:"task,omitempty"`
+	Failed   bool          `json:"failed,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// remoteConn is a connection carrying remoteMessages.
+type remoteConn struct {
+	conn    net.Conn
+	timeout time.Duration
+	dec     *json.Decoder
+	wlck    sync.Mutex
+	enc     *json.Encoder
+}
+
+func newRemoteConn(conn net.Conn, timeout time.Duration) *remoteConn {
+	return &remoteConn{
+		conn:    conn,
+		timeout: timeout,
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+	}
+}
+
+// send sends a message, closing the connection if it cannot be sent within the timeout.
+func (rc *remoteConn) send(msg remoteMessage) error {
+	rc.wlck.Lock()
+	defer rc.wlck.Unlock()
+	rc.conn.SetWriteDeadline(time.Now().Add(rc.timeout))
+	err := rc.enc.Encode(msg)
+	if err != nil {
+		rc.conn.Close()
+	}
+	return err
+}
+
+// recv receives a message, failing if nothing is received within the timeout.
+func (rc *remoteConn) recv() (remoteMessage, error) {
+	var msg remoteMessage
+	rc.conn.SetReadDeadline(time.Now().Add(rc.timeout))
+	err := rc.dec.Decode(&msg)
+	return msg, err
+}
+
+// heartbeat sends heartbeats until stop is closed or sending fails.
+func (rc *remoteConn) heartbeat(stop chan struct{}) {
+	t := time.NewTicker(rc.timeout / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if rc.send(remoteMessage{Type: "heartbeat"}) != nil {
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RemoteRunner is a WorkRunner which sends Jobs to worker processes over TCP.
+// Workers connect to a listener passed to Serve (see Worker), and report how many tasks they can run at once.
+// Jobs which implement RemoteJob are queued, and sent to the worker with the most free capacity.
+// Other Jobs are run locally.
+// If a worker disconnects or stops sending heartbeats, its tasks are sent to another worker.
+//
+// The fields must not be changed after the RemoteRunner is first used.
+type RemoteRunner struct {
+	// Local is the number of Jobs which may be run locally at once.
+	// If 0, one per CPU.
+	Local int
+
+	// Timeout is how long to wait for a message from a worker before it is considered dead.
+	// If 0, DefaultRemoteTimeout is used.
+	Timeout time.Duration
+
+	// MaxAttempts is the number of workers a task may be sent to before it fails with a *WorkerLostError.
+	// If 0, 3 attempts are made.
+	MaxAttempts int
+
+	once      sync.Once
+	lck       sync.Mutex
+	closed    bool
+	nextID    uint64
+	queue     []*remoteCall
+	workers   map[*remoteWorker]struct{}
+	listeners map[net.Listener]struct{}
+	localsem  chan struct{}
+	wg        sync.WaitGroup
+	// tasks is the number of tasks started by DoTask which are running
+	tasks int
+	// capacity is the total capacity of the connected workers
+	capacity int
+	// slot is signalled when a task finishes or capacity is added
+	slot *sync.Cond
+}
+
+// remoteWorker is a worker connected to a RemoteRunner.
+type remoteWorker struct {
+	*remoteConn
+	name     string
+	capacity int
+	// calls are the calls assigned to the worker, which it has not yet reported a result for
+	calls map[uint64]*remoteCall
+}
+
+// remoteCall is a task queued or running on a RemoteRunner.
+type remoteCall struct {
+	id       uint64
+	name     string
+	task     *RemoteTask
+	attempts int
+	// worker is the worker running the call, or nil if the call is queued
+	worker *remoteWorker
+	// done is closed when the call finishes, after setting err
+	done     chan struct{}
+	finished bool
+	err      error
+}
+
+func (rr *RemoteRunner) init() {
+	rr.once.Do(func() {
+		if rr.Local == 0 {
+			rr.Local = runtime.NumCPU()
+		}
+		if rr.Timeout == 0 {
+			rr.Timeout = DefaultRemoteTimeout
+		}
+		if rr.MaxAttempts == 0 {
+			rr.MaxAttempts = 3
+		}
+		rr.workers = make(map[*remoteWorker]struct{})
+		rr.listeners = make(map[net.Listener]struct{})
+		rr.localsem = make(chan struct{}, rr.Local)
+		rr.slot = sync.NewCond(&rr.lck)
+	})
+}
+
+// Serve accepts worker connections on the listener.
+// Serve always returns a non-nil error, which is ErrRunnerClosed after Close.
+func (rr *RemoteRunner) Serve(ln net.Listener) error {
+	rr.init()
+	rr.lck.Lock()
+	if rr.closed {
+		rr.lck.Unlock()
+		ln.Close()
+		return ErrRunnerClosed
+	}
+	rr.listeners[ln] = struct{}{}
+	rr.lck.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			rr.lck.Lock()
+			defer rr.lck.Unlock()
+			delete(rr.listeners, ln)
+			if rr.closed {
+				return ErrRunnerClosed
+			}
+			return err
+		}
+		rr.wg.Add(1)
+		go rr.handle(conn)
+	}
+}
+
+// Workers returns the number of connected workers.
+func (rr *RemoteRunner) Workers() int {
+	rr.init()
+	rr.lck.Lock()
+	defer rr.lck.Unlock()
+	return len(rr.workers)
+}
+
+// handle handles a worker connection.
+func (rr *RemoteRunner) handle(conn net.Conn) {
+	defer rr.wg.Done()
+	defer conn.Close()
+
+	//handshake
+	rc := newRemoteConn(conn, rr.Timeout)
+	hello, err := rc.recv()
+	if err != nil || hello.Type != "hello" || hello.Capacity < 1 {
+		return
+	}
+	w := &remoteWorker{
+		remoteConn: rc,
+		name:       hello.Worker,
+		capacity:   hello.Capacity,
+		calls:      make(map[uint64]*remoteCall),
+	}
+	if w.name == "" {
+		w.name = conn.RemoteAddr().String()
+	}
+	if rc.send(remoteMessage{Type: "welcome", Timeout: rr.Timeout}) != nil {
+		return
+	}
+	rr.lck.Lock()
+	if rr.closed {
+		rr.lck.Unlock()
+		return
+	}
+	rr.workers[w] = struct{}{}
+	rr.capacity += w.capacity
+	rr.slot.Broadcast()
+	rr.lck.Unlock()
+	defer rr.lost(w)
+	stop := make(chan struct{})
+	defer close(stop)
+	go rc.heartbeat(stop)
+	rr.dispatch()
+
+	//process messages until the connection fails
+	for {
+		msg, err := rc.recv()
+		if err != nil {
+			return
+		}
+		if msg.Type == "result" {
+			var err error
+			if msg.Failed {
+				err = &RemoteError{Worker: w.name, Message: msg.Error}
+			}
+			rr.finish(w, msg.ID, err)
+		}
+	}
+}
+
+// dispatch sends queued calls to workers with free capacity.
+func (rr *RemoteRunner) dispatch() {
+	rr.lck.Lock()
+	var sent []*remoteCall
+	for len(rr.queue) > 0 {
+		var w *remoteWorker
+		free := 0
+		for v := range rr.workers {
+			if f := v.capacity - len(v.calls); f > free {
+				w, free = v, f
+			}
+		}
+		if w == nil {
+			break
+		}
+		c := rr.queue[0]
+		rr.queue = rr.queue[1:]
+		c.worker = w
+		c.attempts++
+		w.calls[c.id] = c
+		sent = append(sent, c)
+	}
+	rr.lck.Unlock()
+
+	//if a send fails, the connection is closed and the call is reassigned when the worker is lost
+	for _, c := range sent {
+		c.worker.send(remoteMessage{Type: "task", ID: c.id, Task: c.task})
+	}
+}
+
+// complete finishes a call.
+// The lock must be held.
+func (c *remoteCall) complete(err error) {
+	if c.finished {
+		return
+	}
+	c.finished = true
+	c.err = err
+	close(c.done)
+}
+
+// finish handles a result from a worker.
+func (rr *RemoteRunner) finish(w *remoteWorker, id uint64, err error) {
+	rr.lck.Lock()
+	c := w.calls[id]
+	if c != nil {
+		delete(w.calls, id)
+		c.complete(err)
+	}
+	rr.lck.Unlock()
+	rr.dispatch()
+}
+
+// lost removes a worker, and reassigns its calls.
+func (rr *RemoteRunner) lost(w *remoteWorker) {
+	rr.lck.Lock()
+	delete(rr.workers, w)
+	rr.capacity -= w.capacity
+	var requeue []*remoteCall
+	for _, c := range w.calls {
+		switch {
+		case c.finished: //cancelled
+		case c.attempts >= rr.MaxAttempts:
+			c.complete(&WorkerLostError{Job: c.name, Attempts: c.attempts})
+		default:
+			c.worker = nil
+			requeue = append(requeue, c)
+		}
+	}
+	w.calls = nil
+	rr.queue = append(requeue, rr.queue...)
+	rr.lck.Unlock()
+	rr.dispatch()
+}
+
+// cancel cancels a call.
+// If the call is running on a worker, it stays assigned to the worker until the worker reports a result.
+func (rr *RemoteRunner) cancel(c *remoteCall, err error) {
+	rr.lck.Lock()
+	if c.finished {
+		rr.lck.Unlock()
+		return
+	}
+	c.complete(err)
+	w := c.worker
+	if w == nil {
+		for i, v := range rr.queue {
+			if v == c {
+				rr.queue = append(rr.queue[:i], rr.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	rr.lck.Unlock()
+	if w != nil {
+		w.send(remoteMessage{Type: "cancel", ID: c.id})
+	}
+}
+
+// RunJob runs a Job, sending it to a worker if it implements RemoteJob (implements JobRunner).
+func (rr *RemoteRunner) RunJob(ctx context.Context, job Job) error {
+	rr.init()
+	task, err := remoteTask(job)
+	if err != nil {
+		return err
+	}
+	if task == nil {
+		return rr.runLocal(ctx, job)
+	}
+
+	c := &remoteCall{
+		name: job.Name(),
+		task: task,
+		done: make(chan struct{}),
+	}
+	rr.lck.Lock()
+	if rr.closed {
+		rr.lck.Unlock()
+		return ErrRunnerClosed
+	}
+	rr.nextID++
+	c.id = rr.nextID
+	rr.queue = append(rr.queue, c)
+	rr.lck.Unlock()
+	rr.dispatch()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		rr.cancel(c, ctx.Err())
+	}
+	return c.err
+}
+
+// runLocal runs a Job in the local process.
+func (rr *RemoteRunner) runLocal(ctx context.Context, job Job) error {
+	select {
+	case rr.localsem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-rr.localsem }()
+	return job.Run(ctx)
+}
+
+// DoTask runs a task on a new goroutine.
+// Tasks from a Runner call RunJob, which limits the number of Jobs running locally and on each worker.
+// At most Local tasks plus the total capacity of the connected workers run at once, and DoTask blocks until one can be started.
+func (rr *RemoteRunner) DoTask(task Task, tracker WorkTracker) {
+	rr.init()
+	rr.lck.Lock()
+	for !rr.closed && rr.tasks >= rr.Local+rr.capacity {
+		rr.slot.Wait()
+	}
+	rr.tasks++
+	rr.wg.Add(1)
+	rr.lck.Unlock()
+	go func() {
+		defer rr.wg.Done()
+		defer rr.taskDone()
+		task.Run(tracker)
+	}()
+}
+
+// taskDone releases the slot of a task started by DoTask.
+func (rr *RemoteRunner) taskDone() {
+	rr.lck.Lock()
+	defer rr.lck.Unlock()
+	rr.tasks--
+	rr.slot.Signal()
+}
+
+// Close stops accepting workers, disconnects all workers, and fails any queued or running calls with ErrRunnerClosed.
+// Waits for running tasks to finish.
+func (rr *RemoteRunner) Close() error {
+	rr.init()
+	rr.lck.Lock()
+	rr.closed = true
+	rr.slot.Broadcast()
+	for ln := range rr.listeners {
+		ln.Close()
+	}
+	for w := range rr.workers {
+		w.conn.Close()
+		for _, c := range w.calls {
+			c.complete(ErrRunnerClosed)
+		}
+	}
+	for _, c := range rr.queue {
+		c.complete(ErrRunnerClosed)
+	}
+	rr.queue = nil
+	rr.lck.Unlock()
+	rr.wg.Wait()
+	return nil
+}
+
+// Worker runs tasks sent by a RemoteRunner.
+type Worker struct {
+	// Name identifies the worker in errors.
+	// Defaults to the local address of the connection.
+	Name string
+
+	// Capacity is the number of tasks which may be run at once.
+	// If 0, one per CPU.
+	Capacity int
+}
+
+// Serve runs tasks received over a connection to a RemoteRunner, until the connection is closed or ctx is cancelled.
+// Running tasks are cancelled before Serve returns.
+// Returns nil if the connection was closed by the RemoteRunner or ctx was cancelled.
+func (w *Worker) Serve(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	name, capacity := w.Name, w.Capacity
+	if name == "" {
+		name = conn.LocalAddr().String()
+	}
+	if capacity == 0 {
+		capacity = runtime.NumCPU()
+	}
+
+	//handshake
+	rc := newRemoteConn(conn, DefaultRemoteTimeout)
+	if err := rc.send(remoteMessage{Type: "hello", Worker: name, Capacity: capacity}); err != nil {
+		return err
+	}
+	welcome, err := rc.recv()
+	if err != nil {
+		return err
+	}
+	if welcome.Type != "welcome" || welcome.Timeout <= 0 {
+		return fmt.Errorf("unexpected handshake message %q", welcome.Type)
+	}
+	rc.timeout = welcome.Timeout
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	go rc.heartbeat(stop)
+
+	//run tasks until the connection fails
+	var lck sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	tasks := make(map[uint64]context.CancelFunc)
+	for {
+		msg, err := rc.recv()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		switch msg.Type {
+		case "task":
+			if msg.Task == nil {
+				continue
+			}
+			tctx, tcancel := context.WithCancel(ctx)
+			lck.Lock()
+			tasks[msg.ID] = tcancel
+			lck.Unlock()
+			wg.Add(1)
+			go func(id uint64, task *RemoteTask) {
+				defer wg.Done()
+				err := RunTask(tctx, task)
+				lck.Lock()
+				delete(tasks, id)
+				lck.Unlock()
+				tcancel()
+				res := remoteMessage{Type: "result", ID: id}
+				if err != nil {
+					res.Failed = true
+					res.Error = err.Error()
+				}
+				rc.send(res)
+			}(msg.ID, msg.Task)
+		case "cancel":
+			lck.Lock()
+			if tcancel := tasks[msg.ID]; tcancel != nil {
+				tcancel()
+			}
+			lck.Unlock()
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package xgraph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTasks are RemoteTasks run by the "test" task kind, keyed by name.
+var testTasks = struct {
+	sync.Mutex
+	m map[string]func(ctx context.Context) error
+}{m: make(map[string]func(ctx context.Context) error)}
+
+func init() {
+	RegisterTaskKind("test", func(ctx context.Context, data json.RawMessage) error {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		testTasks.Lock()
+		fn := testTasks.m[name]
+		testTasks.Unlock()
+		if fn == nil {
+			return fmt.Errorf("no test task %q", name)
+		}
+		return fn(ctx)
+	})
+	RegisterTaskKind("pid", func(ctx context.Context, data json.RawMessage) error {
+		var path string
+		if err := json.Unmarshal(data, &path); err != nil {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+		return os.WriteFile(path, []byte(fmt.Sprint(os.Getpid())), 0644)
+	})
+}
+
+// remoteJob is a Job with a RemoteTask.
+type remoteJob struct {
+	BasicJob
+	kind string
+	data interface{}
+}
+
+func (rj remoteJob) RemoteTask() (*RemoteTask, error) {
+	dat, err := json.Marshal(rj.data)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteTask{Kind: rj.kind, Data: dat}, nil
+}
+
+// remoteTestJob returns a remote Job which runs fn on a worker in the test process.
+func remoteTestJob(name string, fn func(ctx context.Context) error, deps ...string) Job {
+	testTasks.Lock()
+	testTasks.m[name] = fn
+	testTasks.Unlock()
+	return remoteJob{BasicJob: BasicJob{JobName: name, Deps: deps}, kind: "test", data: name}
+}
+
+// startRemote starts a RemoteRunner listening on a local port.
+func startRemote(t *testing.T, rr *RemoteRunner) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rr.Serve(ln)
+	return ln.Addr().String()
+}
+
+// startWorker connects a Worker to a RemoteRunner.
+// Returns a function which disconnects the Worker.
+func startWorker(t *testing.T, addr string, w *Worker) func() {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := w.Serve(ctx, conn); err != nil {
+			t.Errorf("worker failed: %v", err)
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitWorkers waits until n workers are connected.
+func waitWorkers(rr *RemoteRunner, n int) {
+	for rr.Workers() != n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fakeWorker connects to a RemoteRunner and completes the handshake, but does not run tasks.
+// Returns the connection and a channel receiving the IDs of tasks sent to it.
+func fakeWorker(t *testing.T, addr string) (net.Conn, chan uint64) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := newRemoteConn(conn, time.Minute)
+	if err := rc.send(remoteMessage{Type: "hello", Worker: "fake", Capacity: 1}); err != nil {
+		t.Fatal(err)
+	}
+	tasks := make(chan uint64, 10)
+	go func() {
+		for {
+			msg, err := rc.recv()
+			if err != nil {
+				return
+			}
+			if msg.Type == "task" {
+				tasks <- msg.ID
+			}
+		}
+	}()
+	return conn, tasks
+}
+
+func TestRemoteRunner(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "build",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{Local: 1}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				for i := 0; i < 3; i++ {
+					defer startWorker(t, addr, &Worker{Name: fmt.Sprintf("w%d", i), Capacity: 2})()
+				}
+				var lck sync.Mutex
+				ran := []string{}
+				record := func(name string) func(context.Context) error {
+					return func(context.Context) error {
+						lck.Lock()
+						defer lck.Unlock()
+						ran = append(ran, name)
+						return nil
+					}
+				}
+				g := New().
+					AddJob(remoteTestJob("remote-build-a", record("a"))).
+					AddJob(remoteTestJob("remote-build-b", record("b"))).
+					AddJob(BasicJob{JobName: "local", Deps: []string{"remote-build-a", "remote-build-b"}, RunCallback: func() error {
+						return record("local")(nil)
+					}}).
+					AddJob(remoteTestJob("remote-build-fail", func(context.Context) error { return errors.New("bad") }, "local"))
+				res := (&Runner{Graph: g, WorkRunner: rr}).Run(context.Background(), "remote-build-fail")
+				if len(ran) != 3 || ran[2] != "local" {
+					return fmt.Errorf("unexpected runs: %v", ran)
+				}
+				if failed := res.Failed(); len(failed) != 1 {
+					return fmt.Errorf("unexpected failures: %v", failed)
+				}
+				err, ok := res.Jobs["remote-build-fail"].Err.(*RemoteError)
+				if !ok || err.Message != "bad" {
+					return fmt.Errorf("unexpected error: %v", res.Jobs["remote-build-fail"].Err)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "capacity",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				defer startWorker(t, addr, &Worker{Capacity: 2})()
+				var lck sync.Mutex
+				running, max := 0, 0
+				g := New()
+				targets := []string{}
+				for i := 0; i < 6; i++ {
+					name := fmt.Sprintf("remote-capacity-%d", i)
+					g.AddJob(remoteTestJob(name, func(context.Context) error {
+						lck.Lock()
+						running++
+						if running > max {
+							max = running
+						}
+						lck.Unlock()
+						time.Sleep(20 * time.Millisecond)
+						lck.Lock()
+						running--
+						lck.Unlock()
+						return nil
+					}))
+					targets = append(targets, name)
+				}
+				res := (&Runner{Graph: g, WorkRunner: rr}).Run(context.Background(), targets...)
+				if failed := res.Failed(); len(failed) != 0 {
+					return fmt.Errorf("unexpected failures: %v", failed)
+				}
+				if max != 2 {
+					return fmt.Errorf("expected at most 2 tasks at once but got %d", max)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "reassign-disconnect",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				conn, tasks := fakeWorker(t, addr)
+				waitWorkers(rr, 1)
+				errch := make(chan error)
+				go func() {
+					errch <- rr.RunJob(context.Background(), remoteTestJob("remote-reassign", func(context.Context) error { return nil }))
+				}()
+				<-tasks
+				defer startWorker(t, addr, &Worker{Capacity: 1})()
+				conn.Close()
+				return <-errch
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "reassign-heartbeat",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{Timeout: 300 * time.Millisecond}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				conn, tasks := fakeWorker(t, addr)
+				defer conn.Close()
+				waitWorkers(rr, 1)
+				errch := make(chan error)
+				go func() {
+					errch <- rr.RunJob(context.Background(), remoteTestJob("remote-heartbeat", func(context.Context) error { return nil }))
+				}()
+				<-tasks
+				defer startWorker(t, addr, &Worker{Capacity: 1})()
+				return <-errch
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "lost",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{MaxAttempts: 1}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				conn, tasks := fakeWorker(t, addr)
+				waitWorkers(rr, 1)
+				errch := make(chan error)
+				go func() {
+					errch <- rr.RunJob(context.Background(), remoteTestJob("remote-lost", func(context.Context) error { return nil }))
+				}()
+				<-tasks
+				conn.Close()
+				err := <-errch
+				if lerr, ok := err.(*WorkerLostError); !ok || lerr.Job != "remote-lost" || lerr.Attempts != 1 {
+					return fmt.Errorf("expected WorkerLostError but got %v", err)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "cancel",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				defer startWorker(t, addr, &Worker{Capacity: 1})()
+				started := make(chan struct{})
+				stopped := make(chan struct{})
+				ctx, cancel := context.WithCancel(context.Background())
+				errch := make(chan error)
+				go func() {
+					errch <- rr.RunJob(ctx, remoteTestJob("remote-cancel", func(ctx context.Context) error {
+						close(started)
+						<-ctx.Done()
+						close(stopped)
+						return ctx.Err()
+					}))
+				}()
+				<-started
+				cancel()
+				if err := <-errch; err != context.Canceled {
+					return fmt.Errorf("expected context.Canceled but got %v", err)
+				}
+				<-stopped
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "task-limit",
+			Func: func() (bool, int) {
+				defer timeout()()
+				rr := &RemoteRunner{Local: 1}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				defer startWorker(t, addr, &Worker{Capacity: 2})()
+				waitWorkers(rr, 1)
+				var lck sync.Mutex
+				running, max, count := 0, 0, 0
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					rr.DoTask(func() error {
+						lck.Lock()
+						running++
+						count++
+						if running > max {
+							max = running
+						}
+						lck.Unlock()
+						time.Sleep(5 * time.Millisecond)
+						lck.Lock()
+						running--
+						lck.Unlock()
+						return nil
+					}, CallbackTracker(func(error) { wg.Done() }))
+				}
+				wg.Wait()
+				return max <= 3, count
+			},
+			Expect: []interface{}{true, 8},
+		},
+		{
+			Name: "unknown-kind",
+			Func: func() error {
+				defer timeout()()
+				rr := &RemoteRunner{}
+				defer rr.Close()
+				addr := startRemote(t, rr)
+				defer startWorker(t, addr, &Worker{Name: "w", Capacity: 1})()
+				err := rr.RunJob(context.Background(), remoteJob{BasicJob: BasicJob{JobName: "unknown"}, kind: "nope"})
+				if rerr, ok := err.(*RemoteError); !ok || rerr.Error() != `worker w: unknown task kind: "nope"` {
+					return fmt.Errorf("unexpected error: %v", err)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+// TestHelperWorker is run in a subprocess by TestRemoteProcesses.
+func TestHelperWorker(t *testing.T) {
+	addr := os.Getenv("XGRAPH_TEST_WORKER")
+	if addr == "" {
+		t.Skip("not a worker process")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Worker{Capacity: 1}).Serve(context.Background(), conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoteProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping worker processes in short mode")
+	}
+	defer timeout()()
+	rr := &RemoteRunner{}
+	addr := startRemote(t, rr)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHelperWorker$")
+		cmd.Env = append(os.Environ(), "XGRAPH_TEST_WORKER="+addr)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cmd.Wait()
+		}()
+	}
+	defer wg.Wait()
+	defer rr.Close()
+	waitWorkers(rr, 3)
+
+	dir := t.TempDir()
+	g := New()
+	targets := []string{}
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("pid-%d", i)
+		g.AddJob(remoteJob{BasicJob: BasicJob{JobName: name}, kind: "pid", data: dir + "/" + name})
+		targets = append(targets, name)
+	}
+	res := (&Runner{Graph: g, WorkRunner: rr}).Run(context.Background(), targets...)
+	if failed := res.Failed(); len(failed) != 0 {
+		t.Fatalf("unexpected failures: %v", failed)
+	}
+	pids := map[string]bool{}
+	for _, v := range targets {
+		dat, err := os.ReadFile(dir + "/" + v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids[string(dat)] = true
+	}
+	if len(pids) != 3 || pids[fmt.Sprint(os.Getpid())] {
+		list := []string{}
+		for p := range pids {
+			list = append(list, p)
+		}
+		sort.Strings(list)
+		t.Errorf("expected jobs to run on 3 worker processes but got %s", strings.Join(list, ","))
+	}
+}
+
+func TestExecJob(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "run",
+			Func: func() error {
+				return ExecJob{JobName: "true", Command: "sh", Args: []string{"-c", `test "$X" = y`}, Env: []string{"X=y"}}.Run(context.Background())
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "fail",
+			Func: func() error {
+				err := ExecJob{JobName: "false", Command: "sh", Args: []string{"-c", "echo oops; exit 1"}}.Run(context.Background())
+				eerr, ok := err.(*ExecError)
+				if !ok || string(eerr.Output) != "oops\n" {
+					return fmt.Errorf("unexpected error: %v", err)
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "remote",
+			Func: func() error {
+				dir := os.TempDir()
+				task, err := ExecJob{JobName: "pwd", Command: "sh", Args: []string{"-c", `test "$(pwd)" = "$1"`, "sh", dir}, Dir: dir}.RemoteTask()
+				if err != nil {
+					return err
+				}
+				return RunTask(context.Background(), task)
+			},
+			Expect: []interface{}{nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,148 @@
+package xgraph
+
+import "strings"
+
+// request adds a job to the forest if it is not already there, and queues a lookup of the job and its dependencies.
+// Lookups run in parallel on the WorkRunner, and each name is looked up at most once per build.
+// Returns the tree of the job, which is not resolved until the lookup completes.
+func (ex *executor) request(name string) *jTree {
+	name = strings.TrimPrefix(name, "/")
+	if t := ex.tb.forest[name]; t != nil {
+		return t
+	}
+	t := ex.tb.node(name)
+	t.job = ex.tb.extra[name]
+	ex.lookups++
+	if ceh, ok := ex.evh.(CheckEventHandler); ok {
+		ceh.OnResolveStart(name)
+	}
+	ex.bufch <- dispatchReq{jt: t, op: opLookup}
+	return t
+}
+
+// lookup looks up the job of a tree and its dependencies, and sends the result to the controller
+func (dt *dispatchTracker) lookup() {
+	dt.notch <- notification{
+		jt:     dt.jt,
+		state:  stateResolved,
+		lookup: dt.ex.tb.lookup(dt.jt.name, dt.jt.job),
+	}
+}
+
+// resolve adds a looked up job to the forest, requests its dependencies, and starts it.
+// Jobs with order-only dependencies and triggered jobs are started once the whole forest has been resolved, since edges may be added to them.
+func (ex *executor) resolve(jt *jTree, r resolved) {
+	ex.lookups--
+	if ceh, ok := ex.evh.(CheckEventHandler); ok {
+		ceh.OnResolveFinish(jt.name, r.err)
+	}
+	jt.job = r.job
+	if r.err != nil {
+		jt.err = r.err
+		jt.lookupErr = r.err
+	}
+	if ex.watch != nil {
+		ex.watch.onResolve(jt.name, r)
+	}
+	for _, v := range r.deps {
+		//order-only deps are linked once the forest is resolved
+		if v.Type == OrderDependency {
+			jt.orderDeps = append(jt.orderDeps, v.Name)
+			continue
+		}
+		d := ex.request(v.Name)
+		jt.deps = append(jt.deps, jEdge{id: d.id, typ: v.Type})
+	}
+	if len(jt.orderDeps) > 0 || ex.triggered[jt.name] {
+		ex.deferred = append(ex.deferred, jt)
+	} else {
+		ex.track(jt)
+	}
+	if ex.lookups == 0 {
+		ex.resolved()
+	}
+}
+
+// resolved is called when there are no lookups in progress.
+// Triggered jobs with a watched job in the forest are requested, and once they have been resolved, the remaining edges are added to the forest and the deferred jobs are started.
+// It is called again whenever the jobs added by dynamic dependencies have been resolved, and then only the new edges are linked and checked for cycles.
+func (ex *executor) resolved() {
+	//add triggered jobs until no more are triggered
+	for i, tr := range ex.triggers {
+		if ex.trigAdded[i] {
+			continue
+		}
+		for _, w := range tr.watch {
+			if ex.tb.forest[strings.TrimPrefix(w, "/")] != nil {
+				ex.trigAdded[i] = true
+				ex.request(tr.name)
+				break
+			}
+		}
+	}
+	if ex.lookups > 0 { //wait for the triggered jobs to be resolved
+		return
+	}
+	mark := ex.linked
+	added := ex.tb.nodes[mark:]
+	ex.linked = len(ex.tb.nodes)
+	roots := ex.extended
+	ex.extended = nil
+
+	//link triggered jobs to the watched jobs which are new to the forest
+	for i, tr := range ex.triggers {
+		if !ex.trigAdded[i] {
+			continue
+		}
+		t := ex.tb.forest[strings.TrimPrefix(tr.name, "/")]
+		for _, w := range tr.watch {
+			d := ex.tb.forest[strings.TrimPrefix(w, "/")]
+			if d == nil || d == t || (int(t.id) < mark && int(d.id) < mark) {
+				continue
+			}
+			if !t.tracked {
+				t.deps = append(t.deps, jEdge{id: d.id, typ: tr.typ})
+				continue
+			}
+			//a started job can only wait for the new job if it has not yet been dispatched
+			if t.completing || t.extending || t.waiting == 0 {
+				continue
+			}
+			t.deps = append(t.deps, jEdge{id: d.id, typ: tr.typ})
+			d.refs++
+			ex.await(t, d, finallyDependency)
+			roots = append(roots, d.id)
+		}
+	}
+	deferred := ex.deferred
+	ex.deferred = nil
+	ex.tb.linkOrderDeps(deferred)
+
+	//fail the jobs in dependency cycles, which can never become ready
+	//a missing dependency takes precedence over a cycle
+	for _, jt := range added {
+		if jt.err == nil && !jt.completing {
+			jt.err = ex.depLookupErr(jt)
+		}
+		if mark > 0 {
+			roots = append(roots, jt.id)
+		}
+	}
+	if mark == 0 {
+		roots = nil //search the whole forest
+	}
+	if mark == 0 || len(roots) > 0 {
+		ex.finishing = true
+		for _, jt := range ex.tb.findCycles(roots...) {
+			//a cycle through new edges fails the new jobs and the jobs waiting for dynamic dependencies, which breaks it
+			if jt.tracked && (int(jt.id) >= mark || jt.extending) {
+				ex.complete(jt, jt.err)
+			}
+		}
+		ex.drain()
+	}
+
+	for _, jt := range deferred {
+		ex.track(jt)
+	}
+}
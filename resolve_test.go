@@ -0,0 +1,121 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countDepsJob is a Job which counts calls to DependencyList.
+type countDepsJob struct {
+	BasicJob
+	lck   *sync.Mutex
+	count map[string]int
+}
+
+func (cdj countDepsJob) DependencyList() ([]Dependency, error) {
+	cdj.lck.Lock()
+	cdj.count[cdj.JobName]++
+	cdj.lck.Unlock()
+	return cdj.BasicJob.DependencyList()
+}
+
+func TestResolve(t *testing.T) {
+	nop := func() error { return nil }
+	tests := []testCase{
+		{
+			Name: "parallel",
+			Func: func() error {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				//each generator call waits for the other, so they must run at the same time
+				wait := barrier(2)
+				g := New().
+					AddJob(BasicJob{JobName: "top", RunCallback: nop, Deps: []string{"gen/a", "gen/b"}}).
+					AddGenerator(func(name string) (Job, error) {
+						wait()
+						return BasicJob{JobName: name, RunCallback: nop}, nil
+					})
+				return (&Runner{Graph: g, WorkRunner: wp}).Run(context.Background(), "top").Jobs["top"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "once",
+			Func: func() (map[string]int, error) {
+				defer timeout()()
+				var lck sync.Mutex
+				count := map[string]int{}
+				job := func(name string, deps ...string) Job {
+					return countDepsJob{BasicJob: BasicJob{JobName: name, RunCallback: nop, Deps: deps}, lck: &lck, count: count}
+				}
+				g := New().
+					AddJob(job("top", "a", "b", "c")).
+					AddJob(job("a", "base")).
+					AddJob(job("b", "base", "a")).
+					AddJob(job("c", "base", "b")).
+					AddJob(job("base"))
+				err := (&Runner{Graph: g}).Run(context.Background(), "top", "a", "base").Jobs["top"].Err
+				return count, err
+			},
+			Expect: []interface{}{map[string]int{"top": 1, "a": 1, "b": 1, "c": 1, "base": 1}, nil},
+		},
+		{
+			Name: "deterministic-errors",
+			Func: func() error {
+				defer timeout()()
+				g := New().
+					AddJob(BasicJob{JobName: "top", RunCallback: nop, Deps: []string{"ok", "gen/slow", "gen/fast"}}).
+					AddJob(BasicJob{JobName: "ok", RunCallback: nop}).
+					AddGenerator(func(name string) (Job, error) {
+						if name == "gen/slow" {
+							time.Sleep(10 * time.Millisecond)
+						}
+						return nil, fmt.Errorf("cannot generate %s", name)
+					})
+				//the error of the first dependency is reported, even though it is resolved last
+				for i := 0; i < 5; i++ {
+					err := (&Runner{Graph: g}).Run(context.Background(), "top").Jobs["top"].Err
+					if err == nil || err.Error() != "cannot generate gen/slow" {
+						return fmt.Errorf("unexpected error: %v", err)
+					}
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "streaming",
+			Func: func() error {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				//the slow branch is not resolved until the fast branch has run
+				ran := make(chan struct{})
+				g := New().
+					AddJob(BasicJob{JobName: "top", RunCallback: nop, Deps: []string{"fast", "gen/slow"}}).
+					AddJob(BasicJob{JobName: "fast", RunCallback: func() error {
+						close(ran)
+						return nil
+					}}).
+					AddGenerator(func(name string) (Job, error) {
+						select {
+						case <-ran:
+						case <-time.After(5 * time.Second):
+							return nil, errors.New("fast job did not run during resolution")
+						}
+						return BasicJob{JobName: name, RunCallback: nop}, nil
+					})
+				return (&Runner{Graph: g, WorkRunner: wp}).Run(context.Background(), "top").Jobs["top"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
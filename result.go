@@ -0,0 +1,157 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// BuildResult is the result of a build run by a Runner.
+type BuildResult struct {
+	// Jobs is the set of results of the Jobs in the build, indexed by name.
+	Jobs map[string]*JobResult
+}
+
+// Failed returns a sorted list of the names of Jobs which failed.
+func (br *BuildResult) Failed() []string {
+	failed := []string{}
+	for name, r := range br.Jobs {
+		if r.Err != nil {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	return failed
+}
+
+// JobResult is the result of a Job in a build.
+type JobResult struct {
+	// Name is the name of the Job.
+	Name string
+
+	// Ran is whether the Job was run.
+	// It is false if the Job did not need to be run, or was not run because of an error.
+	Ran bool
+
+	// Err is the error the Job failed with, or nil if it succeeded.
+	Err error
+
+	// Failures is a sorted list of the watched Jobs which failed, for a Job added with AddFinally or AddOnFailure.
+	Failures []string
+
+	// Value is the value produced by the Job with SetResult, or nil if no value was produced.
+	Value interface{}
+
+	// Shared is whether the run of the Job was shared with another build through a Coordinator.
+	Shared bool
+
+	// Owner is the owner of the Job, or "" if it does not have one (see OwnedJob).
+	Owner string
+}
+
+// ResultOf returns the value produced by a Job in a build.
+// Returns JobNotFoundError if the Job was not part of the build, ErrNoResult if the Job did not produce a value,
+// and a *ResultTypeError if the value is not a T.
+func ResultOf[T any](br *BuildResult, name string) (T, error) {
+	r := br.Jobs[name]
+	if r == nil {
+		var zero T
+		return zero, JobNotFoundError(name)
+	}
+	return convertResult[T](name, r.Value)
+}
+
+// SetResult sets the value produced by the running Job.
+// The ctx must be the context passed to Run.
+// Dependents of the Job may read the value with Result.
+// If ctx does not belong to a running Job, SetResult does nothing.
+func SetResult(ctx context.Context, v interface{}) {
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return
+	}
+	scope.ex.vlck.Lock()
+	defer scope.ex.vlck.Unlock()
+	scope.jt.value = v
+}
+
+// Result returns the value produced by a dependency of the running Job.
+// The ctx must be the context passed to Run.
+// The name is relative to the namespace of the Job, as with Dependencies.
+// Returns a NotDependencyError if dep is not a dependency of the running Job, ErrNoResult if the dependency did not produce a value,
+// and a *ResultTypeError if the value is not a T.
+func Result[T any](ctx context.Context, dep string) (T, error) {
+	var zero T
+	scope, ok := ctx.Value(scopeKey{}).(*jobScope)
+	if !ok {
+		return zero, NotDependencyError(dep)
+	}
+	dep = strings.TrimPrefix(scopeName(scope.jt.job, dep), "/")
+	for _, v := range scope.jt.deps {
+		if d := scope.nodes[v.id]; d.name == dep {
+			scope.ex.vlck.Lock()
+			val := d.value
+			scope.ex.vlck.Unlock()
+			return convertResult[T](dep, val)
+		}
+	}
+	return zero, NotDependencyError(dep)
+}
+
+// convertResult converts a value produced by a Job to a T.
+func convertResult[T any](name string, v interface{}) (T, error) {
+	if v == nil {
+		var zero T
+		return zero, ErrNoResult
+	}
+	t, ok := v.(T)
+	if !ok {
+		return t, &ResultTypeError{
+			Job:   name,
+			Value: v,
+			Type:  reflect.TypeOf((*T)(nil)).Elem(),
+		}
+	}
+	return t, nil
+}
+
+// jobScope is stored in the context of a running Job.
+type jobScope struct {
+	ex *executor
+	jt *jTree
+	// nodes are the nodes of the forest when the job was dispatched, which include its dependencies
+	nodes []*jTree
+}
+
+// scopeKey is the context key for the *jobScope.
+type scopeKey struct{}
+
+// ErrNoResult indicates that a Job did not produce a value.
+var ErrNoResult = errors.New("job did not produce a result")
+
+// NotDependencyError is an error type indicating that a result was requested from a Job which is not a dependency.
+// The underlying string is the name of the job.
+type NotDependencyError string
+
+func (err NotDependencyError) Error() string {
+	return fmt.Sprintf("job %q is not a dependency", string(err))
+}
+
+// ResultTypeError is an error indicating that the value produced by a Job does not have the requested type.
+type ResultTypeError struct {
+	// Job is the name of the Job which produced the value.
+	Job string
+
+	// Value is the value produced by the Job.
+	Value interface{}
+
+	// Type is the requested type.
+	Type reflect.Type
+}
+
+func (err *ResultTypeError) Error() string {
+	return fmt.Sprintf("result of job %q has type %T, not %v", err.Job, err.Value, err.Type)
+}
@@ -0,0 +1,129 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestBuildResult(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "failed",
+			Func: (&BuildResult{Jobs: map[string]*JobResult{
+				"c": {Name: "c", Err: errors.New("bad")},
+				"b": {Name: "b"},
+				"a": {Name: "a", Err: errors.New("bad")},
+			}}).Failed,
+			Expect: []interface{}{[]string{"a", "c"}},
+		},
+		{
+			Name:   "failed-none",
+			Func:   (&BuildResult{Jobs: map[string]*JobResult{}}).Failed,
+			Expect: []interface{}{[]string{}},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+// funcJob is a Job which runs a function with the context.
+type funcJob struct {
+	BasicJob
+	run func(ctx context.Context) error
+}
+
+func (fj funcJob) Run(ctx context.Context) error {
+	return fj.run(ctx)
+}
+
+func TestResults(t *testing.T) {
+	g := New().
+		AddJob(funcJob{
+			BasicJob: BasicJob{JobName: "version"},
+			run: func(ctx context.Context) error {
+				SetResult(ctx, "v1.2.3")
+				return nil
+			},
+		}).
+		AddJob(funcJob{
+			BasicJob: BasicJob{JobName: "none"},
+			run: func(ctx context.Context) error {
+				return nil
+			},
+		}).
+		AddJob(funcJob{
+			BasicJob: BasicJob{JobName: "release", Deps: []string{"version", "none"}},
+			run: func(ctx context.Context) error {
+				v, err := Result[string](ctx, "version")
+				if err != nil {
+					return err
+				}
+				if _, err := Result[string](ctx, "none"); err != ErrNoResult {
+					return errors.New("expected ErrNoResult")
+				}
+				if _, err := Result[int](ctx, "version"); err == nil {
+					return errors.New("expected type error")
+				}
+				if _, err := Result[string](ctx, "release"); err != NotDependencyError("release") {
+					return errors.New("expected NotDependencyError")
+				}
+				SetResult(ctx, []string{"release-" + v + ".tar.gz"})
+				return nil
+			},
+		})
+	tests := []testCase{
+		{
+			Name: "run",
+			Func: func() ([]string, error) {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				res := (&Runner{
+					Graph:        g,
+					WorkRunner:   wp,
+					EventHandler: NoOpEventHandler,
+				}).Run(context.Background(), "release")
+				if err := res.Jobs["release"].Err; err != nil {
+					return nil, err
+				}
+				return ResultOf[[]string](res, "release")
+			},
+			Expect: []interface{}{[]string{"release-v1.2.3.tar.gz"}, nil},
+		},
+		{
+			Name: "result-of-missing",
+			Func: func() (string, error) {
+				return ResultOf[string](&BuildResult{Jobs: map[string]*JobResult{}}, "test")
+			},
+			Expect: []interface{}{"", JobNotFoundError("test")},
+		},
+		{
+			Name: "result-of-type",
+			Func: func() (int, error) {
+				return ResultOf[int](&BuildResult{Jobs: map[string]*JobResult{
+					"test": {Name: "test", Value: "str"},
+				}}, "test")
+			},
+			Expect: []interface{}{0, &ResultTypeError{Job: "test", Value: "str", Type: reflect.TypeOf(0)}},
+		},
+		{
+			Name:   "type-error",
+			Func:   (&ResultTypeError{Job: "test", Value: "str", Type: reflect.TypeOf(0)}).Error,
+			Expect: []interface{}{"result of job \"test\" has type string, not int"},
+		},
+		{
+			Name: "no-scope",
+			Func: func() (string, error) {
+				SetResult(context.Background(), "value")
+				return Result[string](context.Background(), "test")
+			},
+			Expect: []interface{}{"", NotDependencyError("test")},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -2,45 +2,83 @@ package xgraph
 
 import (
 	"context"
+	"time"
 )
 
 //Runner is a tool to run graphs
 type Runner struct {
-	Graph        *Graph
-	WorkRunner   WorkRunner
+	Graph *Graph
+
+	//WorkRunner is used to run the jobs
+	//If nil, a work pool is created for each run
+	WorkRunner WorkRunner
+
+	//EventHandler is notified of build events
+	//If nil, NoOpEventHandler is used
 	EventHandler EventHandler
+
+	//Coordinator is used to share runs of jobs with concurrent builds by other Runners
+	//If nil, jobs are not shared
+	Coordinator *Coordinator
+
+	//Debounce is how long Watch waits for more changes after a file changes, before starting a build
+	//If 0, DefaultDebounce is used
+	Debounce time.Duration
+
+	//PollInterval is how often Watch checks files for changes, when inotify is not available
+	//If 0, DefaultPollInterval is used
+	PollInterval time.Duration
 }
 
 //Run executes the targets on the graph
-func (r *Runner) Run(ctx context.Context, targets ...string) {
+//If no targets are given, the default targets of the graph are run (see Graph.SetDefaults).
+//Returns the results of all of the jobs in the build.
+func (r *Runner) Run(ctx context.Context, targets ...string) *BuildResult {
 	//get WorkRunner or create it
 	wr := r.WorkRunner
 	if wr == nil {
 		wr = NewWorkPool(0)
 		defer wr.Close()
 	}
+	return r.run(ctx, wr, targets, nil)
+}
+
+//run executes the targets on the graph using a WorkRunner
+//wb is used for builds started by Watch, and is nil otherwise
+func (r *Runner) run(ctx context.Context, wr WorkRunner, targets []string, wb *watchBuild) *BuildResult {
+	evh := r.EventHandler
+	if evh == nil {
+		evh = NoOpEventHandler
+	}
+	if len(targets) == 0 {
+		targets = r.Graph.Defaults()
+	}
+	if r.Coordinator != nil {
+		r.Coordinator.begin()
+		defer r.Coordinator.end()
+	}
 
-	//build trees and find cycles
+	//build trees while running the build
 	tb := &treeBuilder{
 		forest: make(map[string]*jTree),
 		g:      r.Graph,
+		inputs: wb != nil,
 	}
-	for _, t := range targets {
-		tb.genTree(t)
-	}
-	tb.findCycles()
 
 	//run build
 	ex := &executor{
-		forest:     tb.forest,
-		runner:     wr,
-		notifych:   make(chan notification),
-		evh:        r.EventHandler,
-		proms:      make(map[string]*Promise),
-		cbset:      make(map[string]func(error)),
-		dispatchch: make(chan Job),
-		bufch:      make(chan Job),
-		ctx:        ctx,
+		tb:          tb,
+		runner:      wr,
+		notifych:    make(chan notification),
+		evh:         evh,
+		dispatchch:  make(chan dispatchReq),
+		bufch:       make(chan dispatchReq),
+		ctx:         ctx,
+		results:     make(map[string]*JobResult),
+		coordinator: r.Coordinator,
+		watch:       wb,
 	}
-	ex.execute()
+	ex.execute(targets)
+
+	return &BuildResult{Jobs: ex.results}
 }
@@ -3,6 +3,7 @@ package xgraph
 import (
 	"context"
 	"errors"
+	"sort"
 	"sync"
 	"testing"
 )
@@ -317,3 +318,339 @@ func (cj cancelJob) Run(ctx context.Context) error {
 	<-ctx.Done()
 	return ctx.Err()
 }
+
+func TestRunnerMount(t *testing.T) {
+	defer timeout()()
+	var lck sync.Mutex
+	ran := []string{}
+	job := func(name string, deps ...string) BasicJob {
+		return BasicJob{
+			JobName: name,
+			Deps:    deps,
+			RunCallback: func() error {
+				lck.Lock()
+				defer lck.Unlock()
+				ran = append(ran, name)
+				return nil
+			},
+		}
+	}
+	g := New().
+		AddJob(job("fmt")).
+		Mount("team-a", New().AddJob(job("build", "lint", "/fmt")).AddJob(job("lint"))).
+		Mount("team-b", New().AddJob(job("build", "/team-a/build")))
+	wp := NewWorkPool(1)
+	defer wp.Close()
+	eh := &errCheckEventHandler{m: make(map[string]error)}
+	(&Runner{
+		Graph:        g,
+		WorkRunner:   wp,
+		EventHandler: eh,
+	}).Run(context.Background(), "team-b/build")
+	if len(eh.m) != 0 {
+		t.Fatalf("unexpected errors: %v", eh.m)
+	}
+	if len(ran) != 4 {
+		t.Fatalf("unexpected run order: %v", ran)
+	}
+}
+
+func TestRunnerDependencyTypes(t *testing.T) {
+	var lck sync.Mutex
+	var ran []string
+	job := func(name string, err error) BasicJob {
+		return BasicJob{
+			JobName: name,
+			RunCallback: func() error {
+				lck.Lock()
+				defer lck.Unlock()
+				ran = append(ran, name)
+				return err
+			},
+		}
+	}
+	withDeps := func(j BasicJob, hard, order, soft []string) BasicJob {
+		j.Deps, j.OrderDeps, j.SoftDeps = hard, order, soft
+		return j
+	}
+	g := New().
+		AddJob(job("setup", nil)).
+		AddJob(job("broken", errors.New("bad"))).
+		AddJob(withDeps(job("ordered", nil), nil, []string{"setup"}, nil)).
+		AddJob(withDeps(job("ordered-broken", nil), nil, []string{"broken"}, nil)).
+		AddJob(withDeps(job("soft", nil), nil, nil, []string{"broken"})).
+		AddJob(withDeps(job("soft-missing", nil), nil, nil, []string{"missing"}))
+	run := func(targets ...string) ([]string, map[string]error) {
+		defer timeout()()
+		ran = nil
+		wp := NewWorkPool(1)
+		defer wp.Close()
+		eh := &errCheckEventHandler{m: make(map[string]error)}
+		(&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: eh,
+		}).Run(context.Background(), targets...)
+		return ran, eh.m
+	}
+	tests := []testCase{
+		{
+			Name: "order-only-not-pulled",
+			Func: func() ([]string, map[string]error) {
+				return run("ordered")
+			},
+			Expect: []interface{}{[]string{"ordered"}, map[string]error{}},
+		},
+		{
+			Name: "order-only",
+			Func: func() ([]string, map[string]error) {
+				return run("ordered", "setup")
+			},
+			Expect: []interface{}{[]string{"setup", "ordered"}, map[string]error{}},
+		},
+		{
+			Name: "order-only-fail",
+			Func: func() ([]string, map[string]error) {
+				return run("ordered-broken", "broken")
+			},
+			Expect: []interface{}{[]string{"broken"}, map[string]error{
+				"broken":         errors.New("bad"),
+				"ordered-broken": BuildDependencyError{"broken"},
+			}},
+		},
+		{
+			Name: "soft",
+			Func: func() ([]string, map[string]error) {
+				return run("soft")
+			},
+			Expect: []interface{}{[]string{"broken", "soft"}, map[string]error{
+				"broken": errors.New("bad"),
+			}},
+		},
+		{
+			Name: "soft-missing",
+			Func: func() ([]string, map[string]error) {
+				return run("soft-missing")
+			},
+			Expect: []interface{}{[]string{"soft-missing"}, map[string]error{
+				"missing": JobNotFoundError("missing"),
+			}},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestRunnerTriggers(t *testing.T) {
+	var lck sync.Mutex
+	var ran []string
+	job := func(name string, err error, deps ...string) BasicJob {
+		return BasicJob{
+			JobName: name,
+			Deps:    deps,
+			RunCallback: func() error {
+				lck.Lock()
+				defer lck.Unlock()
+				ran = append(ran, name)
+				return err
+			},
+		}
+	}
+	g := New().
+		AddJob(job("db", nil)).
+		AddJob(job("test", nil, "db")).
+		AddJob(job("test-broken", errors.New("bad"), "db")).
+		AddJob(job("other", nil)).
+		AddFinally(job("stop-db", nil), "test", "test-broken").
+		AddOnFailure(job("notify", nil), "test", "test-broken")
+	type summary struct {
+		Ran      bool
+		Err      error
+		Failures []string
+	}
+	run := func(targets ...string) ([]string, map[string]summary) {
+		defer timeout()()
+		ran = nil
+		wp := NewWorkPool(1)
+		defer wp.Close()
+		res := (&Runner{
+			Graph:        g,
+			WorkRunner:   wp,
+			EventHandler: NoOpEventHandler,
+		}).Run(context.Background(), targets...)
+		sums := make(map[string]summary)
+		for n, r := range res.Jobs {
+			sums[n] = summary{r.Ran, r.Err, r.Failures}
+		}
+		sort.Strings(ran)
+		return ran, sums
+	}
+	tests := []testCase{
+		{
+			Name: "success",
+			Func: func() ([]string, map[string]summary) {
+				return run("test")
+			},
+			Expect: []interface{}{[]string{"db", "stop-db", "test"}, map[string]summary{
+				"db":      {Ran: true},
+				"test":    {Ran: true},
+				"stop-db": {Ran: true},
+				"notify":  {},
+			}},
+		},
+		{
+			Name: "failure",
+			Func: func() ([]string, map[string]summary) {
+				return run("test-broken")
+			},
+			Expect: []interface{}{[]string{"db", "notify", "stop-db", "test-broken"}, map[string]summary{
+				"db":          {Ran: true},
+				"test-broken": {Ran: true, Err: errors.New("bad")},
+				"stop-db":     {Ran: true, Failures: []string{"test-broken"}},
+				"notify":      {Ran: true, Failures: []string{"test-broken"}},
+			}},
+		},
+		{
+			Name: "not-triggered",
+			Func: func() ([]string, map[string]summary) {
+				return run("other")
+			},
+			Expect: []interface{}{[]string{"other"}, map[string]summary{
+				"other": {Ran: true},
+			}},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+// barrier returns a function which blocks until it has been called n times.
+func barrier(n int) func() {
+	var lck sync.Mutex
+	done := make(chan struct{})
+	return func() {
+		lck.Lock()
+		n--
+		if n == 0 {
+			close(done)
+		}
+		lck.Unlock()
+		<-done
+	}
+}
+
+// slowDepsJob is a Job which calls wait before listing its dependencies.
+type slowDepsJob struct {
+	BasicJob
+	wait func()
+}
+
+func (sdj slowDepsJob) DependencyList() ([]Dependency, error) {
+	sdj.wait()
+	return sdj.BasicJob.DependencyList()
+}
+
+// checkRecorder is a CheckEventHandler which records check and resolve events.
+type checkRecorder struct {
+	nophandler
+	lck      sync.Mutex
+	resolved []string
+	checks   map[string]bool
+	errs     map[string]error
+}
+
+func (cr *checkRecorder) OnResolveStart(job string) {}
+
+func (cr *checkRecorder) OnResolveFinish(job string, err error) {
+	cr.lck.Lock()
+	defer cr.lck.Unlock()
+	cr.resolved = append(cr.resolved, job)
+}
+
+func (cr *checkRecorder) OnCheckStart(job string) {}
+
+func (cr *checkRecorder) OnCheckFinish(job string, run bool, err error) {
+	cr.lck.Lock()
+	defer cr.lck.Unlock()
+	cr.checks[job] = run
+	if err != nil {
+		cr.errs[job] = err
+	}
+}
+
+func (cr *checkRecorder) OnError(job string, err error) {
+	cr.lck.Lock()
+	defer cr.lck.Unlock()
+	cr.errs["error "+job] = err
+}
+
+func TestRunnerChecks(t *testing.T) {
+	errCheck := errors.New("check failed")
+	nop := func() error { return nil }
+	tests := []testCase{
+		{
+			Name: "parallel-checks",
+			Func: func() error {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				//each check waits for the other, so they must run at the same time
+				wait := barrier(2)
+				check := func() (bool, error) {
+					wait()
+					return true, nil
+				}
+				g := New().
+					AddJob(BasicJob{JobName: "a", RunCallback: nop, ShouldRunCallback: check}).
+					AddJob(BasicJob{JobName: "b", RunCallback: nop, ShouldRunCallback: check})
+				res := (&Runner{Graph: g, WorkRunner: wp}).Run(context.Background(), "a", "b")
+				if failed := res.Failed(); len(failed) > 0 {
+					return errors.New("jobs failed")
+				}
+				return nil
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "parallel-deps",
+			Func: func() error {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				wait := barrier(2)
+				g := New().
+					AddJob(slowDepsJob{BasicJob: BasicJob{JobName: "a", RunCallback: nop}, wait: wait}).
+					AddJob(slowDepsJob{BasicJob: BasicJob{JobName: "b", RunCallback: nop}, wait: wait}).
+					AddJob(BasicJob{JobName: "top", RunCallback: nop, Deps: []string{"a", "b"}})
+				return (&Runner{Graph: g, WorkRunner: wp}).Run(context.Background(), "top").Jobs["top"].Err
+			},
+			Expect: []interface{}{nil},
+		},
+		{
+			Name: "events",
+			Func: func() ([]string, map[string]bool, map[string]error) {
+				defer timeout()()
+				wp := NewWorkPool(2)
+				defer wp.Close()
+				g := New().
+					AddJob(BasicJob{JobName: "fresh", RunCallback: nop, ShouldRunCallback: func() (bool, error) { return false, nil }}).
+					AddJob(BasicJob{JobName: "bad", RunCallback: nop, ShouldRunCallback: func() (bool, error) { return false, errCheck }}).
+					AddJob(BasicJob{JobName: "top", RunCallback: nop, SoftDeps: []string{"fresh", "bad"}})
+				cr := &checkRecorder{checks: make(map[string]bool), errs: make(map[string]error)}
+				(&Runner{Graph: g, WorkRunner: wp, EventHandler: cr}).Run(context.Background(), "top")
+				sort.Strings(cr.resolved)
+				return cr.resolved, cr.checks, cr.errs
+			},
+			Expect: []interface{}{
+				[]string{"bad", "fresh", "top"},
+				map[string]bool{"fresh": false, "bad": false, "top": true},
+				map[string]error{"bad": errCheck, "error bad": errCheck},
+			},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,508 @@
+package xgraph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is an http.Handler which runs builds of a Graph on request.
+//
+// The API uses JSON over HTTP:
+//
+//	POST   /runs              queue a run; the body is a RunRequest, and the response is the RunStatus
+//	GET    /runs              list the RunStatus of every run
+//	GET    /runs/{id}         get the RunStatus of a run
+//	DELETE /runs/{id}         cancel a run
+//	GET    /runs/{id}/events  stream the RunEvents of a run as server-sent events
+//
+// Runs are queued, and only a limited number are executed at once.
+// Only the 100 most recent finished runs are kept, along with the runs which are queued or running.
+// Runs share work through a Coordinator: if a Job is already running for one run, other runs wait for its outcome rather than running it again.
+type Server struct {
+	g *Graph
+
+	// wr is the WorkRunner shared by all runs
+	wr WorkRunner
+	// ownwr is whether wr was created by the Server and should be closed with it
+	ownwr bool
+
+	// sem limits the number of runs executing at once
+	sem chan struct{}
+
+	// ctx is cancelled when the Server is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	co *Coordinator
+
+	lck    sync.Mutex
+	runs   map[string]*serverRun
+	order  []*serverRun
+	nextID int
+	// closed is set by Close, after which no runs are submitted
+	closed bool
+}
+
+// ErrServerClosed indicates that a run was submitted to a Server which has been closed.
+var ErrServerClosed = errors.New("server closed")
+
+// maxRunEvents is the number of events of a run which are kept for streaming.
+const maxRunEvents = 10000
+
+// maxFinishedRuns is the number of finished runs which are kept.
+// Once there are more, the oldest finished runs are removed.
+const maxFinishedRuns = 100
+
+// NewServer creates a Server for a Graph.
+// The WorkRunner is shared by all runs; if it is nil, a work pool is created and closed with the Server.
+// parallel is the maximum number of runs to execute at once.
+// If parallel is 0, then one run per CPU is allowed.
+func NewServer(g *Graph, wr WorkRunner, parallel int) *Server {
+	ownwr := false
+	if wr == nil {
+		wr = NewWorkPool(0)
+		ownwr = true
+	}
+	if parallel == 0 {
+		parallel = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		g:      g,
+		wr:     wr,
+		ownwr:  ownwr,
+		sem:    make(chan struct{}, parallel),
+		ctx:    ctx,
+		cancel: cancel,
+		co:     NewCoordinator(),
+		runs:   make(map[string]*serverRun),
+	}
+}
+
+// RunRequest is the body of a request to start a run.
+type RunRequest struct {
+	// Targets is the list of targets to run.
+	Targets []string `json:"targets"`
+}
+
+// Run states used in a RunStatus.
+const (
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunCanceled  = "canceled"
+)
+
+// Job states used in a JobStatus.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobSkipped   = "skipped"
+)
+
+// RunStatus is the status of a run on a Server.
+type RunStatus struct {
+	// ID is the ID of the run.
+	ID string `json:"id"`
+
+	// Targets is the list of targets of the run.
+	Targets []string `json:"targets"`
+
+	// State is the state of the run (RunQueued, RunRunning, RunSucceeded, RunFailed or RunCanceled).
+	State string `json:"state"`
+
+	// Jobs is the status of each Job in the run, indexed by name.
+	Jobs map[string]JobStatus `json:"jobs"`
+
+	// Failed is a sorted list of the Jobs which failed, once the run has completed.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// JobStatus is the status of a Job in a run on a Server.
+type JobStatus struct {
+	// State is the state of the Job (JobQueued, JobRunning, JobSucceeded, JobFailed or JobSkipped).
+	State string `json:"state"`
+
+	// Error is the error message if the Job failed.
+	Error string `json:"error,omitempty"`
+
+	// Owner is the owner of the Job if it failed (see OwnedJob).
+	Owner string `json:"owner,omitempty"`
+}
+
+// RunEvent is an event in a run on a Server.
+// It is sent as a server-sent event, with the Type as the event type.
+// After the last RunEvent, a "done" event is sent with the final RunStatus.
+// Only the latest 10000 events of a run are kept, so a client which falls further behind misses the older events.
+type RunEvent struct {
+	// Type is the type of the event ("queued", "start", "finish" or "error"), corresponding to the EventHandler methods.
+	Type string `json:"type"`
+
+	// Job is the name of the Job.
+	Job string `json:"job"`
+
+	// Error is the error message for an "error" event.
+	Error string `json:"error,omitempty"`
+}
+
+// serverRun is a run on a Server.
+type serverRun struct {
+	id      string
+	targets []string
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	lck    sync.Mutex
+	state  string
+	jobs   map[string]JobStatus
+	failed []string
+	events []RunEvent
+	// dropped is the number of old events which have been discarded from the start of events
+	dropped int
+	// notify is closed and replaced when the run is updated
+	notify chan struct{}
+}
+
+// update applies a change to the run and notifies watchers.
+func (sr *serverRun) update(fn func()) {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	fn()
+	close(sr.notify)
+	sr.notify = make(chan struct{})
+}
+
+// event records an event and updates the Job state accordingly.
+func (sr *serverRun) event(ev RunEvent, state string) {
+	sr.update(func() {
+		if len(sr.events) >= maxRunEvents {
+			//copy, since streams may still be reading the old events
+			n := len(sr.events) / 2
+			sr.events = append(make([]RunEvent, 0, maxRunEvents), sr.events[n:]...)
+			sr.dropped += n
+		}
+		sr.events = append(sr.events, ev)
+		sr.jobs[ev.Job] = JobStatus{State: state, Error: ev.Error}
+	})
+}
+
+// status returns a snapshot of the RunStatus.
+func (sr *serverRun) status() RunStatus {
+	sr.lck.Lock()
+	defer sr.lck.Unlock()
+	jobs := make(map[string]JobStatus, len(sr.jobs))
+	for n, v := range sr.jobs {
+		jobs[n] = v
+	}
+	return RunStatus{
+		ID:      sr.id,
+		Targets: sr.targets,
+		State:   sr.state,
+		Jobs:    jobs,
+		Failed:  sr.failed,
+	}
+}
+
+// done returns whether the run has completed.
+// The lock must be held.
+func (sr *serverRun) done() bool {
+	return sr.state != RunQueued && sr.state != RunRunning
+}
+
+func (sr *serverRun) OnQueued(job string) {
+	sr.event(RunEvent{Type: "queued", Job: job}, JobQueued)
+}
+
+func (sr *serverRun) OnStart(job string) {
+	sr.event(RunEvent{Type: "start", Job: job}, JobRunning)
+}
+
+func (sr *serverRun) OnFinish(job string) {
+	sr.event(RunEvent{Type: "finish", Job: job}, JobSucceeded)
+}
+
+func (sr *serverRun) OnError(job string, err error) {
+	sr.event(RunEvent{Type: "error", Job: job, Error: err.Error()}, JobFailed)
+}
+
+// Submit queues a run of the targets, and returns its status.
+// Returns ErrServerClosed if the Server has been closed.
+func (s *Server) Submit(targets ...string) (RunStatus, error) {
+	s.lck.Lock()
+	if s.closed {
+		s.lck.Unlock()
+		return RunStatus{}, ErrServerClosed
+	}
+	s.nextID++
+	ctx, cancel := context.WithCancel(s.ctx)
+	sr := &serverRun{
+		id:      strconv.Itoa(s.nextID),
+		targets: targets,
+		ctx:     ctx,
+		cancel:  cancel,
+		state:   RunQueued,
+		jobs:    make(map[string]JobStatus),
+		notify:  make(chan struct{}),
+	}
+	s.runs[sr.id] = sr
+	s.order = append(s.order, sr)
+	s.wg.Add(1) //under the lock, so that Close waits for the run
+	s.lck.Unlock()
+
+	go s.execute(sr)
+
+	return sr.status(), nil
+}
+
+// execute waits for a slot and then runs a serverRun.
+func (s *Server) execute(sr *serverRun) {
+	defer s.wg.Done()
+	defer sr.cancel()
+	defer s.prune()
+
+	//wait in queue
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-sr.ctx.Done():
+		sr.update(func() { sr.state = RunCanceled })
+		return
+	}
+	sr.update(func() { sr.state = RunRunning })
+
+	res := (&Runner{
+		Graph:        s.g,
+		WorkRunner:   s.wr,
+		EventHandler: sr,
+		Coordinator:  s.co,
+	}).Run(sr.ctx, sr.targets...)
+
+	sr.update(func() {
+		for n, r := range res.Jobs {
+			if r.Err == nil && !r.Ran {
+				sr.jobs[n] = JobStatus{State: JobSkipped}
+			}
+			if r.Err != nil && r.Owner != "" {
+				st := sr.jobs[n]
+				st.Owner = r.Owner
+				sr.jobs[n] = st
+			}
+		}
+		sr.failed = res.Failed()
+		switch {
+		case sr.ctx.Err() != nil:
+			sr.state = RunCanceled
+		case len(sr.failed) > 0:
+			sr.state = RunFailed
+		default:
+			sr.state = RunSucceeded
+		}
+	})
+}
+
+// prune removes the oldest finished runs, keeping maxFinishedRuns.
+func (s *Server) prune() {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	finished := 0
+	for _, sr := range s.order {
+		sr.lck.Lock()
+		if sr.done() {
+			finished++
+		}
+		sr.lck.Unlock()
+	}
+	if finished <= maxFinishedRuns {
+		return
+	}
+	order := s.order[:0]
+	for _, sr := range s.order {
+		sr.lck.Lock()
+		done := sr.done()
+		sr.lck.Unlock()
+		if done && finished > maxFinishedRuns {
+			finished--
+			delete(s.runs, sr.id)
+			continue
+		}
+		order = append(order, sr)
+	}
+	for i := len(order); i < len(s.order); i++ {
+		s.order[i] = nil
+	}
+	s.order = order
+}
+
+// Status returns the status of a run.
+// Returns false if there is no run with the ID.
+func (s *Server) Status(id string) (RunStatus, bool) {
+	sr := s.getRun(id)
+	if sr == nil {
+		return RunStatus{}, false
+	}
+	return sr.status(), true
+}
+
+// Cancel cancels a run.
+// Returns false if there is no run with the ID.
+func (s *Server) Cancel(id string) bool {
+	sr := s.getRun(id)
+	if sr == nil {
+		return false
+	}
+	sr.cancel()
+	return true
+}
+
+// Wait waits for a run to complete and returns its final status.
+// Returns false if there is no run with the ID, or ctx is cancelled first.
+func (s *Server) Wait(ctx context.Context, id string) (RunStatus, bool) {
+	sr := s.getRun(id)
+	if sr == nil {
+		return RunStatus{}, false
+	}
+	for {
+		sr.lck.Lock()
+		done, notify := sr.done(), sr.notify
+		sr.lck.Unlock()
+		if done {
+			return sr.status(), true
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return RunStatus{}, false
+		}
+	}
+}
+
+func (s *Server) getRun(id string) *serverRun {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.runs[id]
+}
+
+// Close cancels all runs and waits for them to stop.
+// Runs can not be submitted once the Server has been closed.
+// If the WorkRunner was created by the Server, it is closed.
+func (s *Server) Close() error {
+	s.lck.Lock()
+	s.closed = true
+	s.lck.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	if s.ownwr {
+		return s.wr.Close()
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "runs":
+		switch r.Method {
+		case http.MethodGet:
+			s.lck.Lock()
+			runs := append([]*serverRun(nil), s.order...)
+			s.lck.Unlock()
+			stats := make([]RunStatus, len(runs))
+			for i, v := range runs {
+				stats[i] = v.status()
+			}
+			writeJSON(w, http.StatusOK, stats)
+		case http.MethodPost:
+			var req RunRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+			stat, err := s.Submit(req.Targets...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, stat)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(path, "runs/"):
+		parts := strings.Split(strings.TrimPrefix(path, "runs/"), "/")
+		sr := s.getRun(parts[0])
+		switch {
+		case sr == nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "events"):
+			http.NotFound(w, r)
+		case len(parts) == 2 && r.Method == http.MethodGet:
+			s.streamEvents(w, r, sr)
+		case len(parts) == 1 && r.Method == http.MethodGet:
+			writeJSON(w, http.StatusOK, sr.status())
+		case len(parts) == 1 && r.Method == http.MethodDelete:
+			sr.cancel()
+			writeJSON(w, http.StatusOK, sr.status())
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// streamEvents sends the events of a run as server-sent events until the run completes.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, sr *serverRun) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	sent := 0 //number of events sent or dropped
+	for {
+		sr.lck.Lock()
+		if sent < sr.dropped {
+			sent = sr.dropped
+		}
+		evs, done, notify := sr.events[sent-sr.dropped:], sr.done(), sr.notify
+		sr.lck.Unlock()
+		for _, ev := range evs {
+			writeEvent(w, ev.Type, ev)
+		}
+		sent += len(evs)
+		if done {
+			writeEvent(w, "done", sr.status())
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if done {
+			return
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeEvent writes a server-sent event with JSON data.
+func writeEvent(w http.ResponseWriter, typ string, v interface{}) {
+	dat, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, dat)
+}
+
+// writeJSON writes a JSON response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,300 @@
+package xgraph
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	var lck sync.Mutex
+	runs := map[string]int{}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	count := func(name string) {
+		lck.Lock()
+		defer lck.Unlock()
+		runs[name]++
+	}
+	g := New().
+		AddJob(BasicJob{JobName: "build", RunCallback: func() error { count("build"); return nil }}).
+		AddJob(BasicJob{JobName: "test", Deps: []string{"build"}, RunCallback: func() error { count("test"); return nil }}).
+		AddJob(BasicJob{JobName: "broken", JobOwner: "team-a", RunCallback: func() error { return errors.New("bad") }}).
+		AddJob(BasicJob{JobName: "uptodate", ShouldRunCallback: func() (bool, error) { return false, nil }}).
+		AddJob(BasicJob{JobName: "slow", RunCallback: func() error {
+			count("slow")
+			started <- struct{}{}
+			<-release
+			return nil
+		}}).
+		AddJob(BasicJob{JobName: "after-slow", Deps: []string{"slow"}, RunCallback: func() error { return nil }}).
+		AddJob(cancelJob{BasicJob: BasicJob{JobName: "wait"}, start: make(chan struct{})})
+	wp := NewWorkPool(4)
+	defer wp.Close()
+	srv := NewServer(g, wp, 4)
+	defer srv.Close()
+	hs := httptest.NewServer(srv)
+	defer hs.Close()
+
+	submit := func(targets ...string) (RunStatus, error) {
+		dat, _ := json.Marshal(RunRequest{Targets: targets})
+		resp, err := http.Post(hs.URL+"/runs", "application/json", bytes.NewReader(dat))
+		if err != nil {
+			return RunStatus{}, err
+		}
+		defer resp.Body.Close()
+		var stat RunStatus
+		err = json.NewDecoder(resp.Body).Decode(&stat)
+		return stat, err
+	}
+	get := func(id string) (RunStatus, error) {
+		resp, err := http.Get(hs.URL + "/runs/" + id)
+		if err != nil {
+			return RunStatus{}, err
+		}
+		defer resp.Body.Close()
+		var stat RunStatus
+		err = json.NewDecoder(resp.Body).Decode(&stat)
+		return stat, err
+	}
+	// events reads the server-sent events of a run until the "done" event.
+	events := func(id string) ([]string, RunStatus, error) {
+		resp, err := http.Get(hs.URL + "/runs/" + id + "/events")
+		if err != nil {
+			return nil, RunStatus{}, err
+		}
+		defer resp.Body.Close()
+		evs := []string{}
+		var typ string
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				typ = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: ") && typ == "done":
+				var stat RunStatus
+				err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &stat)
+				return evs, stat, err
+			case strings.HasPrefix(line, "data: "):
+				var ev RunEvent
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+					return nil, RunStatus{}, err
+				}
+				evs = append(evs, ev.Type+" "+ev.Job)
+			}
+		}
+		return nil, RunStatus{}, errors.New("stream ended without done event")
+	}
+	// waitJob polls until a job in a run reaches a state.
+	waitJob := func(id string, job string, state string) error {
+		for {
+			stat, err := get(id)
+			if err != nil {
+				return err
+			}
+			if stat.Jobs[job].State == state {
+				return nil
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	tests := []testCase{
+		{
+			Name: "events",
+			Func: func() ([]string, string, map[string]JobStatus, error) {
+				defer timeout()()
+				stat, err := submit("test")
+				if err != nil {
+					return nil, "", nil, err
+				}
+				evs, stat, err := events(stat.ID)
+				return evs[2:], stat.State, stat.Jobs, err
+			},
+			Expect: []interface{}{
+				[]string{"start build", "finish build", "start test", "finish test"},
+				RunSucceeded,
+				map[string]JobStatus{
+					"build": {State: JobSucceeded},
+					"test":  {State: JobSucceeded},
+				},
+				nil,
+			},
+		},
+		{
+			Name: "skipped",
+			Func: func() (string, map[string]JobStatus) {
+				defer timeout()()
+				stat, err := srv.Submit("uptodate")
+				if err != nil {
+					return "", nil
+				}
+				stat, _ = srv.Wait(context.Background(), stat.ID)
+				return stat.State, stat.Jobs
+			},
+			Expect: []interface{}{RunSucceeded, map[string]JobStatus{"uptodate": {State: JobSkipped}}},
+		},
+		{
+			Name: "closed",
+			Func: func() (error, int, error) {
+				closed := NewServer(g, wp, 1)
+				closed.Close()
+				_, err := closed.Submit("build")
+				rec := httptest.NewRecorder()
+				closed.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/runs", strings.NewReader(`{"targets":["build"]}`)))
+				return err, rec.Code, closed.Close()
+			},
+			Expect: []interface{}{ErrServerClosed, http.StatusServiceUnavailable, nil},
+		},
+		{
+			Name: "event-limit",
+			Func: func() (int, int, RunEvent) {
+				sr := &serverRun{jobs: make(map[string]JobStatus), notify: make(chan struct{})}
+				for i := 0; i <= maxRunEvents; i++ {
+					sr.OnQueued(strconv.Itoa(i))
+				}
+				return len(sr.events), sr.dropped, sr.events[0]
+			},
+			Expect: []interface{}{maxRunEvents/2 + 1, maxRunEvents / 2, RunEvent{Type: "queued", Job: strconv.Itoa(maxRunEvents / 2)}},
+		},
+		{
+			Name: "run-limit",
+			Func: func() (int, bool, bool, error) {
+				defer timeout()()
+				limited := NewServer(g, wp, 1)
+				defer limited.Close()
+				var last RunStatus
+				for i := 0; i <= maxFinishedRuns; i++ {
+					stat, err := limited.Submit("build")
+					if err != nil {
+						return 0, false, false, err
+					}
+					last, _ = limited.Wait(context.Background(), stat.ID)
+				}
+				//the last run may not have been pruned yet when Wait returns
+				limited.prune()
+				_, first := limited.Status("1")
+				_, second := limited.Status("2")
+				limited.lck.Lock()
+				defer limited.lck.Unlock()
+				if len(limited.runs) != len(limited.order) || limited.order[len(limited.order)-1].id != last.ID {
+					return 0, false, false, errors.New("runs and order do not match")
+				}
+				return len(limited.runs), first, second, nil
+			},
+			Expect: []interface{}{maxFinishedRuns, false, true, nil},
+		},
+		{
+			Name: "failure",
+			Func: func() (string, []string, JobStatus, error) {
+				defer timeout()()
+				stat, err := submit("broken")
+				if err != nil {
+					return "", nil, JobStatus{}, err
+				}
+				stat, _ = srv.Wait(context.Background(), stat.ID)
+				stat, err = get(stat.ID)
+				return stat.State, stat.Failed, stat.Jobs["broken"], err
+			},
+			Expect: []interface{}{RunFailed, []string{"broken"}, JobStatus{State: JobFailed, Error: "bad", Owner: "team-a"}, nil},
+		},
+		{
+			Name: "shared",
+			Func: func() (string, string, int, error) {
+				defer timeout()()
+				first, err := submit("slow")
+				if err != nil {
+					return "", "", 0, err
+				}
+				<-started
+				second, err := submit("after-slow")
+				if err != nil {
+					return "", "", 0, err
+				}
+				if err := waitJob(second.ID, "slow", JobRunning); err != nil {
+					return "", "", 0, err
+				}
+				close(release)
+				first, _ = srv.Wait(context.Background(), first.ID)
+				second, _ = srv.Wait(context.Background(), second.ID)
+				lck.Lock()
+				defer lck.Unlock()
+				return first.State, second.State, runs["slow"], nil
+			},
+			Expect: []interface{}{RunSucceeded, RunSucceeded, 1, nil},
+		},
+		{
+			Name: "cancel",
+			Func: func() (string, error) {
+				defer timeout()()
+				stat, err := submit("wait")
+				if err != nil {
+					return "", err
+				}
+				if err := waitJob(stat.ID, "wait", JobRunning); err != nil {
+					return "", err
+				}
+				req, _ := http.NewRequest(http.MethodDelete, hs.URL+"/runs/"+stat.ID, nil)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					return "", err
+				}
+				resp.Body.Close()
+				stat, _ = srv.Wait(context.Background(), stat.ID)
+				return stat.State, nil
+			},
+			Expect: []interface{}{RunCanceled, nil},
+		},
+		{
+			Name: "list",
+			Func: func() (int, error) {
+				resp, err := http.Get(hs.URL + "/runs")
+				if err != nil {
+					return 0, err
+				}
+				defer resp.Body.Close()
+				var stats []RunStatus
+				err = json.NewDecoder(resp.Body).Decode(&stats)
+				return len(stats), err
+			},
+			Expect: []interface{}{6, nil},
+		},
+		{
+			Name: "not-found",
+			Func: func() (int, error) {
+				resp, err := http.Get(hs.URL + "/runs/100")
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			},
+			Expect: []interface{}{http.StatusNotFound, nil},
+		},
+		{
+			Name: "bad-request",
+			Func: func() (int, error) {
+				resp, err := http.Post(hs.URL+"/runs", "application/json", strings.NewReader("{"))
+				if err != nil {
+					return 0, err
+				}
+				resp.Body.Close()
+				return resp.StatusCode, nil
+			},
+			Expect: []interface{}{http.StatusBadRequest, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
@@ -0,0 +1,169 @@
+package xgraph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// SubgraphJob is a Job which runs targets of another Graph as a single Job.
+// Events from the inner build are forwarded to the EventHandler of the outer build, with the name of the SubgraphJob as a prefix.
+// The inner build uses the context passed to Run, so cancellation propagates to it.
+// The value of the SubgraphJob (see SetResult) is the *BuildResult of the inner build.
+type SubgraphJob struct {
+	// JobName of the SubgraphJob.
+	// Required.
+	JobName string
+
+	// Graph is the Graph to run.
+	// Required.
+	Graph *Graph
+
+	// Targets is the list of targets to run in Graph.
+	Targets []string
+
+	// WorkRunner is used to run the inner Jobs.
+	// If nil, a work pool is created for each run.
+	// Sharing the WorkRunner of the outer build may deadlock, as the SubgraphJob holds a worker while waiting.
+	WorkRunner WorkRunner
+
+	// ShouldRunCallback returns whether the SubgraphJob should be run.
+	// Defaults to a function that always returns true.
+	ShouldRunCallback func() (bool, error)
+
+	// Deps is a list of dependencies for the SubgraphJob.
+	// Defaults to []string{}.
+	Deps []string
+}
+
+// Name returns the name of the Job.
+func (sj SubgraphJob) Name() string {
+	return sj.JobName
+}
+
+// Run runs the targets of the Graph.
+// If the context is cancelled, the error from the context is returned.
+// Otherwise, if any inner Jobs fail, a *SubgraphError is returned.
+func (sj SubgraphJob) Run(ctx context.Context) error {
+	evh := NoOpEventHandler
+	if scope, ok := ctx.Value(scopeKey{}).(*jobScope); ok {
+		evh = prefixEventHandler{
+			prefix: scope.jt.name + "/",
+			ex:     scope.ex,
+		}
+	}
+	res := (&Runner{
+		Graph:        sj.Graph,
+		WorkRunner:   sj.WorkRunner,
+		EventHandler: evh,
+	}).Run(ctx, sj.Targets...)
+	SetResult(ctx, res)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed := res.Failed(); len(failed) > 0 {
+		errs := make(map[string]error, len(failed))
+		for _, v := range failed {
+			errs[v] = res.Jobs[v].Err
+		}
+		return &SubgraphError{
+			Failed: failed,
+			Errors: errs,
+		}
+	}
+	return nil
+}
+
+// ShouldRun checks if the SubgraphJob should be run, using ShouldRunCallback.
+func (sj SubgraphJob) ShouldRun() (bool, error) {
+	if sj.ShouldRunCallback == nil {
+		return true, nil
+	}
+	return sj.ShouldRunCallback()
+}
+
+// Dependencies returns the dependencies list of the SubgraphJob.
+// Never returns an error.
+// If Deps is nil, returns an empty slice for the dependencies.
+func (sj SubgraphJob) Dependencies() ([]string, error) {
+	if sj.Deps == nil {
+		return []string{}, nil
+	}
+	return sj.Deps, nil
+}
+
+// SubgraphError is an error indicating that Jobs in the build of a SubgraphJob failed.
+type SubgraphError struct {
+	// Failed is a sorted list of the names of the inner Jobs which failed.
+	Failed []string
+
+	// Errors is the set of errors from the inner Jobs, indexed by name.
+	Errors map[string]error
+}
+
+func (err *SubgraphError) Error() string {
+	return fmt.Sprintf("subgraph jobs failed: (%s)", strings.Join(err.Failed, ","))
+}
+
+// prefixEventHandler is an EventHandler which forwards events to the EventHandler of an executor, with a prefix added to the job names.
+// The events are sent to the controller goroutine of the executor, so that its EventHandler is not called concurrently.
+type prefixEventHandler struct {
+	prefix string
+	ex     *executor
+}
+
+// forward calls fn with the EventHandler of the executor on its controller goroutine.
+func (peh prefixEventHandler) forward(fn func(evh EventHandler)) {
+	peh.ex.notifych <- notification{
+		state: stateEvent,
+		event: func() { fn(peh.ex.evh) },
+	}
+}
+
+func (peh prefixEventHandler) OnQueued(job string) {
+	peh.forward(func(evh EventHandler) { evh.OnQueued(peh.prefix + job) })
+}
+
+func (peh prefixEventHandler) OnStart(job string) {
+	peh.forward(func(evh EventHandler) { evh.OnStart(peh.prefix + job) })
+}
+
+func (peh prefixEventHandler) OnFinish(job string) {
+	peh.forward(func(evh EventHandler) { evh.OnFinish(peh.prefix + job) })
+}
+
+func (peh prefixEventHandler) OnError(job string, err error) {
+	peh.forward(func(evh EventHandler) { evh.OnError(peh.prefix+job, err) })
+}
+
+func (peh prefixEventHandler) OnResolveStart(job string) {
+	peh.forward(func(evh EventHandler) {
+		if ceh, ok := evh.(CheckEventHandler); ok {
+			ceh.OnResolveStart(peh.prefix + job)
+		}
+	})
+}
+
+func (peh prefixEventHandler) OnResolveFinish(job string, err error) {
+	peh.forward(func(evh EventHandler) {
+		if ceh, ok := evh.(CheckEventHandler); ok {
+			ceh.OnResolveFinish(peh.prefix+job, err)
+		}
+	})
+}
+
+func (peh prefixEventHandler) OnCheckStart(job string) {
+	peh.forward(func(evh EventHandler) {
+		if ceh, ok := evh.(CheckEventHandler); ok {
+			ceh.OnCheckStart(peh.prefix + job)
+		}
+	})
+}
+
+func (peh prefixEventHandler) OnCheckFinish(job string, run bool, err error) {
+	peh.forward(func(evh EventHandler) {
+		if ceh, ok := evh.(CheckEventHandler); ok {
+			ceh.OnCheckFinish(peh.prefix+job, run, err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package xgraph
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestSubgraph(t *testing.T) {
+	cs := make(chan struct{})
+	release := New().
+		AddJob(BasicJob{JobName: "build", RunCallback: func() error { return nil }}).
+		AddJob(BasicJob{JobName: "package", Deps: []string{"build"}, RunCallback: func() error { return nil }}).
+		AddJob(BasicJob{JobName: "broken", RunCallback: func() error { return errors.New("bad") }}).
+		AddJob(cancelJob{BasicJob: BasicJob{JobName: "wait"}, start: cs})
+	g := New().
+		AddJob(SubgraphJob{JobName: "release", Graph: release, Targets: []string{"package"}}).
+		AddJob(BasicJob{JobName: "ship", Deps: []string{"release"}, RunCallback: func() error { return nil }}).
+		AddJob(SubgraphJob{JobName: "release-broken", Graph: release, Targets: []string{"package", "broken"}}).
+		AddJob(SubgraphJob{JobName: "release-wait", Graph: release, Targets: []string{"wait"}})
+	tests := []testCase{
+		{
+			Name: "basic",
+			Func: func() ([]string, error, bool) {
+				defer timeout()()
+				sr := &startRecorder{}
+				res := (&Runner{Graph: g, EventHandler: sr}).Run(context.Background(), "ship")
+				sort.Strings(sr.started)
+				inner, err := ResultOf[*BuildResult](res, "release")
+				return sr.started, err, err == nil && inner.Jobs["package"].Ran
+			},
+			Expect: []interface{}{[]string{"release", "release/build", "release/package", "ship"}, nil, true},
+		},
+		{
+			Name: "failure",
+			Func: func() (error, error) {
+				defer timeout()()
+				eh := &errCheckEventHandler{m: make(map[string]error)}
+				(&Runner{Graph: g, EventHandler: eh}).Run(context.Background(), "release-broken")
+				return eh.m["release-broken"], eh.m["release-broken/broken"]
+			},
+			Expect: []interface{}{&SubgraphError{
+				Failed: []string{"broken"},
+				Errors: map[string]error{"broken": errors.New("bad")},
+			}, errors.New("bad")},
+		},
+		{
+			Name:   "error-string",
+			Func:   (&SubgraphError{Failed: []string{"a", "b"}}).Error,
+			Expect: []interface{}{"subgraph jobs failed: (a,b)"},
+		},
+		{
+			Name: "cancel",
+			Func: func() error {
+				defer timeout()()
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					<-cs
+					cancel()
+				}()
+				eh := &errCheckEventHandler{m: make(map[string]error)}
+				(&Runner{Graph: g, EventHandler: eh}).Run(ctx, "release-wait")
+				return eh.m["release-wait"]
+			},
+			Expect: []interface{}{context.Canceled},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
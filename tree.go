@@ -1,72 +1,208 @@
 package xgraph
 
 import (
+	"sort"
 	"strings"
-
-	"github.com/looplab/tarjan"
 )
 
 type jTree struct {
-	name     string
-	finished bool
-	started  bool
-	err      error
-	job      Job
-	deps     []*jTree
+	name string
+	// id is the index of the jTree in the nodes of the treeBuilder
+	id        int32
+	finished  bool
+	started   bool
+	err       error
+	job       Job
+	deps      []jEdge
+	orderDeps []string
+	failures  []string
+	value     interface{}
+	dynDeps   []string
+	dynJobs   []Job
+	reduce    string
+	shared    bool
+
+	// state used by the executor
+	// outcome is the error the job completed with (once finished)
+	outcome error
+	// rdeps are the edges from jobs waiting for this one to complete
+	rdeps []jEdge
+	// waiting is the number of jobs this job is waiting for
+	waiting int
+	// refs is the number of dependents which have not completed, after which the jTree is released
+	refs int
+	// depFailures is the list of hard dependencies which failed
+	depFailures []string
+	// watching is set if the job only runs when a dependency it watches fails
+	watching bool
+	// extending is set while the job waits for its dynamic dependencies
+	extending bool
+	// lookupErr is the error from looking up the job or listing its dependencies
+	lookupErr error
+	// tracked is set once the executor has started the job
+	tracked bool
+	// completing is set once the job has been queued to finish
+	completing bool
+}
+
+// jEdge is a dependency edge in a jTree
+type jEdge struct {
+	// id is the id of the jTree at the other end of the edge
+	id  int32
+	typ DependencyType
 }
 
 type treeBuilder struct {
 	forest map[string]*jTree
-	g      *Graph
+	// nodes is the list of trees in the forest, indexed by id
+	nodes []*jTree
+	g     *Graph
+	// extra is a set of jobs added to the build which are not in the Graph
+	extra map[string]Job
+	// addedBy is the name of the job which added each of the extra jobs
+	addedBy map[string]string
+	// inputs is set to also list the inputs of Jobs when they are looked up (for Watch)
+	inputs bool
+	// index, low and stacked are scratch space used by findCycles, indexed by id
+	index, low []int32
+	stacked    []bool
+}
+
+// resolved is the result of looking up a Job and listing its dependencies
+type resolved struct {
+	job    Job
+	deps   []Dependency
+	inputs []string
+	err    error
+}
+
+// lookup looks up a Job and lists its dependencies, with aliases replaced by their targets.
+// If j is not nil, it is used instead of looking up the name in the Graph.
+// lookup may be called from any goroutine.
+func (tb *treeBuilder) lookup(name string, j Job) resolved {
+	if j == nil {
+		var err error
+		j, err = tb.g.GetJob(name)
+		if err != nil {
+			return resolved{err: err}
+		}
+	}
+	deps, err := listDependencies(j)
+	deps = tb.g.expandDeps(deps)
+	if err != nil || !tb.inputs {
+		return resolved{job: j, deps: deps, err: err}
+	}
+	inputs, err := listInputs(j)
+	return resolved{job: j, deps: deps, inputs: inputs, err: err}
+}
+
+// source returns where a job in the build came from: the name of the job which added it, or where it was added to the Graph.
+func (tb *treeBuilder) source(name string) string {
+	if by, ok := tb.addedBy[name]; ok {
+		return by
+	}
+	return tb.g.source(name)
+}
+
+// node adds an unresolved *jTree to the forest.
+func (tb *treeBuilder) node(name string) *jTree {
+	t := &jTree{
+		name: name,
+		id:   int32(len(tb.nodes)),
+	}
+	tb.forest[name] = t
+	tb.nodes = append(tb.nodes, t)
+	return t
+}
+
+// newTree adds a *jTree to the forest, and looks up its Job and dependencies.
+func (tb *treeBuilder) newTree(name string) (*jTree, []Dependency, error) {
+	t := tb.node(name)
+	r := tb.lookup(name, tb.extra[name])
+	t.job = r.job
+	if r.err != nil {
+		t.err = r.err
+		t.lookupErr = r.err
+		return t, nil, r.err
+	}
+	return t, r.deps, nil
 }
 
-// genTree generates a *jTree if it does not already exist
+// genTree generates a *jTree if it does not already exist, along with the trees of its dependencies.
+// The dependencies are walked depth-first with an explicit stack, so long dependency chains do not grow the goroutine stack.
 func (tb *treeBuilder) genTree(name string) (*jTree, error) {
+	//strip absolute prefix
+	name = strings.TrimPrefix(name, "/")
+
 	//check to see if it is already there
-	t := tb.forest[name]
-	if t != nil {
+	if t := tb.forest[name]; t != nil {
 		return t, t.err
 	}
 
 	//create tree
-	t = new(jTree)
-	tb.forest[name] = t
-	t.name = name
-	t.deps = []*jTree{}
-
-	//lookup job
-	j, err := tb.g.GetJob(name)
+	root, deps, err := tb.newTree(name)
 	if err != nil {
-		t.err = err
-		t.finished = true
-		return t, err
+		return root, err
 	}
-	t.job = j
 
-	//load dependency list
-	deps, err := j.Dependencies()
-	if err != nil {
-		t.err = err
-		t.finished = true
-		return t, err
+	//generate deps
+	type frame struct {
+		t    *jTree
+		deps []Dependency
+		// err is the first error from a hard dependency
+		err error
 	}
+	stack := []frame{{t: root, deps: deps}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		if len(f.deps) == 0 {
+			if f.err != nil {
+				f.t.err = f.err
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		v := f.deps[0]
+		f.deps = f.deps[1:]
 
-	//generate deps
-	darr := make([]*jTree, len(deps))
-	errs := []error{}
-	for i, v := range deps {
-		d, err := tb.genTree(v)
-		if err != nil {
-			errs = append(errs, err)
+		//order-only deps are linked later by linkOrderDeps
+		if v.Type == OrderDependency {
+			f.t.orderDeps = append(f.t.orderDeps, v.Name)
+			continue
+		}
+
+		dname := strings.TrimPrefix(v.Name, "/")
+		d := tb.forest[dname]
+		var derr error
+		var ddeps []Dependency
+		if d != nil {
+			derr = d.err
+		} else {
+			d, ddeps, derr = tb.newTree(dname)
+		}
+		if derr != nil && v.Type == HardDependency && f.err == nil {
+			f.err = derr
+		}
+		f.t.deps = append(f.t.deps, jEdge{id: d.id, typ: v.Type})
+		if ddeps != nil {
+			stack = append(stack, frame{t: d, deps: ddeps})
 		}
-		darr[i] = d
-	}
-	t.deps = darr
-	if len(errs) > 0 {
-		t.err = errs[0]
 	}
 
-	return t, nil
+	return root, nil
+}
+
+// linkOrderDeps adds edges from the trees for their order-only dependencies which are part of the forest.
+// This should be called once the dependencies have been generated.
+func (tb *treeBuilder) linkOrderDeps(trees []*jTree) {
+	for _, t := range trees {
+		for _, v := range t.orderDeps {
+			if d := tb.forest[strings.TrimPrefix(v, "/")]; d != nil {
+				t.deps = append(t.deps, jEdge{id: d.id, typ: OrderDependency})
+			}
+		}
+		t.orderDeps = nil
+	}
 }
 
 // DependencyCycleError is an error indicating that there is a dependency cycle
@@ -76,143 +212,122 @@ func (dce DependencyCycleError) Error() string {
 	return "dependency cycle: " + strings.Join([]string(dce), "->")
 }
 
-type backStack []int
-
-func (bs *backStack) push(val int) {
-	*bs = append(*bs, val)
-}
-
-func (bs *backStack) drop() {
-	*bs = (*bs)[:len(*bs)-1]
-}
-
-func (bs *backStack) search(val int) bool {
-	for _, v := range *bs {
-		if v == val {
-			return true
-		}
-	}
-	return false
-}
-
-type depIndex [][]int
-
-func (di depIndex) checkDeps(node int, bs *backStack) (int, bool) {
-	if node == -1 {
-		return -1, true
+// findCycles finds dependency cycles in the forest using Tarjan's strongly connected components algorithm.
+// If roots are given, only the trees reachable from the roots are searched; otherwise the whole forest is searched.
+// Each job in a cycle which does not already have an error is given a DependencyCycleError, and the jobs in cycles are returned.
+// The search uses an explicit stack and the integer ids of the trees, so it uses memory proportional to the size of the forest.
+func (tb *treeBuilder) findCycles(roots ...int32) []*jTree {
+	n := len(tb.nodes)
+	if len(tb.index) < n {
+		tb.index = append(tb.index, make([]int32, n-len(tb.index))...)
+		tb.low = append(tb.low, make([]int32, n-len(tb.low))...)
+		tb.stacked = append(tb.stacked, make([]bool, n-len(tb.stacked))...)
 	}
-	if bs.search(node) {
-		bs.push(node)
-		return node, true
+	index := tb.index //order of discovery, starting at 1 (0 is undiscovered)
+	low := tb.low
+	stacked := tb.stacked
+	visited := []int32{}
+	stack := []int32{}
+	type frame struct {
+		v int32
+		// i is the index of the next edge to visit
+		i int
 	}
-	bs.push(node)
-	for _, v := range di[node] {
-		if n, cyc := di.checkDeps(v, bs); cyc {
-			return n, true
-		}
-	}
-	bs.drop()
-	return -1, false
-}
-
-func (tb *treeBuilder) findCycles() []*jTree {
-	graph := make(map[interface{}][]interface{})
-	for name, job := range tb.g.jobs {
-		deps, _ := job.Dependencies()
-		gdeps := make([]interface{}, len(deps))
-		for i := range gdeps {
-			gdeps[i] = deps[i]
-		}
-		graph[name] = gdeps
+	calls := []frame{}
+	next := int32(1)
+	visit := func(v int32) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		stacked[v] = true
+		calls = append(calls, frame{v: v})
+		visited = append(visited, v)
 	}
 
-	issues := tarjan.Connections(graph)
-
 	results := []*jTree{}
-	for _, issue := range issues {
-		if len(issue) == 1 {
-			n := issue[0].(string)
-			node := tb.forest[n]
-			if node == nil {
+	count := len(roots)
+	if count == 0 {
+		count = n
+	}
+	for r := 0; r < count; r++ {
+		root := int32(r)
+		if len(roots) > 0 {
+			root = roots[r]
+		}
+		if index[root] != 0 {
+			continue
+		}
+		visit(root)
+		for len(calls) > 0 {
+			f := &calls[len(calls)-1]
+			v := f.v
+			if deps := tb.nodes[v].deps; f.i < len(deps) {
+				w := deps[f.i].id
+				f.i++
+				if index[w] == 0 {
+					visit(w)
+				} else if stacked[w] && index[w] < low[v] {
+					low[v] = index[w]
+				}
 				continue
 			}
-			for _, v := range node.deps {
-				if v.name == n {
-					goto errgen
+
+			//all edges visited
+			calls = calls[:len(calls)-1]
+			if len(calls) > 0 {
+				if p := calls[len(calls)-1].v; low[v] < low[p] {
+					low[p] = low[v]
 				}
 			}
-			continue
-		}
-	errgen:
-		component := []string{}
-		for _, elem := range issue {
-			component = append(component, elem.(string))
-		}
+			if low[v] != index[v] {
+				continue
+			}
 
-		for _, elem := range issue {
-			job := tb.forest[elem.(string)]
-			if job == nil {
+			//pop the strongly connected component
+			i := len(stack) - 1
+			for stack[i] != v {
+				i--
+			}
+			scc := stack[i:]
+			stack = stack[:i]
+			for _, w := range scc {
+				stacked[w] = false
+			}
+			if len(scc) == 1 && !tb.selfDependent(v) {
 				continue
 			}
-			if job.err == nil {
-				job.err = DependencyCycleError(component)
+			component := make([]string, len(scc))
+			for j, w := range scc {
+				component[j] = tb.nodes[w].name
+			}
+			sort.Strings(component) //the ids depend on the order in which jobs were resolved
+			for j := len(scc) - 1; j >= 0; j-- {
+				job := tb.nodes[scc[j]]
+				if job.err == nil {
+					job.err = DependencyCycleError(component)
+				}
+				results = append(results, job)
 			}
-			results = append(results, job)
 		}
 	}
 
+	//reset the scratch space for the next search
+	for _, v := range visited {
+		index[v], low[v] = 0, 0
+	}
+
 	if len(results) > 0 {
 		return results
 	}
 	return nil
 }
 
-func (tb *treeBuilder) findCyclesOld() []*jTree {
-	//generate string-int mapping tables
-	s2n := make(map[string]int)
-	n2s := []string{}
-	for n := range tb.forest {
-		i := len(n2s)
-		s2n[n] = i
-		n2s = append(n2s, n)
-	}
-
-	//generate dep index
-	di := make(depIndex, len(tb.forest))
-	for _, v := range tb.forest {
-		i := s2n[v.name]
-		dlst := make([]int, len(v.deps))
-		for j, k := range v.deps {
-			d, exist := s2n[k.name]
-			if !exist {
-				d = -1
-			}
-			dlst[j] = d
-		}
-		di[i] = dlst
-	}
-
-	//scan with index
-	cTrees := []*jTree{}
-	bs := new(backStack)
-	for i := range di {
-		n, cyc := di.checkDeps(i, bs)
-		if cyc && n != -1 {
-			t := tb.forest[n2s[n]]
-			if t.err == nil {
-				c := make([]string, len(*bs))
-				for i, v := range *bs {
-					c[i] = n2s[v]
-				}
-				t.err = DependencyCycleError(c)
-				cTrees = append(cTrees, t)
-			}
+// selfDependent returns whether a tree has an edge to itself.
+func (tb *treeBuilder) selfDependent(id int32) bool {
+	for _, v := range tb.nodes[id].deps {
+		if v.id == id {
+			return true
 		}
-		*bs = (*bs)[:0]
-	}
-
-	if len(cTrees) > 0 {
-		return cTrees
 	}
-	return nil
+	return false
 }
@@ -1,6 +1,7 @@
 package xgraph
 
 import (
+	"context"
 	"fmt"
 	"testing"
 )
@@ -9,15 +10,12 @@ func BenchmarkTreeDeps(b *testing.B) {
 	for _, depth := range []int{4, 8, 10} {
 		g := denseValidGraph(depth, 8)
 		b.Run(fmt.Sprintf("%d", depth), func(b *testing.B) {
-			benchmarkTreeDeps(b, g, 8, false)
-		})
-		b.Run(fmt.Sprintf("%dTarjan", depth), func(b *testing.B) {
-			benchmarkTreeDeps(b, g, 8, true)
+			benchmarkTreeDeps(b, g, 8)
 		})
 	}
 }
 
-func benchmarkTreeDeps(b *testing.B, g *Graph, w int, tarjan bool) {
+func benchmarkTreeDeps(b *testing.B, g *Graph, w int) {
 	for i := 0; i < b.N; i++ {
 		tb := &treeBuilder{
 			forest: make(map[string]*jTree),
@@ -28,11 +26,97 @@ func benchmarkTreeDeps(b *testing.B, g *Graph, w int, tarjan bool) {
 			tb.genTree(jobname(0, i))
 		}
 
-		if tarjan {
-			tb.findCycles()
-		} else {
-			tb.findCyclesOld()
+		tb.findCycles()
+	}
+}
+
+// BenchmarkRunnerScale runs builds of increasing size, to check that the time per job stays about the same.
+func BenchmarkRunnerScale(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		//a chain of jobs, each depending on the previous one
+		g := chainGraph(n, 1)
+		b.Run(fmt.Sprintf("chain/%d", n), func(b *testing.B) {
+			benchmarkRun(b, g, jobname(n-1, 0))
+		})
+
+		//jobs each depending on 10 earlier jobs (1M edges for 100k jobs)
+		g = chainGraph(n, 10)
+		b.Run(fmt.Sprintf("wide/%d", n), func(b *testing.B) {
+			benchmarkRun(b, g, jobname(n-1, 0))
+		})
+	}
+}
+
+func benchmarkRun(b *testing.B, g *Graph, target string) {
+	wp := NewWorkPool(0)
+	defer wp.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := (&Runner{Graph: g, WorkRunner: wp}).Run(context.Background(), target)
+		if res.Jobs[target].Err != nil {
+			b.Fatal(res.Jobs[target].Err)
+		}
+	}
+}
+
+// chainGraph creates a graph of n jobs, where each job depends on up to fan of the jobs before it.
+func chainGraph(n, fan int) *Graph {
+	g := New()
+	for i := 0; i < n; i++ {
+		var deps []string
+		for j := 1; j <= fan && j <= i; j++ {
+			deps = append(deps, jobname(i-j, 0))
 		}
+		g.AddJob(testJob(i, 0, deps))
+	}
+	return g
+}
+
+func TestTreeScale(t *testing.T) {
+	const n = 100000
+	tests := []testCase{
+		{
+			Name: "chain",
+			Func: func() (int, int) {
+				tb := &treeBuilder{
+					forest: make(map[string]*jTree),
+					g:      chainGraph(n, 1),
+				}
+				tb.genTree(jobname(n-1, 0))
+				return len(tb.nodes), len(tb.findCycles())
+			},
+			Expect: []interface{}{n, 0},
+		},
+		{
+			Name: "cycle",
+			Func: func() (int, int, error) {
+				g := chainGraph(n, 1)
+				g.AddJob(testJob(0, 0, []string{jobname(n-1, 0)}))
+				tb := &treeBuilder{
+					forest: make(map[string]*jTree),
+					g:      g,
+				}
+				tb.genTree(jobname(n-1, 0))
+				cyc := tb.findCycles()
+				err, _ := tb.forest[jobname(0, 0)].err.(DependencyCycleError)
+				return len(cyc), len(err), nil
+			},
+			Expect: []interface{}{n, n, nil},
+		},
+		{
+			Name: "run",
+			Func: func() (int, error) {
+				defer timeout()()
+				const m = n / 5
+				res := (&Runner{Graph: chainGraph(m, 1)}).Run(context.Background(), jobname(m-1, 0))
+				return len(res.Jobs), res.Jobs[jobname(m-1, 0)].Err
+			},
+			Expect: []interface{}{n / 5, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
 	}
 }
 
@@ -0,0 +1,223 @@
+package xgraph
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDebounce is the default time that Runner.Watch waits for more changes after a file changes.
+const DefaultDebounce = 100 * time.Millisecond
+
+// DefaultPollInterval is the default interval at which Runner.Watch checks files when inotify is not available.
+const DefaultPollInterval = 500 * time.Millisecond
+
+// watchBuild is the state of a build started by Watch.
+type watchBuild struct {
+	// only is the set of jobs affected by changes since the last build, or nil to run every job
+	only map[string]bool
+
+	// prev is the results of the jobs in the last build
+	prev map[string]*JobResult
+
+	// onResolve is called on the controller goroutine whenever a job has been looked up
+	onResolve func(name string, r resolved)
+}
+
+// unchanged returns the result of a job in the last build if it succeeded and is not affected by the changes since.
+// Returns nil if the job needs to be run, or if wb is nil.
+func (wb *watchBuild) unchanged(name string) *JobResult {
+	if wb == nil || wb.only == nil || wb.only[name] {
+		return nil
+	}
+	if prev := wb.prev[name]; prev != nil && prev.Err == nil {
+		return prev
+	}
+	return nil
+}
+
+// watchState tracks the inputs and dependencies of the jobs seen by Watch.
+type watchState struct {
+	lck sync.Mutex
+	w   fileWatcher
+	ix  inputIndex
+
+	// current is the set of jobs in the build which is running
+	current map[string]bool
+
+	// watched is the set of paths which have been added to the watcher
+	watched map[string]bool
+}
+
+// begin starts tracking the jobs of a new build
+func (ws *watchState) begin() {
+	ws.lck.Lock()
+	defer ws.lck.Unlock()
+	ws.current = make(map[string]bool)
+}
+
+// onResolve records the dependencies and inputs of a job, and watches its inputs
+func (ws *watchState) onResolve(name string, r resolved) {
+	ws.lck.Lock()
+	defer ws.lck.Unlock()
+	ws.current[name] = true
+	if r.err != nil {
+		return
+	}
+	var add []string
+	for _, in := range ws.ix.add(name, r.deps, r.inputs) {
+		if !ws.watched[in] {
+			ws.watched[in] = true
+			add = append(add, in)
+		}
+	}
+	if len(add) > 0 {
+		ws.w.add(add)
+	}
+}
+
+// affected finds the jobs affected by the changed paths.
+// Returns the affected jobs, and the sorted list of changed paths which are read by any job.
+func (ws *watchState) affected(changed []string) (map[string]*AffectedReason, []string) {
+	ws.lck.Lock()
+	defer ws.lck.Unlock()
+	aff := ws.ix.affected(changed)
+	var read []string
+	for _, r := range aff {
+		read = append(read, r.Changed...)
+	}
+	sort.Strings(read)
+	return aff, dedup(read)
+}
+
+// stale checks whether any of the affected jobs are in the running build.
+func (ws *watchState) stale(aff map[string]*AffectedReason) bool {
+	ws.lck.Lock()
+	defer ws.lck.Unlock()
+	for name := range aff {
+		if ws.current[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch runs the targets on the graph, and runs them again whenever the inputs of the jobs in the build change.
+// Inputs are listed by Jobs implementing InputJob, and are watched with inotify on Linux, or by polling otherwise.
+// Changes are debounced by r.Debounce, and then only the jobs which read the changed files, the jobs downstream of them, and the jobs which did not succeed in the last build are run.
+// If a change affects a job in a build which is still running, the build is cancelled and a new build is started.
+// If the EventHandler implements WatchEventHandler, it is notified at the start and end of each build.
+// If no targets are given, the default targets of the graph are used (see Graph.SetDefaults).
+// Watch runs until ctx is cancelled, and then returns the error from ctx.
+func (r *Runner) Watch(ctx context.Context, targets ...string) error {
+	//get WorkRunner or create it
+	wr := r.WorkRunner
+	if wr == nil {
+		wr = NewWorkPool(0)
+		defer wr.Close()
+	}
+	debounce := r.Debounce
+	if debounce == 0 {
+		debounce = DefaultDebounce
+	}
+	poll := r.PollInterval
+	if poll == 0 {
+		poll = DefaultPollInterval
+	}
+	weh, _ := r.EventHandler.(WatchEventHandler)
+
+	w := newFileWatcher(poll)
+	defer w.close()
+	ws := &watchState{
+		w:       w,
+		ix:      newInputIndex(),
+		current: make(map[string]bool),
+		watched: make(map[string]bool),
+	}
+
+	var (
+		cycle   int
+		prev    map[string]*JobResult
+		next    map[string]bool //jobs affected by changes since the running build started (nil before the first build)
+		changed []string        //files changed since the running build started
+		done    chan *BuildResult
+		cancel  context.CancelFunc
+	)
+	start := func() {
+		cycle++
+		ws.begin()
+		if weh != nil {
+			weh.OnCycle(cycle, changed)
+		}
+		wb := &watchBuild{
+			only:      next,
+			prev:      prev,
+			onResolve: ws.onResolve,
+		}
+		next, changed = make(map[string]bool), nil
+		var bctx context.Context
+		bctx, cancel = context.WithCancel(ctx)
+		d := make(chan *BuildResult, 1)
+		done = d
+		go func() {
+			d <- r.run(bctx, wr, targets, wb)
+		}()
+	}
+	finish := func(res *BuildResult) {
+		cancel()
+		done = nil
+		prev = res.Jobs
+		if weh != nil {
+			weh.OnCycleFinish(cycle, res)
+		}
+	}
+
+	start()
+	batch := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case res := <-done:
+			finish(res)
+			if len(next) > 0 {
+				start()
+			}
+		case p := <-w.changes():
+			//wait for changes to settle
+			batch[p] = true
+			timer.Reset(debounce)
+		case <-timer.C:
+			paths := make([]string, 0, len(batch))
+			for p := range batch {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			batch = make(map[string]bool)
+			aff, read := ws.affected(paths)
+			if len(aff) == 0 {
+				continue
+			}
+			for name := range aff {
+				next[name] = true
+			}
+			changed = append(changed, read...)
+			switch {
+			case done == nil:
+				start()
+			case ws.stale(aff):
+				cancel()
+				finish(<-done)
+				start()
+			}
+		case <-ctx.Done():
+			if done != nil {
+				cancel()
+				finish(<-done)
+			}
+			return ctx.Err()
+		}
+	}
+}
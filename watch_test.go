@@ -0,0 +1,199 @@
+package xgraph
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// inputJob is a Job which reads files.
+type inputJob struct {
+	BasicJob
+	files []string
+}
+
+func (ij inputJob) Inputs() ([]string, error) {
+	return ij.files, nil
+}
+
+// blockJob is an inputJob which blocks until cancelled the first time it is run.
+type blockJob struct {
+	inputJob
+	start chan struct{}
+}
+
+func (bj blockJob) Run(ctx context.Context) error {
+	select {
+	case <-bj.start:
+		return nil
+	default:
+	}
+	close(bj.start)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// cycleRecorder is a WatchEventHandler which summarizes each cycle.
+type cycleRecorder struct {
+	nophandler
+	dir     string
+	changed []string
+	ch      chan string
+}
+
+func (cr *cycleRecorder) OnCycle(cycle int, changed []string) {
+	cr.changed = cr.changed[:0]
+	for _, p := range changed {
+		rel, err := filepath.Rel(cr.dir, p)
+		if err != nil {
+			panic(err)
+		}
+		cr.changed = append(cr.changed, rel)
+	}
+}
+
+func (cr *cycleRecorder) OnCycleFinish(cycle int, result *BuildResult) {
+	ran, failed := []string{}, []string{}
+	for name, r := range result.Jobs {
+		if r.Ran {
+			ran = append(ran, name)
+		}
+		if r.Err != nil {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(ran)
+	sort.Strings(failed)
+	cr.ch <- fmt.Sprintf("cycle %d changed %v ran %v failed %v", cycle, cr.changed, ran, failed)
+}
+
+func TestWatch(t *testing.T) {
+	nop := func() error { return nil }
+	for _, poll := range []bool{false, true} {
+		mode := "inotify"
+		if poll {
+			mode = "poll"
+		}
+		tests := []testCase{
+			{
+				Name: "rerun-affected-" + mode,
+				Func: func() []string {
+					defer timeout()()
+					forcePoll = poll
+					defer func() { forcePoll = false }()
+					dir := t.TempDir()
+					write := func(name string) {
+						if err := os.WriteFile(filepath.Join(dir, name), []byte(time.Now().String()), 0644); err != nil {
+							panic(err)
+						}
+					}
+					write("a.txt")
+					write("b.txt")
+					os.Mkdir(filepath.Join(dir, "src"), 0755)
+					g := New().AddJob(inputJob{
+						BasicJob: BasicJob{JobName: "a", RunCallback: nop},
+						files:    []string{filepath.Join(dir, "a.txt")},
+					}).AddJob(inputJob{
+						BasicJob: BasicJob{JobName: "b", RunCallback: nop},
+						files:    []string{filepath.Join(dir, "b.txt"), filepath.Join(dir, "src")},
+					}).AddJob(BasicJob{
+						JobName:     "c",
+						Deps:        []string{"a"},
+						RunCallback: nop,
+					}).AddJob(BasicJob{
+						JobName:     "d",
+						Deps:        []string{"b"},
+						RunCallback: nop,
+					})
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					cr := &cycleRecorder{dir: dir, ch: make(chan string)}
+					errch := make(chan error)
+					go func() {
+						errch <- (&Runner{
+							Graph:        g,
+							EventHandler: cr,
+							Debounce:     50 * time.Millisecond,
+							PollInterval: 5 * time.Millisecond,
+						}).Watch(ctx, "c", "d")
+					}()
+					out := []string{<-cr.ch}
+					write("a.txt")
+					out = append(out, <-cr.ch)
+					//changes are debounced into one cycle
+					write("a.txt")
+					write("b.txt")
+					out = append(out, <-cr.ch)
+					//files are found in directories, and unrelated files are ignored
+					write("other.txt")
+					write(filepath.Join("src", "x.txt"))
+					out = append(out, <-cr.ch)
+					cancel()
+					out = append(out, (<-errch).Error())
+					return out
+				},
+				Expect: []interface{}{[]string{
+					"cycle 1 changed [] ran [a b c d] failed []",
+					"cycle 2 changed [a.txt] ran [a c] failed []",
+					"cycle 3 changed [a.txt b.txt] ran [a b c d] failed []",
+					"cycle 4 changed [src/x.txt] ran [b d] failed []",
+					context.Canceled.Error(),
+				}},
+			},
+			{
+				Name: "cancel-stale-" + mode,
+				Func: func() []string {
+					defer timeout()()
+					forcePoll = poll
+					defer func() { forcePoll = false }()
+					dir := t.TempDir()
+					path := filepath.Join(dir, "a.txt")
+					if err := os.WriteFile(path, []byte("1"), 0644); err != nil {
+						panic(err)
+					}
+					start := make(chan struct{})
+					g := New().AddJob(blockJob{
+						inputJob: inputJob{
+							BasicJob: BasicJob{JobName: "a"},
+							files:    []string{path},
+						},
+						start: start,
+					})
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					cr := &cycleRecorder{dir: dir, ch: make(chan string)}
+					errch := make(chan error)
+					go func() {
+						errch <- (&Runner{
+							Graph:        g,
+							EventHandler: cr,
+							Debounce:     10 * time.Millisecond,
+							PollInterval: 5 * time.Millisecond,
+						}).Watch(ctx, "a")
+					}()
+					//change the input while the job is running
+					<-start
+					if err := os.WriteFile(path, []byte("22"), 0644); err != nil {
+						panic(err)
+					}
+					out := []string{<-cr.ch, <-cr.ch}
+					cancel()
+					out = append(out, (<-errch).Error())
+					return out
+				},
+				Expect: []interface{}{[]string{
+					"cycle 1 changed [] ran [a] failed [a]",
+					"cycle 2 changed [a.txt] ran [a] failed []",
+					context.Canceled.Error(),
+				}},
+			},
+		}
+		for _, tv := range tests {
+			tv.genTest(t)
+		}
+	}
+}
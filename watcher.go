@@ -0,0 +1,167 @@
+package xgraph
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fileWatcher reports changes to files.
+type fileWatcher interface {
+	// add starts watching a set of absolute paths.
+	// Directories are watched recursively, and paths which do not exist yet are reported when they are created.
+	add(paths []string)
+
+	// changes returns a channel of the paths which changed.
+	changes() <-chan string
+
+	// close stops watching.
+	close() error
+}
+
+// forcePoll disables inotify, for testing.
+var forcePoll = false
+
+// newFileWatcher creates a fileWatcher, using inotify if available.
+// Otherwise, files are polled at the given interval.
+func newFileWatcher(poll time.Duration) fileWatcher {
+	if !forcePoll {
+		if w, err := newInotifyWatcher(poll); err == nil {
+			return w
+		}
+	}
+	return newPollWatcher(poll, make(chan string))
+}
+
+// fileState is the state of a file which is checked by a pollWatcher.
+type fileState struct {
+	mod  time.Time
+	size int64
+	mode fs.FileMode
+}
+
+// pollWatcher is a fileWatcher which periodically checks files for changes.
+type pollWatcher struct {
+	interval time.Duration
+	lck      sync.Mutex
+
+	// roots is the state of the files under each watched path
+	roots map[string]map[string]fileState
+
+	ch   chan string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newPollWatcher creates a pollWatcher which checks files at the given interval, and sends changes on ch.
+func newPollWatcher(interval time.Duration, ch chan string) *pollWatcher {
+	pw := &pollWatcher{
+		interval: interval,
+		roots:    make(map[string]map[string]fileState),
+		ch:       ch,
+		done:     make(chan struct{}),
+	}
+	pw.wg.Add(1)
+	go pw.run()
+	return pw
+}
+
+// scan gets the state of a path, and of everything in it if it is a directory.
+func scan(root string) map[string]fileState {
+	files := make(map[string]fileState)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		st := fileState{mode: info.Mode()}
+		if !info.IsDir() {
+			//changes inside directories are reported for the files which changed
+			st.mod, st.size = info.ModTime(), info.Size()
+		}
+		files[path] = st
+		return nil
+	})
+	return files
+}
+
+func (pw *pollWatcher) add(paths []string) {
+	pw.lck.Lock()
+	defer pw.lck.Unlock()
+	for _, p := range paths {
+		if _, ok := pw.roots[p]; !ok {
+			pw.roots[p] = scan(p)
+		}
+	}
+}
+
+// poll checks all of the watched paths, and returns a sorted list of the paths which changed.
+func (pw *pollWatcher) poll() []string {
+	pw.lck.Lock()
+	defer pw.lck.Unlock()
+	changed := make(map[string]bool)
+	for root, old := range pw.roots {
+		files := scan(root)
+		for path, st := range files {
+			if ost, ok := old[path]; !ok || ost != st {
+				changed[path] = true
+			}
+		}
+		for path := range old {
+			if _, ok := files[path]; !ok {
+				changed[path] = true
+			}
+		}
+		pw.roots[root] = files
+	}
+	list := make([]string, 0, len(changed))
+	for path := range changed {
+		list = append(list, path)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (pw *pollWatcher) run() {
+	defer pw.wg.Done()
+	tick := time.NewTicker(pw.interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-pw.done:
+			return
+		}
+		for _, path := range pw.poll() {
+			select {
+			case pw.ch <- path:
+			case <-pw.done:
+				return
+			}
+		}
+	}
+}
+
+func (pw *pollWatcher) changes() <-chan string {
+	return pw.ch
+}
+
+func (pw *pollWatcher) close() error {
+	close(pw.done)
+	pw.wg.Wait()
+	return nil
+}
+
+var _ fileWatcher = (*pollWatcher)(nil)
+
+// statDir checks whether a path is a directory.
+func statDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
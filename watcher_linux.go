@@ -0,0 +1,187 @@
+package xgraph
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyMask is the set of inotify events which are reported as changes.
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotifyWatcher is a fileWatcher which uses inotify.
+// Files are watched through their parent directory, so that they are seen if they are replaced or created later.
+type inotifyWatcher struct {
+	f    *os.File
+	fd   int
+	lck  sync.Mutex
+	poll time.Duration
+
+	// dirs is the watch descriptor of each watched directory
+	dirs map[string]int
+
+	// wds is the directory of each watch descriptor
+	wds map[int]string
+
+	// trees is the set of directories which are watched recursively
+	trees map[string]bool
+
+	// fallback polls paths which could not be watched with inotify (created when needed)
+	fallback *pollWatcher
+
+	ch   chan string
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newInotifyWatcher creates a fileWatcher using inotify.
+// If a path cannot be watched with inotify (e.g. the watch limit has been reached), it is polled at the given interval instead.
+func newInotifyWatcher(poll time.Duration) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		f:     os.NewFile(uintptr(fd), "inotify"),
+		fd:    fd,
+		poll:  poll,
+		dirs:  make(map[string]int),
+		wds:   make(map[int]string),
+		trees: make(map[string]bool),
+		ch:    make(chan string),
+		done:  make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) add(paths []string) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	var failed []string
+	for _, p := range paths {
+		var err error
+		if statDir(p) {
+			err = w.watchTree(p)
+		} else {
+			err = w.watchDir(filepath.Dir(p))
+		}
+		if err != nil {
+			failed = append(failed, p)
+		}
+	}
+	if len(failed) > 0 {
+		if w.fallback == nil {
+			w.fallback = newPollWatcher(w.poll, w.ch)
+		}
+		w.fallback.add(failed)
+	}
+}
+
+// watchDir adds an inotify watch to a directory.
+func (w *inotifyWatcher) watchDir(dir string) error {
+	if _, ok := w.dirs[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return err
+	}
+	w.dirs[dir] = wd
+	w.wds[wd] = dir
+	return nil
+}
+
+// watchTree watches a directory and everything in it.
+func (w *inotifyWatcher) watchTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		w.trees[path] = true
+		return w.watchDir(path)
+	})
+}
+
+// read reads events from inotify until the watcher is closed.
+func (w *inotifyWatcher) read() {
+	defer w.wg.Done()
+	var buf [64 * 1024]byte
+	for {
+		n, err := w.f.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)])
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			path, ok := w.event(int(ev.Wd), ev.Mask, strings.TrimRight(name, "\x00"))
+			if !ok {
+				continue
+			}
+			select {
+			case w.ch <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// event updates the watches for an inotify event, and returns the path which changed.
+func (w *inotifyWatcher) event(wd int, mask uint32, name string) (string, bool) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	dir, ok := w.wds[wd]
+	if !ok {
+		return "", false
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		//the watch was removed because the directory was deleted
+		delete(w.wds, wd)
+		delete(w.dirs, dir)
+		delete(w.trees, dir)
+		return "", false
+	}
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && w.trees[dir] {
+		//watch new subdirectories of recursively watched directories
+		w.watchTree(path)
+	}
+	return path, true
+}
+
+func (w *inotifyWatcher) changes() <-chan string {
+	return w.ch
+}
+
+func (w *inotifyWatcher) close() error {
+	close(w.done)
+	err := w.f.Close()
+	w.wg.Wait()
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	if w.fallback != nil {
+		w.fallback.close()
+	}
+	return err
+}
+
+var _ fileWatcher = (*inotifyWatcher)(nil)
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package xgraph
+
+import (
+	"errors"
+	"time"
+)
+
+// errInotifyUnsupported is returned by newInotifyWatcher on systems other than Linux.
+var errInotifyUnsupported = errors.New("inotify not supported")
+
+// newInotifyWatcher creates a fileWatcher using inotify.
+// Returns an error on systems other than Linux.
+func newInotifyWatcher(poll time.Duration) (fileWatcher, error) {
+	return nil, errInotifyUnsupported
+}
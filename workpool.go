@@ -1,9 +1,11 @@
 package xgraph
 
 import (
+	"context"
 	"io"
 	"runtime"
 	"sync"
+	"time"
 )
 
 // WorkRunner is a type
@@ -15,6 +17,13 @@ type WorkRunner interface {
 	io.Closer
 }
 
+// JobRunner is an optional interface for a WorkRunner which controls how Jobs are run.
+// If the WorkRunner used by a Runner implements JobRunner, the tasks it is given call RunJob instead of Job.Run.
+type JobRunner interface {
+	// RunJob runs a Job, and returns the error from running it.
+	RunJob(ctx context.Context, job Job) error
+}
+
 // Task is a task function.
 type Task func() error
 
@@ -23,60 +32,163 @@ func (t Task) Run(tracker WorkTracker) {
 	tracker.OnComplete(t())
 }
 
-// poolWorkRunner is a WorkRunner implementation which uses a pool of goroutines.
-type poolWorkRunner struct {
-	//jobch is a channel where jobs can be sent
-	//all goroutines should stop after this channel is closed
-	workch chan work
+// WorkPool is a WorkRunner which runs tasks on goroutines, limiting the number of tasks running at once.
+// The limit can be changed while the WorkPool is in use with SetParallelism.
+// A WorkPool can also hold back tasks while the system is overloaded (see SetLoadLimit).
+type WorkPool struct {
+	//lck protects the state of the pool
+	//cond is signalled when a task finishes or the limits change
+	lck  sync.Mutex
+	cond *sync.Cond
+
+	//parallel is the maximum number of running tasks
+	//running is the number of running tasks
+	parallel, running int
+
+	//overloaded is set by the load monitor while the system is overloaded
+	overloaded bool
+
+	//stopMonitor stops the load monitor, if there is one
+	stopMonitor chan struct{}
+
+	//readLoad reads the load of the system
+	readLoad func() (SystemLoad, error)
 
-	//stop is a WaitGroup which waits on all the goroutines
-	//goroutines will release the WaitGroup when they shut down
+	//stop is a WaitGroup which waits on all running tasks
 	stop sync.WaitGroup
 }
 
-// NewWorkPool returns a WorkRunner that uses a fixed pool of goroutines.
+// NewWorkPool returns a WorkRunner that uses a pool of goroutines.
 // parallel is the number of goroutines to use in the pool.
 // If parallel is 0, then one goroutine will be used per CPU.
+// The WorkRunner is a *WorkPool, so the parallelism can be changed later.
 func NewWorkPool(parallel uint16) WorkRunner {
-	if parallel == 0 {
-		parallel = uint16(runtime.NumCPU())
-	}
-	pwr := &poolWorkRunner{
-		workch: make(chan work),
-	}
-	pwr.stop.Add(int(parallel))
-	for parallel != 0 {
-		go pwr.worker()
-		parallel--
+	return NewResizableWorkPool(int(parallel))
+}
+
+// NewResizableWorkPool returns a WorkPool which runs up to parallel tasks at once.
+// If parallel is 0, then one task is run at once per CPU.
+func NewResizableWorkPool(parallel int) *WorkPool {
+	wp := &WorkPool{readLoad: ReadSystemLoad}
+	wp.cond = sync.NewCond(&wp.lck)
+	wp.SetParallelism(parallel)
+	return wp
+}
+
+// SetParallelism changes the maximum number of tasks run at once.
+// If parallel is 0, then one task is run at once per CPU.
+// If the limit is reduced, running tasks are not interrupted, but no new tasks are started until the number running is below the limit.
+func (wp *WorkPool) SetParallelism(parallel int) {
+	if parallel <= 0 {
+		parallel = runtime.NumCPU()
 	}
-	return pwr
+	wp.lck.Lock()
+	defer wp.lck.Unlock()
+	wp.parallel = parallel
+	wp.cond.Broadcast()
 }
 
-// work is a container holding a task-tracker pair.
-type work struct {
-	task    Task
-	tracker WorkTracker
+// Parallelism returns the maximum number of tasks run at once.
+func (wp *WorkPool) Parallelism() int {
+	wp.lck.Lock()
+	defer wp.lck.Unlock()
+	return wp.parallel
 }
 
-// worker is run in a goroutine to do work from the queue.
-// decrements the WaitGroup when it finishes.
-func (pwr *poolWorkRunner) worker() {
-	defer pwr.stop.Done()
-	for work := range pwr.workch {
-		work.task.Run(work.tracker)
+// LoadLimit is a limit on the load of the system, used by a WorkPool to hold back tasks on a shared machine.
+type LoadLimit struct {
+	// MaxLoad is the maximum 1 minute load average per CPU.
+	// If 0, the load average is not checked.
+	MaxLoad float64
+
+	// MinMemory is the minimum fraction of memory which must be available.
+	// If 0, memory is not checked.
+	MinMemory float64
+
+	// Interval is how often the load is checked.
+	// Defaults to one second.
+	Interval time.Duration
+}
+
+// overloaded checks whether a SystemLoad exceeds the limit.
+func (ll *LoadLimit) overloaded(sl SystemLoad) bool {
+	return (ll.MaxLoad > 0 && sl.Load > ll.MaxLoad) || (ll.MinMemory > 0 && sl.Memory < ll.MinMemory)
+}
+
+// SetLoadLimit makes the WorkPool check the load of the system, and hold back new tasks while it exceeds the limit.
+// While the system is overloaded, a new task is only started if no tasks are running, so that the build still progresses.
+// If the load cannot be read (e.g. because the system is not Linux), tasks are never held back.
+// A nil LoadLimit removes the limit.
+func (wp *WorkPool) SetLoadLimit(limit *LoadLimit) {
+	wp.lck.Lock()
+	defer wp.lck.Unlock()
+	if wp.stopMonitor != nil {
+		close(wp.stopMonitor)
+		wp.stopMonitor = nil
+	}
+	wp.overloaded = false
+	wp.cond.Broadcast()
+	if limit == nil {
+		return
+	}
+	stop := make(chan struct{})
+	wp.stopMonitor = stop
+	go wp.monitor(*limit, stop)
+}
+
+// monitor checks the load of the system periodically until stop is closed.
+func (wp *WorkPool) monitor(limit LoadLimit, stop chan struct{}) {
+	if limit.Interval == 0 {
+		limit.Interval = time.Second
+	}
+	t := time.NewTicker(limit.Interval)
+	defer t.Stop()
+	for {
+		sl, err := wp.readLoad()
+		overloaded := err == nil && limit.overloaded(sl)
+		wp.lck.Lock()
+		select {
+		case <-stop:
+			wp.lck.Unlock()
+			return
+		default:
+		}
+		if overloaded != wp.overloaded {
+			wp.overloaded = overloaded
+			wp.cond.Broadcast()
+		}
+		wp.lck.Unlock()
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
 	}
 }
 
-func (pwr *poolWorkRunner) DoTask(task Task, tracker WorkTracker) {
-	pwr.workch <- work{
-		task:    task,
-		tracker: tracker,
+// DoTask waits until the task can be started, and then runs it on a new goroutine.
+func (wp *WorkPool) DoTask(task Task, tracker WorkTracker) {
+	wp.lck.Lock()
+	for wp.running >= wp.parallel || (wp.overloaded && wp.running > 0) {
+		wp.cond.Wait()
 	}
+	wp.running++
+	wp.lck.Unlock()
+	wp.stop.Add(1)
+	go func() {
+		defer wp.stop.Done()
+		task.Run(tracker)
+		wp.lck.Lock()
+		wp.running--
+		wp.cond.Broadcast()
+		wp.lck.Unlock()
+	}()
 }
 
-func (pwr *poolWorkRunner) Close() error {
-	close(pwr.workch)
-	pwr.stop.Wait()
+// Close waits for running tasks to finish, and stops the load monitor.
+func (wp *WorkPool) Close() error {
+	wp.SetLoadLimit(nil)
+	wp.stop.Wait()
 	return nil
 }
 
@@ -1,9 +1,12 @@
 package xgraph
 
 import (
+	"errors"
 	"io"
+	"runtime"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestWorkPool(t *testing.T) {
@@ -44,3 +47,169 @@ func TestWorkPool(t *testing.T) {
 		tv.genTest(t)
 	}
 }
+
+// poolTracker tracks the tasks running on a WorkPool.
+type poolTracker struct {
+	lck          sync.Mutex
+	running, max int
+	release      chan struct{}
+	wg           sync.WaitGroup
+}
+
+// start starts a task on the pool, which runs until a value is sent on release.
+func (pt *poolTracker) start(wp *WorkPool) {
+	pt.wg.Add(1)
+	wp.DoTask(func() error {
+		pt.lck.Lock()
+		pt.running++
+		if pt.running > pt.max {
+			pt.max = pt.running
+		}
+		pt.lck.Unlock()
+		<-pt.release
+		pt.lck.Lock()
+		pt.running--
+		pt.lck.Unlock()
+		return nil
+	}, CallbackTracker(func(error) { pt.wg.Done() }))
+}
+
+// waitRunning waits until n tasks are running.
+func (pt *poolTracker) waitRunning(n int) {
+	for {
+		pt.lck.Lock()
+		running := pt.running
+		pt.lck.Unlock()
+		if running == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkPoolResize(t *testing.T) {
+	tests := []testCase{
+		{
+			Name: "grow",
+			Func: func() int {
+				defer timeout()()
+				wp := NewResizableWorkPool(1)
+				defer wp.Close()
+				pt := &poolTracker{release: make(chan struct{})}
+				pt.start(wp)
+				pt.waitRunning(1)
+				done := make(chan struct{})
+				go func() { //blocks until the pool grows
+					defer close(done)
+					pt.start(wp)
+					pt.start(wp)
+				}()
+				wp.SetParallelism(3)
+				<-done
+				pt.waitRunning(3)
+				close(pt.release)
+				pt.wg.Wait()
+				return pt.max
+			},
+			Expect: []interface{}{3},
+		},
+		{
+			Name: "shrink",
+			Func: func() int {
+				defer timeout()()
+				wp := NewResizableWorkPool(2)
+				defer wp.Close()
+				pt := &poolTracker{release: make(chan struct{})}
+				pt.start(wp)
+				pt.start(wp)
+				pt.waitRunning(2)
+				wp.SetParallelism(1)
+				pt.lck.Lock()
+				pt.max = 0
+				pt.lck.Unlock()
+				go func() {
+					for i := 0; i < 4; i++ {
+						pt.release <- struct{}{}
+					}
+				}()
+				for i := 0; i < 2; i++ {
+					pt.start(wp)
+				}
+				pt.wg.Wait()
+				return pt.max
+			},
+			Expect: []interface{}{1},
+		},
+		{
+			Name: "overloaded",
+			Func: func() (int, error) {
+				defer timeout()()
+				wp := NewResizableWorkPool(4)
+				defer wp.Close()
+				loadch := make(chan SystemLoad)
+				defer close(loadch)
+				wp.readLoad = func() (SystemLoad, error) {
+					return <-loadch, nil
+				}
+				wp.SetLoadLimit(&LoadLimit{MaxLoad: 1, MinMemory: 0.1, Interval: time.Millisecond})
+				loadch <- SystemLoad{Load: 2, Memory: 0.5}
+				loadch <- SystemLoad{Load: 2, Memory: 0.5} //the first load has been applied
+				pt := &poolTracker{release: make(chan struct{})}
+				for i := 0; i < 3; i++ {
+					pt.start(wp) //the first is started, and the others wait for it to finish
+					go func() { pt.release <- struct{}{} }()
+				}
+				pt.wg.Wait()
+				if pt.max != 1 {
+					return 0, errors.New("tasks were started while overloaded")
+				}
+
+				//the memory limit also holds back tasks
+				loadch <- SystemLoad{Load: 0.5, Memory: 0.05}
+				loadch <- SystemLoad{Load: 0.5, Memory: 0.05}
+				pt.start(wp)
+				go func() { pt.start(wp) }()
+				time.Sleep(10 * time.Millisecond)
+				if pt.max != 1 {
+					return 0, errors.New("tasks were started while memory was low")
+				}
+
+				//once the load drops, the limit is lifted
+				loadch <- SystemLoad{Load: 0.5, Memory: 0.5}
+				loadch <- SystemLoad{Load: 0.5, Memory: 0.5}
+				pt.waitRunning(2)
+				wp.SetLoadLimit(nil)
+				close(pt.release)
+				pt.wg.Wait()
+				return pt.max, nil
+			},
+			Expect: []interface{}{2, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+}
+
+func TestSystemLoad(t *testing.T) {
+	tests := []testCase{
+		{
+			Name:   "loadavg",
+			Func:   parseLoadavg,
+			Args:   []interface{}{"1.50 0.58 0.59 1/345 12345\n"},
+			Expect: []interface{}{1.5, nil},
+		},
+		{
+			Name:   "meminfo",
+			Func:   parseMeminfo,
+			Args:   []interface{}{"MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    4000000 kB\n"},
+			Expect: []interface{}{0.25, nil},
+		},
+	}
+	for _, tv := range tests {
+		tv.genTest(t)
+	}
+	if _, err := ReadSystemLoad(); err != nil && runtime.GOOS == "linux" {
+		t.Errorf("failed to read system load: %v", err)
+	}
+}